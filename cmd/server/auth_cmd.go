@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hugr-lab/hugr/pkg/auth"
+)
+
+const authUsage = `Usage:
+  server auth validate <file>     check the auth providers config file (JSON or YAML)
+  server auth schema [json|yaml]  print the JSON Schema of the auth providers config file (default: yaml)
+`
+
+// runAuthCommand runs the auth subcommand and returns the exit code.
+func runAuthCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, authUsage)
+		return 2
+	}
+	switch args[0] {
+	case "validate":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, authUsage)
+			return 2
+		}
+		pc, err := auth.LoadFile(args[1])
+		if err == nil {
+			err = pc.Validate()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid auth config:\n%v\n", args[1], err)
+			return 1
+		}
+		fmt.Printf("%s: auth config is valid\n", args[1])
+		return 0
+	case "schema":
+		format := "yaml"
+		if len(args) > 1 {
+			format = args[1]
+		}
+		if format != "json" && format != "yaml" || len(args) > 2 {
+			fmt.Fprint(os.Stderr, authUsage)
+			return 2
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(auth.ConfigSchema(format)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprint(os.Stderr, authUsage)
+	return 2
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	"github.com/hugr-lab/hugr/pkg/auth"
@@ -21,6 +22,14 @@ type Config struct {
 	ServiceBind string
 	Cluster     cluster.ClusterConfig
 
+	ServiceDebugToken   string
+	ServiceTLS          bool
+	ServiceTLSCertFile  string
+	ServiceTLSKeyFile   string
+	ServiceAuthToken    string
+	ServiceAuthUsername string
+	ServiceAuthPassword string
+
 	EnableAdminUI      bool
 	AdminUIFetchPath   string
 	DebugMode          bool
@@ -34,7 +43,8 @@ type Config struct {
 	SchemaCacheTTL        time.Duration
 	MCPEnabled            bool
 
-	DB db.Config
+	DB                db.Config
+	DBMetricsInterval time.Duration
 
 	CoreDB coredb.Config
 
@@ -72,6 +82,7 @@ func initEnvs() {
 	viper.SetDefault("DB_PATH", "")
 	viper.SetDefault("DB_MAX_OPEN_CONNS", 0)
 	viper.SetDefault("DB_MAX_IDLE_CONNS", 0)
+	viper.SetDefault("DB_METRICS_INTERVAL", 15*time.Second)
 	viper.SetDefault("ALLOWED_ANONYMOUS", true)
 	viper.SetDefault("ANONYMOUS_ROLE", "admin")
 	viper.SetDefault("CLUSTER_ENABLED", false)
@@ -82,6 +93,7 @@ func initEnvs() {
 	viper.SetDefault("OIDC_CLIENT_SECRET", "")
 	viper.SetDefault("OIDC_SCOPES", "openid profile email")
 	viper.SetDefault("OIDC_REDIRECT_URL", "")
+	viper.SetDefault("OIDC_TOKEN_CACHE_SIZE", 10000)
 	viper.SetDefault("MCP_OAUTH_CLIENT_ID", "")
 	viper.SetDefault("MCP_OAUTH_CLIENT_SECRET", "")
 	viper.SetDefault("HUGR_APP_HEARTBEAT_INTERVAL", "30s")
@@ -89,13 +101,21 @@ func initEnvs() {
 	viper.SetDefault("HUGR_APP_HEARTBEAT_RETRIES", 3)
 	viper.SetDefault("TLS_CERT_FILE", "")
 	viper.SetDefault("TLS_KEY_FILE", "")
+	viper.SetDefault("SERVICE_TLS", false)
 	viper.AutomaticEnv()
 }
 
 func loadConfig() Config {
 	return Config{
-		Bind:        viper.GetString("BIND"),
-		ServiceBind: viper.GetString("SERVICE_BIND"),
+		Bind:                viper.GetString("BIND"),
+		ServiceBind:         viper.GetString("SERVICE_BIND"),
+		ServiceDebugToken:   viper.GetString("SERVICE_DEBUG_TOKEN"),
+		ServiceTLS:          viper.GetBool("SERVICE_TLS"),
+		ServiceTLSCertFile:  viper.GetString("SERVICE_TLS_CERT_FILE"),
+		ServiceTLSKeyFile:   viper.GetString("SERVICE_TLS_KEY_FILE"),
+		ServiceAuthToken:    viper.GetString("SERVICE_AUTH_TOKEN"),
+		ServiceAuthUsername: viper.GetString("SERVICE_AUTH_USERNAME"),
+		ServiceAuthPassword: viper.GetString("SERVICE_AUTH_PASSWORD"),
 		Cluster: cluster.ClusterConfig{
 			Enabled:      viper.GetBool("CLUSTER_ENABLED"),
 			Role:         viper.GetString("CLUSTER_ROLE"),
@@ -134,6 +154,7 @@ func loadConfig() Config {
 				PGPagesPerTask:       viper.GetInt("DB_PG_PAGES_PER_TASK"),
 			},
 		},
+		DBMetricsInterval: viper.GetDuration("DB_METRICS_INTERVAL"),
 		CoreDB: coredb.Config{
 			Path:       viper.GetString("CORE_DB_PATH"),
 			VectorSize: viper.GetInt("EMBEDDER_VECTOR_SIZE"),
@@ -154,17 +175,67 @@ func loadConfig() Config {
 			ManagementApiKeys: viper.GetBool("ALLOW_MANAGED_API_KEYS"),
 			AnonymousRole:     viper.GetString("ANONYMOUS_ROLE"),
 			SecretKey:         viper.GetString("SECRET_KEY"),
+			SecretKeyHash:     viper.GetString("SECRET_KEY_HASH"),
 			ConfigFile:        viper.GetString("AUTH_CONFIG_FILE"),
+			APIKeysLifecycle: auth.ManagedAPIKeysConfig{
+				UsageFlushInterval:  viper.GetDuration("AUTH_API_KEYS_USAGE_FLUSH_INTERVAL"),
+				InactiveAfter:       viper.GetDuration("AUTH_API_KEYS_INACTIVE_AFTER"),
+				ExpireInactive:      viper.GetBool("AUTH_API_KEYS_EXPIRE_INACTIVE"),
+				RotationGracePeriod: viper.GetDuration("AUTH_API_KEYS_ROTATION_GRACE_PERIOD"),
+			},
+			Denylist: auth.DenylistConfig{
+				Enabled:         viper.GetBool("AUTH_DENYLIST"),
+				RefreshInterval: viper.GetDuration("AUTH_DENYLIST_REFRESH_INTERVAL"),
+				AdminRoles:      stringList("AUTH_DENYLIST_ADMIN_ROLES"),
+			},
+			Audit: auth.AuditConfig{
+				Enabled:     viper.GetBool("AUTH_AUDIT"),
+				Sink:        viper.GetString("AUTH_AUDIT_SINK"),
+				File:        viper.GetString("AUTH_AUDIT_FILE"),
+				Retention:   viper.GetDuration("AUTH_AUDIT_RETENTION"),
+				MaxFileSize: viper.GetInt64("AUTH_AUDIT_MAX_FILE_SIZE"),
+				MaxFiles:    viper.GetInt("AUTH_AUDIT_MAX_FILES"),
+			},
+			Lockout: auth.LockoutConfig{
+				Enabled:               viper.GetBool("AUTH_LOCKOUT"),
+				IPMaxFailures:         viper.GetInt("AUTH_LOCKOUT_IP_MAX_FAILURES"),
+				CredentialMaxFailures: viper.GetInt("AUTH_LOCKOUT_CREDENTIAL_MAX_FAILURES"),
+				Window:                viper.GetDuration("AUTH_LOCKOUT_WINDOW"),
+				Duration:              viper.GetDuration("AUTH_LOCKOUT_DURATION"),
+				MaxDuration:           viper.GetDuration("AUTH_LOCKOUT_MAX_DURATION"),
+			},
+			Impersonation: auth.ImpersonationConfig{
+				Disabled: viper.GetBool("AUTH_IMPERSONATION_DISABLED"),
+			},
+			Login: auth.LoginConfig{
+				Enabled:    viper.GetBool("AUTH_LOGIN"),
+				CookieName: viper.GetString("AUTH_LOGIN_COOKIE_NAME"),
+				SessionTTL: viper.GetDuration("AUTH_LOGIN_SESSION_TTL"),
+			},
+			TrustedProxies:     stringList("AUTH_TRUSTED_PROXIES"),
+			RedirectLoginPaths: stringList("AUTH_REDIRECT_LOGIN_PATHS"),
+			LoginUrl:           viper.GetString("AUTH_LOGIN_URL"),
+			RedirectUrl:        viper.GetString("AUTH_REDIRECT_URL"),
 			OIDC: auth.OIDCConfig{
-				Issuer:          viper.GetString("OIDC_ISSUER"),
-				ClientID:        viper.GetString("OIDC_CLIENT_ID"),
-				Timeout:         viper.GetDuration("OIDC_TIMEOUT"),
-				TLSInsecure:     viper.GetBool("OIDC_TLS_INSECURE"),
-				CookieName:      viper.GetString("OIDC_COOKIE_NAME"),
-				ClientSecret:    viper.GetString("OIDC_CLIENT_SECRET"),
-				Scopes:          viper.GetString("OIDC_SCOPES"),
-				RedirectURL:     viper.GetString("OIDC_REDIRECT_URL"),
-				ScopeRolePrefix: viper.GetString("OIDC_SCOPE_ROLE_PREFIX"),
+				Issuer:              viper.GetString("OIDC_ISSUER"),
+				ClientID:            viper.GetString("OIDC_CLIENT_ID"),
+				Timeout:             viper.GetDuration("OIDC_TIMEOUT"),
+				TLSInsecure:         viper.GetBool("OIDC_TLS_INSECURE"),
+				CookieName:          viper.GetString("OIDC_COOKIE_NAME"),
+				ClientSecret:        viper.GetString("OIDC_CLIENT_SECRET"),
+				Scopes:              viper.GetString("OIDC_SCOPES"),
+				RedirectURL:         viper.GetString("OIDC_REDIRECT_URL"),
+				ScopeRolePrefix:     viper.GetString("OIDC_SCOPE_ROLE_PREFIX"),
+				DefaultRole:         viper.GetString("OIDC_DEFAULT_ROLE"),
+				RoleHeader:          viper.GetString("OIDC_ROLE_HEADER"),
+				Audiences:           stringList("OIDC_AUDIENCES"),
+				MaxTokenAge:         viper.GetDuration("OIDC_MAX_TOKEN_AGE"),
+				UserInfo:            viper.GetBool("OIDC_USERINFO"),
+				UserInfoCacheTTL:    viper.GetDuration("OIDC_USERINFO_CACHE_TTL"),
+				JWKSFile:            viper.GetString("OIDC_JWKS_FILE"),
+				JWKSRefreshInterval: viper.GetDuration("OIDC_JWKS_REFRESH_INTERVAL"),
+				TokenCacheSize:      viper.GetInt("OIDC_TOKEN_CACHE_SIZE"),
+				TokenCacheTTL:       viper.GetDuration("OIDC_TOKEN_CACHE_TTL"),
 				Claims: auth.OIDCClaims{
 					UserName: viper.GetString("OIDC_USERNAME_CLAIM"),
 					UserId:   viper.GetString("OIDC_USERID_CLAIM"),
@@ -206,3 +277,15 @@ func loadConfig() Config {
 		},
 	}
 }
+
+// stringList returns the list of the comma separated values of the variable,
+// the values are trimmed and the empty ones are skipped.
+func stringList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(viper.GetString(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLoadConfig_Lists(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "https://idp.example.com")
+	t.Setenv("OIDC_AUDIENCES", "hugr, hugr-admin")
+	t.Setenv("AUTH_DENYLIST_ADMIN_ROLES", "admin,security,")
+	t.Setenv("AUTH_REDIRECT_LOGIN_PATHS", "/admin")
+
+	c := loadConfig()
+	if got := c.Auth.OIDC.Audiences; !slices.Equal(got, []string{"hugr", "hugr-admin"}) {
+		t.Errorf("OIDC audiences = %q", got)
+	}
+	if got := c.Auth.Denylist.AdminRoles; !slices.Equal(got, []string{"admin", "security"}) {
+		t.Errorf("denylist admin roles = %q", got)
+	}
+	if got := c.Auth.RedirectLoginPaths; !slices.Equal(got, []string{"/admin"}) {
+		t.Errorf("redirect login paths = %q", got)
+	}
+
+	t.Setenv("OIDC_AUDIENCES", "")
+	if got := loadConfig().Auth.OIDC.Audiences; len(got) != 0 {
+		t.Errorf("empty OIDC audiences = %q", got)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"database/sql"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -15,13 +17,18 @@ import (
 	"time"
 
 	"github.com/duckdb/duckdb-go/v2"
+	"github.com/hugr-lab/hugr/pkg/apikeys"
+	"github.com/hugr-lab/hugr/pkg/audit"
 	"github.com/hugr-lab/hugr/pkg/auth"
 	"github.com/hugr-lab/hugr/pkg/auth/oauth"
 	"github.com/hugr-lab/hugr/pkg/cors"
+	"github.com/hugr-lab/hugr/pkg/denylist"
 	"github.com/hugr-lab/hugr/pkg/info"
 	"github.com/hugr-lab/hugr/pkg/service"
 	hugr "github.com/hugr-lab/query-engine"
+	qeauth "github.com/hugr-lab/query-engine/pkg/auth"
 	coredb "github.com/hugr-lab/query-engine/pkg/data-sources/sources/runtime/core-db"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -30,6 +37,9 @@ var (
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "auth" {
+		os.Exit(runAuthCommand(flag.Args()[1:]))
+	}
 	if *installFlag {
 		err := installDuckDBExtension()
 		if err != nil {
@@ -47,19 +57,57 @@ func main() {
 			log.Println("Both TLS_CERT_FILE and TLS_KEY_FILE must be set when enabling TLS")
 			os.Exit(1)
 		}
-		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		var err error
+		tlsCfg, err = loadTLSConfig(config.TLSCertFile, config.TLSKeyFile)
 		if err != nil {
 			log.Printf("TLS configuration error: %v\n", err)
 			os.Exit(1)
 		}
-		tlsCfg = &tls.Config{
-			Certificates: []tls.Certificate{cert},
+	}
+
+	// Service endpoint TLS: separate certificate or reuse the main one
+	var serviceTLSCfg *tls.Config
+	switch {
+	case config.ServiceTLSCertFile != "" || config.ServiceTLSKeyFile != "":
+		if config.ServiceTLSCertFile == "" || config.ServiceTLSKeyFile == "" {
+			log.Println("Both SERVICE_TLS_CERT_FILE and SERVICE_TLS_KEY_FILE must be set when enabling TLS for the service endpoint")
+			os.Exit(1)
+		}
+		var err error
+		serviceTLSCfg, err = loadTLSConfig(config.ServiceTLSCertFile, config.ServiceTLSKeyFile)
+		if err != nil {
+			log.Printf("Service TLS configuration error: %v\n", err)
+			os.Exit(1)
 		}
+	case config.ServiceTLS:
+		if tlsCfg == nil {
+			log.Println("SERVICE_TLS requires TLS_CERT_FILE and TLS_KEY_FILE or SERVICE_TLS_CERT_FILE and SERVICE_TLS_KEY_FILE")
+			os.Exit(1)
+		}
+		serviceTLSCfg = tlsCfg.Clone()
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// Start service endpoint before the engine initialization to serve liveness and startup probes
+	svc := service.New(service.Config{
+		Bind:       config.ServiceBind,
+		Profiling:  config.HttpProfiling,
+		DebugToken: config.ServiceDebugToken,
+		TLS:        serviceTLSCfg,
+		Auth: service.AuthConfig{
+			BearerToken: config.ServiceAuthToken,
+			Username:    config.ServiceAuthUsername,
+			Password:    config.ServiceAuthPassword,
+		},
+	})
+	err := svc.Start(ctx)
+	if err != nil {
+		log.Println("Services endpoint server start error:", err)
+		os.Exit(1)
+	}
+
 	// Validate cluster configuration
 	if config.Cluster.Enabled {
 		if config.Cluster.Role != "management" && config.Cluster.Role != "worker" {
@@ -78,12 +126,16 @@ func main() {
 		log.Println("Auth configuration error:", err)
 		os.Exit(1)
 	}
+	trustedProxies, err := auth.ParseTrustedProxies(config.Auth.TrustedProxies)
+	if err != nil {
+		log.Println("Auth configuration error:", err)
+		os.Exit(1)
+	}
 
 	hugrConfig := hugr.Config{
 		AdminUI:               config.EnableAdminUI,
 		AdminUIFetchPath:      config.AdminUIFetchPath,
 		Debug:                 config.DebugMode,
-		Profiling:             config.HttpProfiling,
 		AllowParallel:         config.AllowParallel,
 		MaxParallelQueries:    config.MaxParallelQueries,
 		MaxDepth:              config.MaxDepthInTypes,
@@ -128,18 +180,49 @@ func main() {
 		auth.PrintSummary(hugrConfig.Auth)
 	}
 
-	err = engine.AttachRuntimeSource(ctx, info.New(info.NodeInfo{
+	infoSource := info.New(info.NodeInfo{
 		Version:   Version,
 		BuildDate: BuildDate,
 		InCluster: config.Cluster.Enabled,
 		NodeRole:  config.Cluster.Role,
 		NodeName:  config.Cluster.NodeName,
-	}))
+	})
+	err = engine.AttachRuntimeSource(ctx, infoSource)
 	if err != nil {
 		log.Println("Attach version source error:", err)
 		os.Exit(1)
 	}
 
+	var denylistSource *denylist.Source
+	if dl := auth.ConfiguredDenylist(authConfig); dl != nil {
+		denylistSource = denylist.New(dl, config.CoreDB.ReadOnly)
+		err = engine.AttachRuntimeSource(ctx, denylistSource)
+		if err != nil {
+			log.Println("Attach denylist source error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var auditSource *audit.Source
+	if a := auth.ConfiguredAuditor(authConfig); a != nil && a.Config.Sink == auth.AuditSinkCoreDB {
+		auditSource = audit.New(a, config.CoreDB.ReadOnly)
+		err = engine.AttachRuntimeSource(ctx, auditSource)
+		if err != nil {
+			log.Println("Attach audit source error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var apiKeysSource *apikeys.Source
+	if mp := auth.ConfiguredManagedAPIKeys(authConfig); mp != nil {
+		apiKeysSource = apikeys.New(mp, config.CoreDB.ReadOnly)
+		err = engine.AttachRuntimeSource(ctx, apiKeysSource)
+		if err != nil {
+			log.Println("Attach api keys source error:", err)
+			os.Exit(1)
+		}
+	}
+
 	err = engine.Init(ctx)
 	if err != nil {
 		log.Println("Initialization error:", err)
@@ -147,6 +230,53 @@ func main() {
 	}
 	defer engine.Close()
 
+	if apiKeysSource != nil {
+		if err := apiKeysSource.Start(ctx); err != nil {
+			log.Println("Managed API keys initialization error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if denylistSource != nil {
+		if err := denylistSource.Start(ctx); err != nil {
+			log.Println("Denylist initialization error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if auditSource != nil {
+		if err := auditSource.Start(ctx); err != nil {
+			log.Println("Audit log initialization error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var l2Cache *service.L2Cache
+	if config.Cache.L2.Enabled {
+		l2Cache = service.NewL2Cache(config.Cache.L2)
+	}
+	lockout := auth.ConfiguredLockout(authConfig)
+	if lockout != nil && config.Cluster.Enabled {
+		// the failure counters are shared by the cluster nodes through the L2 cache
+		if l2Cache != nil {
+			lockout.SetStore(auth.NewCacheLockoutStore(l2Cache.Store, l2Cache))
+		} else {
+			log.Println("Auth lockout: the L2 cache is not enabled, the failure counters are not shared by the cluster nodes")
+		}
+	}
+	addReadinessChecks(svc, config, authConfig, engine, infoSource, l2Cache)
+	addAdminOperations(svc, engine, authConfig, infoSource, l2Cache)
+	if config.ServiceBind != "" && infoSource.Pool() != nil {
+		dm := service.NewDuckDBMetrics(infoSource.Pool(), config.DB, config.DBMetricsInterval)
+		prometheus.MustRegister(dm)
+		go dm.Run(ctx)
+	}
+	if config.ServiceBind != "" {
+		if err := auth.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+			log.Println("Auth metrics registration error:", err)
+		}
+	}
+
 	var handler http.Handler = engine
 
 	// Add /auth/config and OAuth proxy endpoints if OIDC is configured
@@ -154,7 +284,7 @@ func main() {
 		mux := http.NewServeMux()
 		mux.HandleFunc("GET /auth/config", config.Auth.AuthConfigHandler())
 
-		// Mount OAuth proxy for MCP clients when MCP is enabled
+		// Mount OAuth proxy for MCP clients when MCP is enabled (uses the default OIDC provider)
 		mcpClientID := config.MCPOAuthClientID
 		mcpClientSecret := config.MCPOAuthClientSecret
 		// Fall back to OIDC client credentials if MCP-specific ones are not set
@@ -164,7 +294,7 @@ func main() {
 		if mcpClientSecret == "" {
 			mcpClientSecret = config.Auth.OIDC.ClientSecret
 		}
-		if config.MCPEnabled && mcpClientSecret != "" {
+		if config.MCPEnabled && mcpClientSecret != "" && config.Auth.OIDC.Issuer != "" {
 			oauthProxy, err := oauth.NewProxy(ctx, oauth.Config{
 				Issuer:       config.Auth.OIDC.Issuer,
 				ClientID:     mcpClientID,
@@ -179,12 +309,41 @@ func main() {
 				os.Exit(1)
 			}
 			oauthProxy.RegisterHandlers(mux)
+			svc.AddCheck("oauth_proxy", func(ctx context.Context) error { return oauthProxy.Ready() })
 			log.Println("MCP OAuth proxy enabled")
 		}
 
-		mux.Handle("/", engine)
+		var engineHandler http.Handler = engine
+		// Mount the browser login endpoints, the session cookie is converted into the bearer token
+		if config.Auth.LoginEnabled() {
+			loginProxy, err := oauth.NewProxy(ctx, oauth.Config{
+				Issuer:       config.Auth.OIDC.Issuer,
+				ClientID:     config.Auth.OIDC.ClientID,
+				ClientSecret: config.Auth.OIDC.ClientSecret,
+				Scopes:       config.Auth.OIDC.Scopes,
+				TLSInsecure:  config.Auth.OIDC.TLSInsecure,
+				SecretKey:    config.Auth.SecretKey,
+			})
+			if err != nil {
+				log.Println("Browser login initialization error:", err)
+				os.Exit(1)
+			}
+			loginProxy.RegisterLoginHandlers(mux, config.Auth.OAuthLoginConfig())
+			svc.AddCheck("auth_login", func(ctx context.Context) error { return loginProxy.Ready() })
+			engineHandler = loginProxy.SessionMiddleware(engine)
+			log.Println("Browser login enabled")
+		} else if config.Auth.Login.Enabled {
+			log.Println("Browser login: the default OIDC provider is not configured, the login is disabled")
+		}
+
+		mux.Handle("/", engineHandler)
 		handler = mux
 	}
+	if lockout != nil {
+		handler = lockout.Middleware(handler)
+	}
+	// the client IP of the requests from the reverse proxies is resolved before the lockout and the auth
+	handler = trustedProxies.Middleware(handler)
 
 	srv := &http.Server{
 		Addr:      config.Bind,
@@ -216,11 +375,7 @@ func main() {
 			os.Exit(1)
 		}
 	}()
-	svc := service.New(config.ServiceBind)
-	err = svc.Start(ctx)
-	if err != nil {
-		log.Println("Services endpoint server start error:", err)
-	}
+	svc.MarkStarted()
 	<-ctx.Done()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -237,6 +392,84 @@ func main() {
 	log.Println("Server shutdown")
 }
 
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// addReadinessChecks registers the component checks for the readiness probe.
+func addReadinessChecks(svc *service.Service, config Config, authConfig *qeauth.Config, engine *hugr.Service, infoSource *info.Source, l2Cache *service.L2Cache) {
+	pool := infoSource.Pool()
+	svc.AddCheck("duckdb", service.DBCheck(pool, "SELECT 1"))
+	svc.AddCheck("coredb", service.DBCheck(pool, `SELECT "version" FROM core."version" LIMIT 1`))
+	if l2Cache != nil {
+		svc.AddCheck("cache_l2", service.L2CacheCheck(l2Cache))
+	}
+	if config.Embedder.URL != "" {
+		svc.AddCheck("embedder", service.DialCheck(config.Embedder.URL))
+	}
+	if config.Auth.OIDCEnabled() {
+		// only the discovery state of the providers is reported, the IdP isn't called by the probe,
+		// so its short outage doesn't make the node unready for the other auth providers
+		svc.AddCheck("oidc", auth.CheckProviders(authConfig))
+	}
+	if config.Cluster.Enabled {
+		svc.AddCheck("cluster", service.ClusterCheck(engine.ClusterSource()))
+	}
+}
+
+// addAdminOperations registers the runtime admin operations on the service endpoint.
+// engineDebug is implemented by the query engine that can switch the SQL debug output at runtime.
+type engineDebug interface {
+	SetDebug(enabled bool)
+}
+
+func addAdminOperations(svc *service.Service, engine any, authConfig *qeauth.Config, infoSource *info.Source, l2Cache *service.L2Cache) {
+	// switch the SQL debug output (DEBUG) if the query engine supports it
+	if e, ok := engine.(engineDebug); ok {
+		svc.AddAdminOperation("debug", service.DebugOperation(e.SetDebug))
+	} else {
+		log.Println("Admin: the query engine doesn't support switching the debug output at runtime, the debug operation is not registered")
+	}
+	// flush the query cache (L1 and L2), with level=l2 only the L2 cache backend is cleared
+	svc.AddAdminOperation("cache/flush", func(ctx context.Context, params url.Values) (string, error) {
+		switch params.Get("level") {
+		case "":
+			pool := infoSource.Pool()
+			if pool == nil {
+				return "", errors.New("database is not connected")
+			}
+			if _, err := pool.Exec(qeauth.ContextWithFullAccess(ctx), "SELECT invalidate_cache()"); err != nil {
+				return "", err
+			}
+			return "cache flushed", nil
+		case "l2":
+			if l2Cache == nil {
+				return "", errors.New("L2 cache is not enabled")
+			}
+			if err := l2Cache.Clear(ctx); err != nil {
+				return "", err
+			}
+			return "L2 cache flushed", nil
+		default:
+			return "", fmt.Errorf("%w: unknown cache level %q", service.ErrInvalidParams, params.Get("level"))
+		}
+	})
+	// force the OIDC discovery to refresh the issuer signing keys (JWKS)
+	svc.AddAdminOperation("oidc/rediscover", func(ctx context.Context, params url.Values) (string, error) {
+		n, err := auth.RediscoverOIDC(ctx, authConfig)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d OIDC providers rediscovered", n), nil
+	})
+}
+
 func installDuckDBExtension() error {
 	connector, err := duckdb.NewConnector("", nil)
 	if err != nil {
@@ -0,0 +1,493 @@
+package apikeys
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/catalog/compiler"
+	"github.com/hugr-lab/query-engine/pkg/catalog/sources"
+	rtsources "github.com/hugr-lab/query-engine/pkg/data-sources/sources"
+	"github.com/hugr-lab/query-engine/pkg/data-sources/sources/runtime"
+	"github.com/hugr-lab/query-engine/pkg/db"
+	"github.com/hugr-lab/query-engine/pkg/engines"
+	"github.com/hugr-lab/query-engine/types"
+
+	_ "embed"
+)
+
+// The API keys runtime source for hugr query engine that stores the managed API keys hashed
+// in the core.api_keys table and exposes the admin functions:
+// 1. core.apikeys.create - creates the key and returns it once
+// 2. core.apikeys.rotate - replaces the key, the previous one is valid during the grace period
+// 3. core.apikeys.set_scope - limits the key to the modules, data sources or read-only queries
+// 4. core.apikeys.inactive - lists the keys that are not used for the given period
+// The keys are looked up by the key_prefix column and verified by the salted hash stored in the key column.
+// The CoreDB version is owned by the engine, so the table is migrated at the startup:
+// the lifecycle columns are added and the plaintext keys are hashed.
+
+//go:embed schema.graphql
+var schema string
+
+const adminRole = "admin"
+
+var ErrNotAdmin = errors.New("api keys management is allowed for admins only")
+
+var _ (rtsources.RuntimeSource) = (*Source)(nil)
+var _ (hugrauth.ManagedAPIKeyStore) = (*Source)(nil)
+
+type Source struct {
+	provider *hugrauth.ManagedAPIKeyProvider
+	readOnly bool
+	pool     *db.Pool
+}
+
+// New creates the API keys source, the plaintext keys are not hashed in the readOnly CoreDB.
+func New(p *hugrauth.ManagedAPIKeyProvider, readOnly bool) *Source {
+	return &Source{
+		provider: p,
+		readOnly: readOnly,
+	}
+}
+
+func (*Source) Name() string {
+	return "core.apikeys"
+}
+
+func (*Source) Engine() engines.Engine {
+	return engines.NewDuckDB()
+}
+
+func (*Source) IsReadonly() bool {
+	return false
+}
+
+func (*Source) AsModule() bool {
+	return true
+}
+
+func (s *Source) Attach(ctx context.Context, pool *db.Pool) error {
+	s.pool = pool
+	return s.registerUDFs(ctx)
+}
+
+func (s *Source) Catalog(ctx context.Context) (sources.Catalog, error) {
+	e := engines.NewDuckDB()
+	opts := compiler.Options{
+		Name:         s.Name(),
+		Prefix:       "core_apikeys",
+		ReadOnly:     s.IsReadonly(),
+		AsModule:     s.AsModule(),
+		EngineType:   string(e.Type()),
+		Capabilities: e.Capabilities(),
+	}
+	return sources.NewStringSource(s.Name(), e, opts, schema)
+}
+
+// Start migrates the api_keys table, sets the source as the keys store of the provider
+// and writes the keys usage, hashes the plaintext keys and checks the inactive keys until the context is done.
+// It should be called after the engine initialization (the CoreDB is attached).
+func (s *Source) Start(ctx context.Context) error {
+	if s.pool == nil {
+		return errors.New("api keys source is not attached")
+	}
+	if !s.readOnly {
+		if err := s.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+	if s.provider != nil {
+		s.provider.SetStore(s)
+		go s.run(ctx)
+	}
+	return nil
+}
+
+// migrateColumns are the columns added to the api_keys table.
+var migrateColumns = []string{
+	"key_prefix VARCHAR",
+	"previous_key VARCHAR",
+	"previous_key_prefix VARCHAR",
+	"previous_key_expires_at TIMESTAMP",
+	"last_used_at TIMESTAMP",
+	"last_used_ip VARCHAR",
+	"scope VARCHAR",
+}
+
+// Migrate adds the lifecycle columns and replaces the plaintext keys with their hashes.
+func (s *Source) Migrate(ctx context.Context) error {
+	for _, c := range migrateColumns {
+		_, err := s.pool.Exec(ctx, `ALTER TABLE core.api_keys ADD COLUMN IF NOT EXISTS `+c)
+		if err != nil {
+			return fmt.Errorf("add api keys column %s: %w", c, err)
+		}
+	}
+	return s.HashPlaintextKeys(ctx)
+}
+
+// HashPlaintextKeys replaces the plaintext keys with their hashes. It is called at the startup and
+// periodically after it, so the keys inserted by the core.insert_api_keys mutation are not kept in plaintext
+// until their first use.
+func (s *Source) HashPlaintextKeys(ctx context.Context) error {
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(ctx, `SELECT name, key FROM core.api_keys WHERE key_prefix IS NULL`)
+	if err != nil {
+		return fmt.Errorf("load plaintext api keys: %w", err)
+	}
+	type plainKey struct{ name, key string }
+	var keys []plainKey
+	for rows.Next() {
+		var k plainKey
+		if err := rows.Scan(&k.name, &k.key); err != nil {
+			rows.Close()
+			return fmt.Errorf("load plaintext api keys: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("load plaintext api keys: %w", err)
+	}
+	for _, k := range keys {
+		if err := s.hashKey(ctx, k.name, k.key); err != nil {
+			return err
+		}
+	}
+	if len(keys) != 0 {
+		log.Printf("Auth: managed api keys: %d plaintext keys are hashed", len(keys))
+	}
+	return nil
+}
+
+// hashKey replaces the plaintext key with its hash.
+func (s *Source) hashKey(ctx context.Context, name, key string) error {
+	hash, err := hugrauth.HashAPIKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `UPDATE core.api_keys SET key = $1, key_prefix = $2 WHERE name = $3 AND key = $4`,
+		hash, hugrauth.APIKeyPrefix(key), name, key,
+	)
+	if err != nil {
+		return fmt.Errorf("hash api key %s: %w", name, err)
+	}
+	return nil
+}
+
+// FindAPIKey finds the key by its prefix and verifies its hash, the previous key is found during the rotation
+// grace period. The plaintext key inserted after the startup (e.g. by the core.insert_api_keys mutation)
+// is hashed on the first use if it is used before the periodic hashing.
+func (s *Source) FindAPIKey(ctx context.Context, key string) (*hugrauth.ManagedAPIKey, error) {
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	prefix := hugrauth.APIKeyPrefix(key)
+	rows, err := conn.Query(ctx, `SELECT name, key, key_prefix, previous_key, previous_key_expires_at,
+			default_role, disabled, is_temporal, expires_at, headers::VARCHAR, claims::VARCHAR, scope
+		FROM core.api_keys
+		WHERE key_prefix = $1 OR (key_prefix IS NULL AND key = $2)
+			OR (previous_key_prefix = $1 AND previous_key_expires_at > $3)`,
+		prefix, key, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("find api key: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k hugrauth.ManagedAPIKey
+		var stored string
+		var storedPrefix, previous, headers, claims, scope *string
+		var expiresAt, previousExpiresAt *time.Time
+		err := rows.Scan(&k.Name, &stored, &storedPrefix, &previous, &previousExpiresAt,
+			&k.DefaultRole, &k.Disabled, &k.IsTemporal, &expiresAt, &headers, &claims, &scope)
+		if err != nil {
+			return nil, fmt.Errorf("find api key: %w", err)
+		}
+		switch {
+		case storedPrefix == nil:
+			// the plaintext key is matched by the query
+		case hugrauth.VerifyAPIKey(stored, key):
+		case previous != nil && previousExpiresAt != nil && hugrauth.VerifyAPIKey(*previous, key):
+			k.Previous = true
+			k.GraceExpiresAt = *previousExpiresAt
+		default:
+			continue
+		}
+		if expiresAt != nil {
+			k.ExpiresAt = *expiresAt
+		}
+		if headers != nil {
+			if err := json.Unmarshal([]byte(*headers), &k.Headers); err != nil {
+				return nil, fmt.Errorf("api key %s headers: %w", k.Name, err)
+			}
+		}
+		if claims != nil {
+			if err := json.Unmarshal([]byte(*claims), &k.Claims); err != nil {
+				return nil, fmt.Errorf("api key %s claims: %w", k.Name, err)
+			}
+		}
+		if scope != nil && *scope != "" {
+			if err := json.Unmarshal([]byte(*scope), &k.Scope); err != nil {
+				return nil, fmt.Errorf("api key %s scope: %w", k.Name, err)
+			}
+		}
+		rows.Close()
+		if err := s.resolveDataSources(ctx, &k.Scope); err != nil {
+			return nil, err
+		}
+		if storedPrefix == nil && !s.readOnly {
+			if err := s.hashKey(ctx, k.Name, key); err != nil {
+				log.Printf("Auth: managed api keys: %v", err)
+			}
+		}
+		return &k, nil
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("find api key: %w", err)
+	}
+	return nil, hugrauth.ErrAPIKeyNotFound
+}
+
+// NewAPIKey describes the created API key.
+type NewAPIKey struct {
+	Name        string
+	Description string
+	DefaultRole string
+	// TTL is the key lifetime, 0 - the key doesn't expire
+	TTL time.Duration
+}
+
+// Create stores the hash of the new random key and returns the key, it can't be restored later.
+func (s *Source) Create(ctx context.Context, k NewAPIKey) (string, error) {
+	if s.readOnly {
+		return "", errors.New("core db is read-only")
+	}
+	if k.Name == "" || k.DefaultRole == "" {
+		return "", errors.New("api key name and default role are required")
+	}
+	key, err := hugrauth.GenerateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	hash, err := hugrauth.HashAPIKey(key)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	expiresAt := now
+	if k.TTL > 0 {
+		expiresAt = now.Add(k.TTL)
+	}
+	_, err = s.pool.Exec(ctx, `INSERT INTO core.api_keys (name, key, key_prefix, description, default_role, is_temporal, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		k.Name, hash, hugrauth.APIKeyPrefix(key), k.Description, k.DefaultRole, k.TTL > 0, expiresAt, now,
+	)
+	if err != nil {
+		return "", fmt.Errorf("create api key %s: %w", k.Name, err)
+	}
+	return key, nil
+}
+
+// checkAdmin checks that the request is allowed to manage the API keys.
+func (s *Source) checkAdmin(ctx context.Context) error {
+	if auth.IsFullAccess(ctx) {
+		return nil
+	}
+	info := auth.AuthInfoFromContext(ctx)
+	if info == nil || info.Role != adminRole {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+func (s *Source) registerUDFs(ctx context.Context) error {
+	// core_apikeys_create(name, default_role, description, ttl) → OperationResult, the message is the key
+	type createArgs struct {
+		name        string
+		defaultRole string
+		description string
+		ttl         int32
+	}
+	err := s.pool.RegisterScalarFunction(ctx, &db.ScalarFunctionWithArgs[createArgs, *types.OperationResult]{
+		Name: "core_apikeys_create",
+		Execute: func(ctx context.Context, args createArgs) (*types.OperationResult, error) {
+			if err := s.checkAdmin(ctx); err != nil {
+				return types.ErrResult(err), nil
+			}
+			key, err := s.Create(ctx, NewAPIKey{
+				Name:        args.name,
+				Description: args.description,
+				DefaultRole: args.defaultRole,
+				TTL:         time.Duration(args.ttl) * time.Second,
+			})
+			if err != nil {
+				return types.ErrResult(err), nil
+			}
+			return types.Result(key, 1, 0), nil
+		},
+		ConvertInput: func(args []driver.Value) (createArgs, error) {
+			a := createArgs{name: args[0].(string), defaultRole: args[1].(string)}
+			if args[2] != nil {
+				a.description = args[2].(string)
+			}
+			if args[3] != nil {
+				a.ttl = args[3].(int32)
+			}
+			return a, nil
+		},
+		ConvertOutput: func(out *types.OperationResult) (any, error) {
+			return out.ToDuckdb(), nil
+		},
+		InputTypes: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("INTEGER"),
+		},
+		OutputType:            db.DuckDBOperationResult(),
+		IsSpecialNullHandling: true,
+	})
+	if err != nil {
+		return fmt.Errorf("register core_apikeys_create: %w", err)
+	}
+
+	// core_apikeys_rotate(name, grace_period) → OperationResult, the message is the new key
+	type rotateArgs struct {
+		name  string
+		grace int32
+	}
+	err = s.pool.RegisterScalarFunction(ctx, &db.ScalarFunctionWithArgs[rotateArgs, *types.OperationResult]{
+		Name: "core_apikeys_rotate",
+		Execute: func(ctx context.Context, args rotateArgs) (*types.OperationResult, error) {
+			if err := s.checkAdmin(ctx); err != nil {
+				return types.ErrResult(err), nil
+			}
+			key, err := s.Rotate(ctx, args.name, time.Duration(args.grace)*time.Second)
+			if err != nil {
+				return types.ErrResult(err), nil
+			}
+			return types.Result(key, 1, 0), nil
+		},
+		ConvertInput: func(args []driver.Value) (rotateArgs, error) {
+			a := rotateArgs{name: args[0].(string)}
+			if args[1] != nil {
+				a.grace = args[1].(int32)
+			}
+			return a, nil
+		},
+		ConvertOutput: func(out *types.OperationResult) (any, error) {
+			return out.ToDuckdb(), nil
+		},
+		InputTypes: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("INTEGER"),
+		},
+		OutputType:            db.DuckDBOperationResult(),
+		IsSpecialNullHandling: true,
+	})
+	if err != nil {
+		return fmt.Errorf("register core_apikeys_rotate: %w", err)
+	}
+
+	// core_apikeys_set_scope(name, read_only, modules, data_sources) → OperationResult,
+	// the lists are passed as the JSON arrays
+	type scopeArgs struct {
+		name  string
+		scope hugrauth.APIKeyScope
+	}
+	err = s.pool.RegisterScalarFunction(ctx, &db.ScalarFunctionWithArgs[scopeArgs, *types.OperationResult]{
+		Name: "core_apikeys_set_scope",
+		Execute: func(ctx context.Context, args scopeArgs) (*types.OperationResult, error) {
+			if err := s.checkAdmin(ctx); err != nil {
+				return types.ErrResult(err), nil
+			}
+			if err := s.SetScope(ctx, args.name, args.scope); err != nil {
+				return types.ErrResult(err), nil
+			}
+			return types.Result("scope is set", 1, 0), nil
+		},
+		ConvertInput: func(args []driver.Value) (scopeArgs, error) {
+			a := scopeArgs{name: args[0].(string)}
+			if args[1] != nil {
+				a.scope.ReadOnly = args[1].(bool)
+			}
+			for i, list := range []*[]string{&a.scope.Modules, &a.scope.DataSources} {
+				if args[i+2] == nil {
+					continue
+				}
+				if err := json.Unmarshal([]byte(args[i+2].(string)), list); err != nil {
+					return a, fmt.Errorf("invalid list argument: %w", err)
+				}
+			}
+			return a, nil
+		},
+		ConvertOutput: func(out *types.OperationResult) (any, error) {
+			return out.ToDuckdb(), nil
+		},
+		InputTypes: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("BOOLEAN"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+		},
+		OutputType:            db.DuckDBOperationResult(),
+		IsSpecialNullHandling: true,
+	})
+	if err != nil {
+		return fmt.Errorf("register core_apikeys_set_scope: %w", err)
+	}
+
+	// core_apikeys_inactive(days) → table of the keys not used for the days
+	err = s.pool.RegisterTableRowFunction(ctx, &db.TableRowFunctionWithArgs[int32, InactiveAPIKey]{
+		Name: "core_apikeys_inactive",
+		Arguments: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("INTEGER"),
+		},
+		ConvertArgs: func(named map[string]any, args ...any) (int32, error) {
+			return args[0].(int32), nil
+		},
+		ColumnInfos: []duckdb.ColumnInfo{
+			{Name: "name", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "description", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "default_role", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "created_at", T: runtime.DuckDBTypeInfoByNameMust("TIMESTAMP")},
+			{Name: "last_used_at", T: runtime.DuckDBTypeInfoByNameMust("TIMESTAMP")},
+			{Name: "last_used_ip", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+		},
+		Execute: func(ctx context.Context, days int32) ([]InactiveAPIKey, error) {
+			if err := s.checkAdmin(ctx); err != nil {
+				return nil, err
+			}
+			return s.InactiveKeys(ctx, time.Duration(days)*24*time.Hour)
+		},
+		FillRow: func(k InactiveAPIKey, row duckdb.Row) error {
+			var lastUsedAt, lastUsedIP any
+			if !k.LastUsedAt.IsZero() {
+				lastUsedAt, lastUsedIP = k.LastUsedAt, k.LastUsedIP
+			}
+			for i, v := range []any{k.Name, k.Description, k.DefaultRole, k.CreatedAt, lastUsedAt, lastUsedIP} {
+				if err := row.SetRowValue(i, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("register core_apikeys_inactive: %w", err)
+	}
+	return nil
+}
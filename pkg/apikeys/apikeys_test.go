@@ -0,0 +1,291 @@
+package apikeys
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/db"
+)
+
+// newCorePool creates the in-memory DuckDB pool with the attached in-memory core database
+// and the api_keys table of the CoreDB schema.
+func newCorePool(t *testing.T) *db.Pool {
+	t.Helper()
+	pool, err := db.NewPool("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	_, err = pool.Exec(t.Context(), `ATTACH ':memory:' AS core;
+		CREATE TABLE core.api_keys (
+			name VARCHAR PRIMARY KEY,
+			key VARCHAR NOT NULL UNIQUE,
+			description VARCHAR,
+			default_role VARCHAR NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			is_temporal BOOLEAN NOT NULL DEFAULT FALSE,
+			expires_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			headers JSON,
+			claims JSON,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func storedKey(t *testing.T, pool *db.Pool, name string) (key string, prefix *string) {
+	t.Helper()
+	conn, err := pool.Conn(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.QueryRow(t.Context(), `SELECT key, key_prefix FROM core.api_keys WHERE name = $1`, name).Scan(&key, &prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, prefix
+}
+
+func TestSource_MigrateAndFind(t *testing.T) {
+	ctx := t.Context()
+	pool := newCorePool(t)
+	_, err := pool.Exec(ctx, `INSERT INTO core.api_keys (name, key, default_role, headers, claims) VALUES
+		('etl', 'plaintext-etl-key', 'loader', '{"role": "x-hugr-role"}', '{"tenant": "acme"}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := hugrauth.NewManagedAPIKeyProvider("managed-api-keys", "", hugrauth.ManagedAPIKeysConfig{})
+	s := New(p, false)
+	if err := s.Attach(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the second start doesn't hash the keys twice
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, prefix := storedKey(t, pool, "etl")
+	if !hugrauth.VerifyAPIKey(stored, "plaintext-etl-key") || prefix == nil || *prefix != "plaintext-etl-key"[:8] {
+		t.Fatalf("plaintext key is not hashed: %q, %v", stored, prefix)
+	}
+
+	k, err := s.FindAPIKey(ctx, "plaintext-etl-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Name != "etl" || k.DefaultRole != "loader" || k.Headers.Role != "x-hugr-role" || k.Claims["tenant"] != "acme" {
+		t.Errorf("unexpected key: %+v", k)
+	}
+	if _, err := s.FindAPIKey(ctx, "plaintext-other"); !errors.Is(err, hugrauth.ErrAPIKeyNotFound) {
+		t.Errorf("key with the same prefix: err = %v, want ErrAPIKeyNotFound", err)
+	}
+
+	// the plaintext key inserted by the generic mutation is hashed on the first use
+	_, err = pool.Exec(ctx, `INSERT INTO core.api_keys (name, key, default_role) VALUES ('late', 'late-plaintext-key', 'user')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindAPIKey(ctx, "late-plaintext-key"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := storedKey(t, pool, "late"); !hugrauth.VerifyAPIKey(stored, "late-plaintext-key") {
+		t.Errorf("plaintext key is not hashed on the first use: %q", stored)
+	}
+	if _, err := s.FindAPIKey(ctx, "late-plaintext-key"); err != nil {
+		t.Errorf("hashed key: %v", err)
+	}
+}
+
+func TestSource_HashInsertedKeys(t *testing.T) {
+	ctx := t.Context()
+	pool := newCorePool(t)
+	p := hugrauth.NewManagedAPIKeyProvider("managed-api-keys", "", hugrauth.ManagedAPIKeysConfig{
+		UsageFlushInterval: 10 * time.Millisecond,
+	})
+	s := New(p, false)
+	if err := s.Attach(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the plaintext key inserted by the generic mutation is hashed without being used
+	_, err := pool.Exec(ctx, `INSERT INTO core.api_keys (name, key, default_role) VALUES ('unused', 'unused-plaintext-key', 'user')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stored, prefix := storedKey(t, pool, "unused")
+		if prefix != nil && hugrauth.VerifyAPIKey(stored, "unused-plaintext-key") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unused plaintext key is not hashed: %q", stored)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := s.FindAPIKey(ctx, "unused-plaintext-key"); err != nil {
+		t.Errorf("hashed key: %v", err)
+	}
+}
+
+func TestSource_Create(t *testing.T) {
+	ctx := t.Context()
+	pool := newCorePool(t)
+	s := New(nil, false)
+	s.pool = pool
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := s.Create(ctx, NewAPIKey{Name: "bi", DefaultRole: "analyst", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := storedKey(t, pool, "bi"); stored == key || !hugrauth.VerifyAPIKey(stored, key) {
+		t.Errorf("key is not stored hashed: %q", stored)
+	}
+	k, err := s.FindAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.IsTemporal || k.ExpiresAt.Before(time.Now()) {
+		t.Errorf("key expiration is not set: %+v", k)
+	}
+	if _, err := s.Create(ctx, NewAPIKey{Name: "bi", DefaultRole: "analyst"}); err == nil {
+		t.Error("duplicate key name must be rejected")
+	}
+
+	ro := New(nil, true)
+	ro.pool = pool
+	if _, err := ro.Create(ctx, NewAPIKey{Name: "x", DefaultRole: "user"}); err == nil {
+		t.Error("read-only core db must not be changed")
+	}
+}
+
+func TestSource_Lifecycle(t *testing.T) {
+	ctx := t.Context()
+	pool := newCorePool(t)
+	_, err := pool.Exec(ctx, `CREATE TABLE core.data_sources (name VARCHAR PRIMARY KEY, prefix VARCHAR NOT NULL, as_module BOOLEAN NOT NULL);
+		INSERT INTO core.data_sources VALUES ('crm', 'crm', false), ('sales', 'sales', true),
+			('crm_eu', 'crm_eu', false), ('hr', 'hr', true)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := hugrauth.NewManagedAPIKeyProvider("managed-api-keys", "", hugrauth.ManagedAPIKeysConfig{})
+	s := New(p, false)
+	s.pool = pool
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.Create(ctx, NewAPIKey{Name: "etl", DefaultRole: "loader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, NewAPIKey{Name: "unused", DefaultRole: "loader"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotation keeps the previous key during the grace period
+	newKey, err := s.Rotate(ctx, "etl", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := s.FindAPIKey(ctx, newKey); err != nil || k.Previous {
+		t.Fatalf("new key: %+v, %v", k, err)
+	}
+	k, err := s.FindAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.Previous || k.GraceExpiresAt.Before(time.Now()) {
+		t.Errorf("previous key: %+v", k)
+	}
+	if _, err := s.Rotate(ctx, "etl", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindAPIKey(ctx, key); !errors.Is(err, hugrauth.ErrAPIKeyNotFound) {
+		t.Errorf("key replaced twice: err = %v, want ErrAPIKeyNotFound", err)
+	}
+
+	// scope with the data sources
+	err = s.SetScope(ctx, "etl", hugrauth.APIKeyScope{ReadOnly: true, DataSources: []string{"crm", "sales"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = s.FindAPIKey(ctx, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.Scope.ReadOnly || len(k.Scope.Modules) != 1 || k.Scope.Modules[0] != "sales" ||
+		len(k.Scope.Prefixes) != 1 || k.Scope.Prefixes[0] != "crm" {
+		t.Errorf("unexpected scope: %+v", k.Scope)
+	}
+	slices.Sort(k.Scope.TypePrefixes)
+	slices.Sort(k.Scope.OtherPrefixes)
+	if !slices.Equal(k.Scope.TypePrefixes, []string{"crm", "sales"}) || !slices.Equal(k.Scope.OtherPrefixes, []string{"crm_eu", "hr"}) {
+		t.Errorf("unexpected scope prefixes: %+v", k.Scope)
+	}
+	if err := s.SetScope(ctx, "unknown", hugrauth.APIKeyScope{ReadOnly: true}); err == nil {
+		t.Error("scope of the unknown key must not be set")
+	}
+
+	// usage and inactive keys
+	_, err = pool.Exec(ctx, `UPDATE core.api_keys SET created_at = $1`, time.Now().UTC().Add(-48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetStore(s)
+	if err := s.FlushUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/query?query="+url.QueryEscape("{ sales { x } }"), nil)
+	r.Header.Set("x-hugr-api-key", newKey)
+	if _, err := p.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	inactive, err := s.InactiveKeys(ctx, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inactive) != 1 || inactive[0].Name != "unused" || !inactive[0].LastUsedAt.IsZero() {
+		t.Fatalf("inactive keys: %+v", inactive)
+	}
+	names, err := s.ExpireInactive(ctx, 24*time.Hour)
+	if err != nil || len(names) != 1 {
+		t.Fatalf("expire inactive: %v, %v", names, err)
+	}
+	if inactive, _ := s.InactiveKeys(ctx, 24*time.Hour); len(inactive) != 0 {
+		t.Errorf("expired keys are reported: %+v", inactive)
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var ip string
+	if err := conn.QueryRow(ctx, `SELECT last_used_ip FROM core.api_keys WHERE name = 'etl'`).Scan(&ip); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "192.0.2.1" {
+		t.Errorf("last used ip = %q", ip)
+	}
+}
@@ -0,0 +1,323 @@
+package apikeys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+)
+
+// inactiveCheckInterval is the interval to check the inactive keys.
+const inactiveCheckInterval = time.Hour
+
+// InactiveAPIKey is the key that is not used for the inactivity period.
+type InactiveAPIKey struct {
+	Name        string
+	Description string
+	DefaultRole string
+	CreatedAt   time.Time
+	// LastUsedAt is zero if the key has never been used
+	LastUsedAt time.Time
+	LastUsedIP string
+}
+
+// run writes the keys usage, hashes the plaintext keys and checks the inactive keys until the context is done,
+// the usage is written on the context cancellation as well.
+func (s *Source) run(ctx context.Context) {
+	flush := time.NewTicker(s.provider.Config.FlushInterval())
+	defer flush.Stop()
+	inactive := time.NewTicker(inactiveCheckInterval)
+	defer inactive.Stop()
+	s.checkInactive(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.FlushUsage(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("Auth: managed api keys usage write error: %v", err)
+			}
+			return
+		case <-flush.C:
+			if err := s.FlushUsage(ctx); err != nil {
+				log.Printf("Auth: managed api keys usage write error: %v", err)
+			}
+			if !s.readOnly {
+				if err := s.HashPlaintextKeys(ctx); err != nil {
+					log.Printf("Auth: managed api keys: hash plaintext keys error: %v", err)
+				}
+			}
+		case <-inactive.C:
+			s.checkInactive(ctx)
+		}
+	}
+}
+
+// FlushUsage writes the keys last usage time and IP collected by the provider.
+func (s *Source) FlushUsage(ctx context.Context) error {
+	usage := s.provider.TakeUsage()
+	if len(usage) == 0 || s.readOnly {
+		return nil
+	}
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, u := range usage {
+		_, err := conn.Exec(ctx, `UPDATE core.api_keys SET last_used_at = $1, last_used_ip = $2
+			WHERE name = $3 AND (last_used_at IS NULL OR last_used_at < $1)`,
+			u.LastUsedAt.UTC(), u.LastUsedIP, u.Name,
+		)
+		if err != nil {
+			return fmt.Errorf("api key %s: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkInactive reports the inactive keys and expires them if it is configured.
+func (s *Source) checkInactive(ctx context.Context) {
+	c := s.provider.Config
+	if c.InactiveAfter <= 0 {
+		return
+	}
+	if c.ExpireInactive && !s.readOnly {
+		names, err := s.ExpireInactive(ctx, c.InactiveAfter)
+		if err != nil {
+			log.Printf("Auth: managed api keys: expire inactive keys error: %v", err)
+			return
+		}
+		if len(names) != 0 {
+			log.Printf("Auth: managed api keys: inactive keys are expired: %s", strings.Join(names, ", "))
+		}
+		return
+	}
+	keys, err := s.InactiveKeys(ctx, c.InactiveAfter)
+	if err != nil {
+		log.Printf("Auth: managed api keys: check inactive keys error: %v", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.Name)
+	}
+	log.Printf("Auth: managed api keys: keys not used for %s: %s", c.InactiveAfter, strings.Join(names, ", "))
+}
+
+// activeKeysCondition selects the enabled not expired keys, $1 is the current time.
+const activeKeysCondition = `NOT disabled AND NOT (is_temporal AND expires_at <= $1)`
+
+// InactiveKeys returns the active keys that are not used (or created if never used) for the period.
+func (s *Source) InactiveKeys(ctx context.Context, period time.Duration) ([]InactiveAPIKey, error) {
+	now := time.Now().UTC()
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(ctx, `SELECT name, description, default_role, created_at, last_used_at, last_used_ip
+		FROM core.api_keys
+		WHERE `+activeKeysCondition+` AND coalesce(last_used_at, created_at) < $2
+		ORDER BY name`,
+		now, now.Add(-period),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load inactive api keys: %w", err)
+	}
+	defer rows.Close()
+	var keys []InactiveAPIKey
+	for rows.Next() {
+		var k InactiveAPIKey
+		var description, ip *string
+		var createdAt, lastUsedAt *time.Time
+		if err := rows.Scan(&k.Name, &description, &k.DefaultRole, &createdAt, &lastUsedAt, &ip); err != nil {
+			return nil, fmt.Errorf("load inactive api keys: %w", err)
+		}
+		if description != nil {
+			k.Description = *description
+		}
+		if createdAt != nil {
+			k.CreatedAt = *createdAt
+		}
+		if lastUsedAt != nil {
+			k.LastUsedAt = *lastUsedAt
+		}
+		if ip != nil {
+			k.LastUsedIP = *ip
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// ExpireInactive expires the keys that are not used for the period and returns their names.
+func (s *Source) ExpireInactive(ctx context.Context, period time.Duration) ([]string, error) {
+	keys, err := s.InactiveKeys(ctx, period)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		_, err := s.pool.Exec(ctx, `UPDATE core.api_keys SET is_temporal = true, expires_at = $1 WHERE name = $2`, now, k.Name)
+		if err != nil {
+			return names, fmt.Errorf("expire api key %s: %w", k.Name, err)
+		}
+		names = append(names, k.Name)
+	}
+	if s.provider != nil {
+		s.provider.Purge()
+	}
+	return names, nil
+}
+
+// Rotate replaces the key with the new random one and returns it, the previous key is valid during the grace period
+// (the configured default if it is 0). The key replaced earlier is not valid after the rotation.
+func (s *Source) Rotate(ctx context.Context, name string, grace time.Duration) (string, error) {
+	if s.readOnly {
+		return "", errors.New("core db is read-only")
+	}
+	if grace <= 0 && s.provider != nil {
+		grace = s.provider.Config.GracePeriod()
+	}
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	var stored string
+	var prefix *string
+	err = conn.QueryRow(ctx, `SELECT key, key_prefix FROM core.api_keys WHERE name = $1`, name).Scan(&stored, &prefix)
+	conn.Close()
+	if err != nil {
+		return "", fmt.Errorf("api key %s: %w", name, err)
+	}
+	if prefix == nil {
+		// the plaintext key inserted after the startup
+		if err := s.hashKey(ctx, name, stored); err != nil {
+			return "", err
+		}
+	}
+	key, err := hugrauth.GenerateAPIKey()
+	if err != nil {
+		return "", err
+	}
+	hash, err := hugrauth.HashAPIKey(key)
+	if err != nil {
+		return "", err
+	}
+	_, err = s.pool.Exec(ctx, `UPDATE core.api_keys SET
+			previous_key = key, previous_key_prefix = key_prefix, previous_key_expires_at = $1,
+			key = $2, key_prefix = $3
+		WHERE name = $4`,
+		time.Now().UTC().Add(grace), hash, hugrauth.APIKeyPrefix(key), name,
+	)
+	if err != nil {
+		return "", fmt.Errorf("rotate api key %s: %w", name, err)
+	}
+	if s.provider != nil {
+		s.provider.Purge()
+	}
+	log.Printf("Auth: managed api keys: key %s is rotated, the previous key is valid for %s", name, grace)
+	return key, nil
+}
+
+// SetScope sets the key scope, the empty scope removes the limits.
+func (s *Source) SetScope(ctx context.Context, name string, scope hugrauth.APIKeyScope) error {
+	if s.readOnly {
+		return errors.New("core db is read-only")
+	}
+	var value any
+	if !scope.IsEmpty() {
+		b, err := json.Marshal(scope)
+		if err != nil {
+			return err
+		}
+		value = string(b)
+	}
+	res, err := s.pool.Exec(ctx, `UPDATE core.api_keys SET scope = $1 WHERE name = $2`, value, name)
+	if err != nil {
+		return fmt.Errorf("set api key %s scope: %w", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("api key %s is not found", name)
+	}
+	if s.provider != nil {
+		s.provider.Purge()
+	}
+	return nil
+}
+
+// resolveDataSources adds the modules and the field prefixes of the scope data sources:
+// the data sources attached as modules are matched by the module name, the other ones by the prefix of the root fields.
+// The type prefixes of the allowed data sources and the prefixes of the other ones are added to check the _join
+// and _spatial queries and to match the field by its own data source prefix.
+func (s *Source) resolveDataSources(ctx context.Context, scope *hugrauth.APIKeyScope) error {
+	if len(scope.Modules) == 0 && len(scope.DataSources) == 0 {
+		return nil
+	}
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(ctx, `SELECT name, prefix, as_module FROM core.data_sources`)
+	if err != nil {
+		// the unknown data sources don't allow anything
+		log.Printf("Auth: managed api keys: scope data sources: %v", err)
+		return nil
+	}
+	type dataSource struct {
+		name, prefix string
+		asModule     bool
+	}
+	var all []dataSource
+	for rows.Next() {
+		var ds dataSource
+		if err := rows.Scan(&ds.name, &ds.prefix, &ds.asModule); err != nil {
+			rows.Close()
+			return fmt.Errorf("scope data sources: %w", err)
+		}
+		all = append(all, ds)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scope data sources: %w", err)
+	}
+	for _, name := range scope.DataSources {
+		i := slices.IndexFunc(all, func(ds dataSource) bool { return ds.name == name })
+		if i == -1 {
+			log.Printf("Auth: managed api keys: scope data source %s is not found", name)
+			continue
+		}
+		if all[i].asModule {
+			scope.Modules = append(scope.Modules, name)
+			continue
+		}
+		if all[i].prefix != "" {
+			scope.Prefixes = append(scope.Prefixes, all[i].prefix)
+		}
+	}
+	for _, ds := range all {
+		if ds.prefix == "" {
+			continue
+		}
+		allowed := slices.Contains(scope.Prefixes, ds.prefix) ||
+			ds.asModule && slices.ContainsFunc(scope.Modules, func(m string) bool {
+				return ds.name == m || strings.HasPrefix(ds.name, m+".")
+			})
+		if allowed {
+			scope.TypePrefixes = append(scope.TypePrefixes, ds.prefix)
+			continue
+		}
+		scope.OtherPrefixes = append(scope.OtherPrefixes, ds.prefix)
+	}
+	return nil
+}
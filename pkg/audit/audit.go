@@ -0,0 +1,268 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/catalog/compiler"
+	"github.com/hugr-lab/query-engine/pkg/catalog/sources"
+	rtsources "github.com/hugr-lab/query-engine/pkg/data-sources/sources"
+	"github.com/hugr-lab/query-engine/pkg/data-sources/sources/runtime"
+	"github.com/hugr-lab/query-engine/pkg/db"
+	"github.com/hugr-lab/query-engine/pkg/engines"
+
+	_ "embed"
+)
+
+// The Audit runtime source for hugr query engine that stores the authentication audit events
+// in the core.auth_audit table of the CoreDB (the coredb audit sink) and exposes them to the admins:
+// 1. core.audit.events
+// The events older than the retention period are removed by the auditor.
+
+//go:embed schema.graphql
+var schema string
+
+const createTableSQL = `CREATE TABLE IF NOT EXISTS core.auth_audit (
+	event_time TIMESTAMPTZ NOT NULL,
+	provider VARCHAR,
+	provider_type VARCHAR,
+	user_id VARCHAR,
+	user_name VARCHAR,
+	role VARCHAR,
+	real_user_id VARCHAR,
+	real_user_name VARCHAR,
+	real_role VARCHAR,
+	client_ip VARCHAR,
+	user_agent VARCHAR,
+	method VARCHAR,
+	path VARCHAR,
+	outcome VARCHAR NOT NULL,
+	error_class VARCHAR,
+	error VARCHAR
+)`
+
+// migrateTableSQL adds the columns of the real identity of the impersonated requests to the table created before.
+var migrateTableSQL = []string{
+	`ALTER TABLE core.auth_audit ADD COLUMN IF NOT EXISTS real_user_id VARCHAR`,
+	`ALTER TABLE core.auth_audit ADD COLUMN IF NOT EXISTS real_user_name VARCHAR`,
+	`ALTER TABLE core.auth_audit ADD COLUMN IF NOT EXISTS real_role VARCHAR`,
+}
+
+const (
+	adminRole = "admin"
+	// maxEvents limits the events returned by the events function
+	maxEvents = 10000
+)
+
+var ErrNotAdmin = errors.New("audit events are available for admins only")
+
+var (
+	_ rtsources.RuntimeSource = (*Source)(nil)
+	_ hugrauth.AuditSink      = (*Source)(nil)
+)
+
+type Source struct {
+	auditor  *hugrauth.Auditor
+	readOnly bool
+	pool     *db.Pool
+}
+
+// New creates the audit source, the events can't be written to the readOnly CoreDB.
+func New(a *hugrauth.Auditor, readOnly bool) *Source {
+	return &Source{
+		auditor:  a,
+		readOnly: readOnly,
+	}
+}
+
+func (*Source) Name() string {
+	return "core.audit"
+}
+
+func (*Source) Engine() engines.Engine {
+	return engines.NewDuckDB()
+}
+
+func (*Source) IsReadonly() bool {
+	return false
+}
+
+func (*Source) AsModule() bool {
+	return true
+}
+
+func (s *Source) Attach(ctx context.Context, pool *db.Pool) error {
+	s.pool = pool
+	return s.registerUDFs(ctx)
+}
+
+func (s *Source) Catalog(ctx context.Context) (sources.Catalog, error) {
+	e := engines.NewDuckDB()
+	opts := compiler.Options{
+		Name:         s.Name(),
+		Prefix:       "core_audit",
+		ReadOnly:     s.IsReadonly(),
+		AsModule:     s.AsModule(),
+		EngineType:   string(e.Type()),
+		Capabilities: e.Capabilities(),
+	}
+	return sources.NewStringSource(s.Name(), e, opts, schema)
+}
+
+// Start creates the audit table and sets the source as the audit sink,
+// the events buffered before are written then. It should be called after the engine initialization.
+func (s *Source) Start(ctx context.Context) error {
+	if s.pool == nil {
+		return errors.New("audit source is not attached")
+	}
+	if s.readOnly {
+		return errors.New("the coredb audit sink requires the writable CoreDB")
+	}
+	if _, err := s.pool.Exec(ctx, createTableSQL); err != nil {
+		return fmt.Errorf("create audit table: %w", err)
+	}
+	for _, q := range migrateTableSQL {
+		if _, err := s.pool.Exec(ctx, q); err != nil {
+			return fmt.Errorf("migrate audit table: %w", err)
+		}
+	}
+	if s.auditor != nil {
+		s.auditor.SetSink(s)
+	}
+	return nil
+}
+
+// WriteEvents inserts the events into the audit table.
+func (s *Source) WriteEvents(ctx context.Context, events []hugrauth.AuditEvent) error {
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, e := range events {
+		_, err := conn.Exec(ctx, `INSERT INTO core.auth_audit (event_time, provider, provider_type, user_id, user_name, role,
+				real_user_id, real_user_name, real_role, client_ip, user_agent, method, path, outcome, error_class, error)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+			e.Time.UTC(), e.Provider, e.ProviderType, e.UserID, e.UserName, e.Role,
+			e.RealUserID, e.RealUserName, e.RealRole, e.ClientIP, e.UserAgent, e.Method, e.Path, e.Outcome, e.ErrorClass, e.Error,
+		)
+		if err != nil {
+			return fmt.Errorf("insert audit event: %w", err)
+		}
+	}
+	return nil
+}
+
+// RemoveBefore removes the events older than the time.
+func (s *Source) RemoveBefore(ctx context.Context, t time.Time) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM core.auth_audit WHERE event_time < $1`, t.UTC())
+	if err != nil {
+		return fmt.Errorf("remove audit events: %w", err)
+	}
+	return nil
+}
+
+// Events returns the events since the time, the newest first.
+func (s *Source) Events(ctx context.Context, since time.Time, limit int) ([]hugrauth.AuditEvent, error) {
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(ctx, `SELECT event_time, provider, provider_type, user_id, user_name, role,
+			real_user_id, real_user_name, real_role, client_ip, user_agent, method, path, outcome, error_class, error
+		FROM core.auth_audit
+		WHERE event_time >= $1
+		ORDER BY event_time DESC
+		LIMIT $2`, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("load audit events: %w", err)
+	}
+	defer rows.Close()
+	var events []hugrauth.AuditEvent
+	for rows.Next() {
+		var e hugrauth.AuditEvent
+		var values [15]*string
+		dest := []any{&e.Time}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("load audit events: %w", err)
+		}
+		for i, f := range []*string{&e.Provider, &e.ProviderType, &e.UserID, &e.UserName, &e.Role,
+			&e.RealUserID, &e.RealUserName, &e.RealRole, &e.ClientIP, &e.UserAgent, &e.Method, &e.Path, &e.Outcome, &e.ErrorClass, &e.Error} {
+			if values[i] != nil {
+				*f = *values[i]
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Source) checkAdmin(ctx context.Context) error {
+	if auth.IsFullAccess(ctx) {
+		return nil
+	}
+	info := auth.AuthInfoFromContext(ctx)
+	if info == nil || info.Role != adminRole {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+func (s *Source) registerUDFs(ctx context.Context) error {
+	// core_audit_events(hours) → table of the events of the last hours
+	err := s.pool.RegisterTableRowFunction(ctx, &db.TableRowFunctionWithArgs[int32, hugrauth.AuditEvent]{
+		Name: "core_audit_events",
+		Arguments: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("INTEGER"),
+		},
+		ConvertArgs: func(named map[string]any, args ...any) (int32, error) {
+			return args[0].(int32), nil
+		},
+		ColumnInfos: []duckdb.ColumnInfo{
+			{Name: "event_time", T: runtime.DuckDBTypeInfoByNameMust("TIMESTAMP")},
+			{Name: "provider", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "provider_type", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "user_id", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "user_name", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "role", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "real_user_id", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "real_user_name", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "real_role", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "client_ip", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "user_agent", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "method", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "path", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "outcome", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "error_class", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "error", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+		},
+		Execute: func(ctx context.Context, hours int32) ([]hugrauth.AuditEvent, error) {
+			if err := s.checkAdmin(ctx); err != nil {
+				return nil, err
+			}
+			return s.Events(ctx, time.Now().Add(-time.Duration(hours)*time.Hour), maxEvents)
+		},
+		FillRow: func(e hugrauth.AuditEvent, row duckdb.Row) error {
+			for i, v := range []any{e.Time, e.Provider, e.ProviderType, e.UserID, e.UserName, e.Role,
+				e.RealUserID, e.RealUserName, e.RealRole, e.ClientIP, e.UserAgent, e.Method, e.Path, e.Outcome, e.ErrorClass, e.Error} {
+				if err := row.SetRowValue(i, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("register core_audit_events: %w", err)
+	}
+	return nil
+}
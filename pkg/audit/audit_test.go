@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/db"
+)
+
+func TestSource_Events(t *testing.T) {
+	ctx := t.Context()
+	pool, err := db.NewPool("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	if _, err := pool.Exec(ctx, `ATTACH ':memory:' AS core`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(nil, false)
+	if err := s.Attach(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	err = s.WriteEvents(ctx, []hugrauth.AuditEvent{
+		{Time: now.Add(-48 * time.Hour), Provider: "oidc", UserID: "old", Outcome: hugrauth.AuditSuccess},
+		{Time: now.Add(-time.Minute), Provider: "oidc", ProviderType: "oidc", UserID: "alice", Role: "analyst",
+			RealUserID: "ops", RealRole: "support", ClientIP: "10.0.0.1", UserAgent: "curl", Method: "POST", Path: "/query", Outcome: hugrauth.AuditSuccess},
+		{Time: now, Provider: "etl", ProviderType: "apiKey", ClientIP: "10.0.0.2", Method: "GET", Path: "/ipc",
+			Outcome: hugrauth.AuditFailure, ErrorClass: "ErrInvalidKeyType", Error: "invalid key type"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := s.Events(ctx, now.Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("events = %+v", events)
+	}
+	if e := events[0]; e.Provider != "etl" || e.ErrorClass != "ErrInvalidKeyType" || e.Outcome != hugrauth.AuditFailure || !e.Time.Equal(now) {
+		t.Errorf("newest event = %+v", e)
+	}
+	if e := events[1]; e.UserID != "alice" || e.Role != "analyst" || e.RealUserID != "ops" || e.RealRole != "support" ||
+		e.ClientIP != "10.0.0.1" || e.UserAgent != "curl" {
+		t.Errorf("event = %+v", e)
+	}
+
+	if err := s.RemoveBefore(ctx, now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if events, err := s.Events(ctx, now.Add(-72*time.Hour), 10); err != nil || len(events) != 2 {
+		t.Errorf("events after the retention: %+v, %v", events, err)
+	}
+
+	if err := New(nil, true).Start(ctx); err == nil {
+		t.Error("not attached source must not start")
+	}
+	ro := New(nil, true)
+	ro.pool = pool
+	if err := ro.Start(ctx); err == nil {
+		t.Error("read-only CoreDB must be rejected")
+	}
+}
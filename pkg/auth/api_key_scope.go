@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// maxScopedRequestSize limits the request body read to check the API key scope.
+const maxScopedRequestSize = 10 << 20
+
+// APIKeyScope limits the requests made with the managed API key, the empty scope allows everything.
+// The scoped keys can be used only for the GraphQL queries (the /query, /jq-query and /ipc endpoints),
+// the query root fields are checked against the allowed modules and data sources.
+type APIKeyScope struct {
+	// ReadOnly allows only the query operations
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Modules are the allowed module paths (e.g. sales or core.denylist), the nested modules are allowed as well
+	Modules []string `json:"modules,omitempty"`
+	// DataSources are the allowed data sources, resolved by the keys store to Modules and Prefixes
+	DataSources []string `json:"data_sources,omitempty"`
+	// Prefixes are the root field prefixes of the allowed data sources that are not attached as modules
+	Prefixes []string `json:"-"`
+	// TypePrefixes are the type name prefixes of all allowed data sources (including the ones attached
+	// to the allowed modules), the fields of the _join and _spatial queries are checked against them
+	TypePrefixes []string `json:"-"`
+	// OtherPrefixes are the prefixes of the data sources out of the scope, the field is matched
+	// by the longest data source prefix, so the allowed prefix sales doesn't allow the sales_eu data source
+	OtherPrefixes []string `json:"-"`
+}
+
+// IsEmpty returns true if the scope doesn't limit the requests.
+func (s APIKeyScope) IsEmpty() bool {
+	return !s.ReadOnly && len(s.Modules) == 0 && len(s.DataSources) == 0
+}
+
+func (s APIKeyScope) limitsModules() bool {
+	return len(s.Modules) != 0 || len(s.DataSources) != 0
+}
+
+// Check checks that the request is in the scope.
+func (s APIKeyScope) Check(r *http.Request) error {
+	if s.IsEmpty() {
+		return nil
+	}
+	req, err := scopedRequest(r)
+	if err != nil {
+		return err
+	}
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: req.Query})
+	if gqlErr != nil {
+		return fmt.Errorf("parse query: %w", gqlErr)
+	}
+	checked := 0
+	for _, op := range doc.Operations {
+		if req.OperationName != "" && op.Name != req.OperationName {
+			continue
+		}
+		checked++
+		if s.ReadOnly && op.Operation != ast.Query {
+			return fmt.Errorf("%s operations are not allowed for the read-only key", op.Operation)
+		}
+		if !s.limitsModules() {
+			continue
+		}
+		if err := s.checkSelections(doc, op.SelectionSet, "", true); err != nil {
+			return err
+		}
+	}
+	if checked == 0 {
+		return errors.New("no operation to check")
+	}
+	return nil
+}
+
+// checkSelections checks the fields of the module (path) selection set, the function root fields
+// are checked as the fields of the module.
+func (s APIKeyScope) checkSelections(doc *ast.QueryDocument, set ast.SelectionSet, path string, root bool) error {
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if err := s.checkField(doc, sel, path, root); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := s.checkSelections(doc, sel.SelectionSet, path, root); err != nil {
+				return err
+			}
+		case *ast.FragmentSpread:
+			f := doc.Fragments.ForName(sel.Name)
+			if f == nil {
+				return fmt.Errorf("unknown fragment %q", sel.Name)
+			}
+			if err := s.checkSelections(doc, f.SelectionSet, path, root); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s APIKeyScope) checkField(doc *ast.QueryDocument, f *ast.Field, path string, root bool) error {
+	if strings.HasPrefix(f.Name, "__") {
+		return nil
+	}
+	if f.Name == "function" && root {
+		return s.checkSelections(doc, f.SelectionSet, path, false)
+	}
+	full := f.Name
+	if path != "" {
+		full = path + "." + f.Name
+	}
+	if s.moduleAllowed(full) {
+		return s.checkJoins(doc, f.SelectionSet, false)
+	}
+	if path == "" && s.prefixAllowed(f.Name, s.Prefixes) {
+		return s.checkJoins(doc, f.SelectionSet, false)
+	}
+	if len(f.SelectionSet) != 0 && slices.ContainsFunc(s.Modules, func(m string) bool {
+		return strings.HasPrefix(m, full+".")
+	}) {
+		return s.checkSelections(doc, f.SelectionSet, full, root)
+	}
+	return fmt.Errorf("%s is out of the allowed modules", full)
+}
+
+// checkJoins walks the selection set of the allowed field and checks the fields of the _join and _spatial
+// queries, they select the data objects of any data source by their type names.
+func (s APIKeyScope) checkJoins(doc *ast.QueryDocument, set ast.SelectionSet, join bool) error {
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if join && !strings.HasPrefix(sel.Name, "__") && !s.prefixAllowed(sel.Name, s.TypePrefixes) {
+				return fmt.Errorf("%s is out of the allowed data sources", sel.Name)
+			}
+			if err := s.checkJoins(doc, sel.SelectionSet, sel.Name == "_join" || sel.Name == "_spatial"); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := s.checkJoins(doc, sel.SelectionSet, join); err != nil {
+				return err
+			}
+		case *ast.FragmentSpread:
+			f := doc.Fragments.ForName(sel.Name)
+			if f == nil {
+				return fmt.Errorf("unknown fragment %q", sel.Name)
+			}
+			if err := s.checkJoins(doc, f.SelectionSet, join); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prefixAllowed checks that the longest data source prefix of the name is one of the allowed prefixes.
+func (s APIKeyScope) prefixAllowed(name string, allowed []string) bool {
+	matched := ""
+	for _, p := range allowed {
+		if len(p) > len(matched) && strings.HasPrefix(name, p+"_") {
+			matched = p
+		}
+	}
+	if matched == "" {
+		return false
+	}
+	return !slices.ContainsFunc(s.OtherPrefixes, func(p string) bool {
+		return len(p) > len(matched) && strings.HasPrefix(name, p+"_")
+	})
+}
+
+func (s APIKeyScope) moduleAllowed(path string) bool {
+	for _, m := range s.Modules {
+		if path == m || strings.HasPrefix(path, m+".") {
+			return true
+		}
+	}
+	return false
+}
+
+type scopedGraphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// scopedRequest reads the GraphQL query of the request, the body is restored for the next handlers.
+func scopedRequest(r *http.Request) (scopedGraphQLRequest, error) {
+	var req scopedGraphQLRequest
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return req, errors.New("websocket requests are not allowed for the scoped key")
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/query") || strings.HasSuffix(r.URL.Path, "/ipc"):
+		if r.Method == http.MethodGet {
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			return req, nil
+		}
+		body, err := readBody(r)
+		if err != nil {
+			return req, err
+		}
+		err = json.Unmarshal(body, &req)
+		return req, err
+	case strings.HasSuffix(r.URL.Path, "/jq-query"):
+		body, err := readBody(r)
+		if err != nil {
+			return req, err
+		}
+		var jq struct {
+			Query scopedGraphQLRequest `json:"query"`
+		}
+		err = json.Unmarshal(body, &jq)
+		return jq.Query, err
+	}
+	return req, fmt.Errorf("endpoint %s is not allowed for the scoped key", r.URL.Path)
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, errors.New("empty request body")
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxScopedRequestSize+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxScopedRequestSize {
+		return nil, errors.New("request body is too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
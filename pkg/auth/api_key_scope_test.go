@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyScope_Check(t *testing.T) {
+	post := func(path, body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	}
+	get := func(query string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/query?query="+url.QueryEscape(query), nil)
+	}
+	scope := APIKeyScope{
+		ReadOnly: true,
+		Modules:  []string{"sales", "core.denylist"},
+		Prefixes: []string{"crm"},
+		// the data source sales is attached as the module, crm and crm_eu are not
+		TypePrefixes:  []string{"sales", "crm"},
+		OtherPrefixes: []string{"hr", "crm_eu"},
+	}
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"module", post("/query", `{"query": "{ sales { orders { id } } }"}`), true},
+		{"nested module", get(`{ sales { eu { orders { id } } } __typename }`), true},
+		{"allowed submodule", post("/query", `{"query": "{ core { denylist { x } } }"}`), true},
+		{"data source prefix", post("/query", `{"query": "{ crm_customers { id } }"}`), true},
+		{"function", post("/query", `{"query": "{ function { sales { total } } }"}`), true},
+		{"fragment", post("/query", `{"query": "{ ...F } fragment F on Query { sales { x } }"}`), true},
+		{"jq", post("/jq-query", `{"jq": ".", "query": {"query": "{ sales { x } }"}}`), true},
+		{"operation name", post("/query", `{"query": "query A { sales { x } } query B { hr { x } }", "operationName": "A"}`), true},
+		{"join", get(`{ sales { orders { _join(fields: ["id"]) { crm_customers(fields: ["id"]) { id } } } } }`), true},
+		{"spatial", get(`{ crm_customers { _spatial(field: "geom", type: INTERSECTS) { sales_stores(field: "geom") { id } } } }`), true},
+		{"join other module", get(`{ sales { orders { _join(fields: ["id"]) { hr_salaries(fields: ["id"]) { amount } } } } }`), false},
+		{"join other aggregation", get(`{ sales { orders { _join(fields: ["id"]) { hr_salaries_aggregation(fields: ["id"]) { _rows_count } } } } }`), false},
+		{"nested join", get(`{ sales { orders { _join(fields: ["id"]) { crm_customers(fields: ["id"]) { _join(fields: ["id"]) { hr_salaries(fields: ["id"]) { amount } } } } } } }`), false},
+		{"join fragment", get(`{ sales { orders { ...J } } } fragment J on sales_orders { _join(fields: ["id"]) { hr_salaries(fields: ["id"]) { amount } } }`), false},
+		{"spatial other data source", get(`{ crm_customers { _spatial(field: "geom", type: INTERSECTS) { crm_eu_stores(field: "geom") { id } } } }`), false},
+		{"longer data source prefix", post("/query", `{"query": "{ crm_eu_customers { id } }"}`), false},
+		{"other module", post("/query", `{"query": "{ hr { employees { id } } }"}`), false},
+		{"other submodule", post("/query", `{"query": "{ core { api_keys { key } } }"}`), false},
+		{"other fragment", post("/query", `{"query": "{ ...F } fragment F on Query { hr { x } }"}`), false},
+		{"other operation", post("/query", `{"query": "query A { sales { x } } query B { hr { x } }"}`), false},
+		{"mutation", post("/query", `{"query": "mutation { sales { insert_orders(data: {}) { id } } }"}`), false},
+		{"other endpoint", post("/mcp", `{}`), false},
+		{"invalid query", post("/query", `{"query": "{ sales "}`), false},
+		{"no operation", post("/query", `{"query": "query A { sales { x } }", "operationName": "B"}`), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := scope.Check(tt.r)
+			if (err == nil) != tt.ok {
+				t.Errorf("err = %v, want ok = %t", err, tt.ok)
+			}
+		})
+	}
+
+	// the body is kept for the query handler
+	r := post("/query", `{"query": "{ sales { x } }"}`)
+	if err := scope.Check(r); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r.Body); string(b) != `{"query": "{ sales { x } }"}` {
+		t.Errorf("body = %q", b)
+	}
+
+	readOnly := APIKeyScope{ReadOnly: true}
+	if err := readOnly.Check(post("/query", `{"query": "{ hr { x } }"}`)); err != nil {
+		t.Errorf("read-only query: %v", err)
+	}
+	if err := (APIKeyScope{}).Check(post("/mcp", `{}`)); err != nil {
+		t.Errorf("empty scope: %v", err)
+	}
+}
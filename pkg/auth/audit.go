@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// The audit log sinks.
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkFile   = "file"
+	AuditSinkCoreDB = "coredb"
+)
+
+// The outcomes of the audit events.
+const (
+	AuditSuccess   = "success"
+	AuditAnonymous = "anonymous"
+	AuditFailure   = "failure"
+)
+
+const (
+	defaultAuditBufferSize    = 10000
+	defaultAuditFlushInterval = time.Second
+	auditBatchSize            = 500
+	auditRetentionInterval    = time.Hour
+)
+
+// AuditConfig configures the audit log of the authentication decisions.
+type AuditConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Sink is stdout (default), file or coredb (the core.auth_audit table)
+	Sink string `json:"sink" yaml:"sink"`
+	// File is the audit log file of the file sink, the events are written as JSON lines
+	File string `json:"file" yaml:"file"`
+	// Retention is the time the events are kept (the rotated files or the table rows), 0 - forever
+	Retention time.Duration `json:"retention" yaml:"retention"`
+	// MaxFileSize is the file size in bytes to rotate the file at (default 100MB), the file is rotated daily as well
+	MaxFileSize int64 `json:"max_file_size" yaml:"max_file_size"`
+	// MaxFiles limits the number of the rotated files, 0 - no limit
+	MaxFiles int `json:"max_files" yaml:"max_files"`
+	// BufferSize is the number of the events waiting for the sink (default 10000), the new events are dropped if it is full
+	BufferSize int `json:"buffer_size" yaml:"buffer_size"`
+	// FlushInterval is the interval to write the buffered events to the sink (default 1s)
+	FlushInterval time.Duration `json:"flush_interval" yaml:"flush_interval"`
+}
+
+func (c AuditConfig) sink() string {
+	if c.Sink == "" {
+		return AuditSinkStdout
+	}
+	return c.Sink
+}
+
+func (c AuditConfig) bufferSize() int {
+	if c.BufferSize <= 0 {
+		return defaultAuditBufferSize
+	}
+	return c.BufferSize
+}
+
+func (c AuditConfig) flushInterval() time.Duration {
+	if c.FlushInterval <= 0 {
+		return defaultAuditFlushInterval
+	}
+	return c.FlushInterval
+}
+
+// AuditEvent is the authentication decision of the providers chain for the request.
+type AuditEvent struct {
+	Time         time.Time `json:"time"`
+	Provider     string    `json:"provider,omitempty"`
+	ProviderType string    `json:"provider_type,omitempty"`
+	UserID       string    `json:"user_id,omitempty"`
+	UserName     string    `json:"user_name,omitempty"`
+	Role         string    `json:"role,omitempty"`
+	// RealUserID, RealUserName and RealRole are the real identity of the impersonated request
+	RealUserID   string `json:"real_user_id,omitempty"`
+	RealUserName string `json:"real_user_name,omitempty"`
+	RealRole     string `json:"real_role,omitempty"`
+	ClientIP     string `json:"client_ip"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	Method       string `json:"method"`
+	Path         string `json:"path"`
+	// Outcome is success, anonymous or failure
+	Outcome string `json:"outcome"`
+	// ErrorClass is the name of the auth error (e.g. ErrTokenExpired, ErrForbidden) of the failure
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// AuditSink stores the audit events.
+type AuditSink interface {
+	WriteEvents(ctx context.Context, events []AuditEvent) error
+	// RemoveBefore removes the events older than the time, it is called to apply the retention
+	RemoveBefore(ctx context.Context, t time.Time) error
+}
+
+// auditErrorClasses are the classes of the known auth errors.
+var auditErrorClasses = []struct {
+	err   error
+	class string
+}{
+	{auth.ErrTokenExpired, "ErrTokenExpired"},
+	{auth.ErrForbidden, "ErrForbidden"},
+	{auth.ErrInvalidKeyType, "ErrInvalidKeyType"},
+	{auth.ErrNeedAuth, "ErrNeedAuth"},
+	{ErrProviderUnavailable, "ErrProviderUnavailable"},
+	{ErrInvalidCredentials, "ErrInvalidCredentials"},
+	{ErrLockedOut, "ErrLockedOut"},
+}
+
+// AuditErrorClass returns the class of the auth error.
+func AuditErrorClass(err error) string {
+	for _, c := range auditErrorClasses {
+		if errors.Is(err, c.err) {
+			return c.class
+		}
+	}
+	return "Error"
+}
+
+// Auditor writes the authentication decisions of the providers chain to the audit sink.
+// The events are buffered and written in batches by the background loop. The CoreDB sink
+// is set after the CoreDB is attached, the events are kept in the buffer until that.
+type Auditor struct {
+	Config AuditConfig
+
+	anonymous     bool
+	anonymousRole string
+
+	events chan AuditEvent
+
+	mu   sync.RWMutex
+	sink AuditSink
+
+	// pending are the token rejections (ErrInvalidKeyType) of the requests that are not decided yet
+	pending sync.Map
+}
+
+// NewAuditor creates the auditor and starts writing the events until the context is done.
+func NewAuditor(ctx context.Context, c AuditConfig) (*Auditor, error) {
+	a := &Auditor{
+		Config: c,
+		events: make(chan AuditEvent, c.bufferSize()),
+	}
+	switch c.sink() {
+	case AuditSinkStdout:
+		a.sink = newWriterAuditSink(os.Stdout)
+	case AuditSinkFile:
+		s, err := newFileAuditSink(c)
+		if err != nil {
+			return nil, err
+		}
+		a.sink = s
+	case AuditSinkCoreDB:
+		// the sink is set by the audit runtime source
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q, expected %s, %s or %s", c.Sink, AuditSinkStdout, AuditSinkFile, AuditSinkCoreDB)
+	}
+	go a.run(ctx)
+	return a, nil
+}
+
+// SetSink sets the audit sink, e.g. the CoreDB table.
+func (a *Auditor) SetSink(s AuditSink) {
+	a.mu.Lock()
+	a.sink = s
+	a.mu.Unlock()
+}
+
+func (a *Auditor) getSink() AuditSink {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.sink
+}
+
+// Record adds the event to the buffer, the event is dropped if the buffer is full.
+func (a *Auditor) Record(e AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	select {
+	case a.events <- e:
+	default:
+		auditDroppedEvents.Inc()
+	}
+}
+
+func (a *Auditor) run(ctx context.Context) {
+	flush := time.NewTicker(a.Config.flushInterval())
+	defer flush.Stop()
+	retention := time.NewTicker(auditRetentionInterval)
+	defer retention.Stop()
+	var batch []AuditEvent
+	for {
+		select {
+		case <-ctx.Done():
+			for len(a.events) > 0 {
+				batch = append(batch, <-a.events)
+			}
+			a.write(context.WithoutCancel(ctx), batch)
+			return
+		case e := <-a.events:
+			batch = append(batch, e)
+			if len(batch) >= auditBatchSize {
+				batch = a.write(ctx, batch)
+			}
+		case <-flush.C:
+			batch = a.write(ctx, batch)
+		case <-retention.C:
+			a.applyRetention(ctx)
+		}
+	}
+}
+
+// write writes the batch and returns the events to keep: the batch is kept (limited by the buffer size)
+// until the sink is set.
+func (a *Auditor) write(ctx context.Context, batch []AuditEvent) []AuditEvent {
+	if len(batch) == 0 {
+		return batch
+	}
+	sink := a.getSink()
+	if sink == nil {
+		if n := len(batch) - a.Config.bufferSize(); n > 0 {
+			auditDroppedEvents.Add(float64(n))
+			batch = batch[n:]
+		}
+		return batch
+	}
+	if err := sink.WriteEvents(ctx, batch); err != nil {
+		log.Printf("Auth: audit: write %d events error: %v", len(batch), err)
+		auditDroppedEvents.Add(float64(len(batch)))
+	}
+	return batch[:0]
+}
+
+func (a *Auditor) applyRetention(ctx context.Context) {
+	if a.Config.Retention <= 0 {
+		return
+	}
+	sink := a.getSink()
+	if sink == nil {
+		return
+	}
+	if err := sink.RemoveBefore(ctx, time.Now().Add(-a.Config.Retention)); err != nil {
+		log.Printf("Auth: audit: retention error: %v", err)
+	}
+}
+
+func (a *Auditor) event(r *http.Request, p auth.AuthProvider) AuditEvent {
+	e := AuditEvent{
+		Time:      time.Now().UTC(),
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+	}
+	if p != nil {
+		e.Provider, e.ProviderType = p.Name(), p.Type()
+	}
+	return e
+}
+
+func (a *Auditor) success(r *http.Request, p auth.AuthProvider, info *auth.AuthInfo) {
+	a.pending.Delete(r)
+	e := a.event(r, p)
+	e.Outcome = AuditSuccess
+	e.UserID, e.UserName, e.Role = info.UserId, info.UserName, info.Role
+	if o := info.ImpersonatedBy; o != nil {
+		e.RealUserID, e.RealUserName, e.RealRole = o.UserId, o.UserName, o.Role
+	}
+	a.Record(e)
+}
+
+func (a *Auditor) failure(r *http.Request, p auth.AuthProvider, err error) {
+	a.pending.Delete(r)
+	e := a.event(r, p)
+	e.Outcome = AuditFailure
+	e.ErrorClass, e.Error = AuditErrorClass(err), err.Error()
+	a.Record(e)
+}
+
+// rejected remembers the token rejection, the next provider can accept the token.
+func (a *Auditor) rejected(r *http.Request, p auth.AuthProvider, err error) {
+	e := a.event(r, p)
+	e.Outcome = AuditFailure
+	e.ErrorClass, e.Error = AuditErrorClass(err), err.Error()
+	a.pending.Store(r, e)
+}
+
+// chainEnd records the decision if no provider has accepted or denied the request:
+// the rejected token, the anonymous access or the missing credentials.
+func (a *Auditor) chainEnd(r *http.Request) {
+	if e, ok := a.pending.LoadAndDelete(r); ok {
+		a.Record(e.(AuditEvent))
+		return
+	}
+	e := a.event(r, nil)
+	if a.anonymous {
+		e.Outcome, e.Role = AuditAnonymous, a.anonymousRole
+		a.Record(e)
+		return
+	}
+	e.Outcome = AuditFailure
+	e.ErrorClass, e.Error = AuditErrorClass(auth.ErrNeedAuth), "no credentials"
+	a.Record(e)
+}
+
+// auditProvider records the decisions of the wrapped provider, the last provider of the chain
+// records the requests that are not decided by the providers.
+type auditProvider struct {
+	auth.AuthProvider
+	auditor *Auditor
+	last    bool
+}
+
+func (p *auditProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	info, err := p.AuthProvider.Authenticate(r)
+	switch {
+	case err == nil && info != nil:
+		p.auditor.success(r, p.AuthProvider, info)
+	case errors.Is(err, auth.ErrSkipAuth):
+		if p.last {
+			p.auditor.chainEnd(r)
+		}
+	case errors.Is(err, auth.ErrInvalidKeyType):
+		p.auditor.rejected(r, p.AuthProvider, err)
+		if p.last {
+			p.auditor.chainEnd(r)
+		}
+	case err != nil:
+		p.auditor.failure(r, p.AuthProvider, err)
+	}
+	return info, err
+}
+
+// Unwrap returns the wrapped provider.
+func (p *auditProvider) Unwrap() auth.AuthProvider {
+	return p.AuthProvider
+}
+
+// ConfiguredAuditor returns the auditor of the auth providers, nil if the audit log is disabled.
+func ConfiguredAuditor(c *auth.Config) *Auditor {
+	if c == nil {
+		return nil
+	}
+	if ap, ok := findWrapper[*auditProvider](c.Providers); ok {
+		return ap.auditor
+	}
+	return nil
+}
+
+// writerAuditSink writes the events as JSON lines, the retention isn't applied.
+type writerAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newWriterAuditSink(w io.Writer) *writerAuditSink {
+	return &writerAuditSink{enc: json.NewEncoder(w)}
+}
+
+func (s *writerAuditSink) WriteEvents(_ context.Context, events []AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		if err := s.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *writerAuditSink) RemoveBefore(context.Context, time.Time) error {
+	return nil
+}
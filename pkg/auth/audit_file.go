@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditMaxFileSize = 100 << 20
+	// auditFileTimeFormat is the suffix of the rotated files: <file>.<time>
+	auditFileTimeFormat = "20060102T150405.000"
+)
+
+// fileAuditSink writes the events as JSON lines to the file, the file is rotated by the size and daily,
+// the rotated files are removed by the retention settings.
+type fileAuditSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened string // the day of the file events
+}
+
+func newFileAuditSink(c AuditConfig) (*fileAuditSink, error) {
+	if c.File == "" {
+		return nil, errors.New("audit file is required for the file sink")
+	}
+	s := &fileAuditSink{
+		path:     c.File,
+		maxSize:  c.MaxFileSize,
+		maxFiles: c.MaxFiles,
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultAuditMaxFileSize
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	s.opened = time.Now().UTC().Format(time.DateOnly)
+	if s.size != 0 {
+		s.opened = fi.ModTime().UTC().Format(time.DateOnly)
+	}
+	return nil
+}
+
+func (s *fileAuditSink) WriteEvents(_ context.Context, events []AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if s.size != 0 && (s.size+int64(len(b)) > s.maxSize || e.Time.UTC().Format(time.DateOnly) != s.opened) {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := s.f.Write(b)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileAuditSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, s.path+"."+time.Now().UTC().Format(auditFileTimeFormat)); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.maxFiles <= 0 {
+		return nil
+	}
+	files, err := s.rotated()
+	if err != nil || len(files) <= s.maxFiles {
+		return err
+	}
+	var errs []error
+	for _, f := range files[:len(files)-s.maxFiles] {
+		errs = append(errs, os.Remove(f))
+	}
+	return errors.Join(errs...)
+}
+
+// rotated returns the rotated files from the oldest to the newest.
+func (s *fileAuditSink) rotated() ([]string, error) {
+	matches, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, m := range matches {
+		if _, err := time.Parse(auditFileTimeFormat, strings.TrimPrefix(m, s.path+".")); err == nil {
+			files = append(files, m)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+func (s *fileAuditSink) RemoveBefore(_ context.Context, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := s.rotated()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Before(t) {
+			errs = append(errs, os.Remove(f))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+type memoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *memoryAuditSink) WriteEvents(_ context.Context, events []AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *memoryAuditSink) RemoveBefore(context.Context, time.Time) error {
+	return nil
+}
+
+// wait returns the n written events.
+func (s *memoryAuditSink) wait(t *testing.T, n int) []AuditEvent {
+	t.Helper()
+	for range 200 {
+		s.mu.Lock()
+		if len(s.events) >= n {
+			events := s.events
+			s.events = nil
+			s.mu.Unlock()
+			return events
+		}
+		s.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("audit events are not written, want %d", n)
+	return nil
+}
+
+func TestAuditor_Chain(t *testing.T) {
+	hash, err := HashAPIKey("etl-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "auth.yaml")
+	err = os.WriteFile(file, []byte(`api-keys:
+  etl:
+    key-hash: `+hash+`
+    default-role: loader
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, anonymous := range []bool{false, true} {
+		c := &Config{
+			ConfigFile:       file,
+			SecretKey:        "admin-secret",
+			AllowedAnonymous: anonymous,
+			AnonymousRole:    "public",
+			Audit:            AuditConfig{Enabled: true, FlushInterval: 10 * time.Millisecond},
+		}
+		ac, err := c.Configure(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := ConfiguredAuditor(ac)
+		if a == nil {
+			t.Fatal("auditor is not configured")
+		}
+		sink := &memoryAuditSink{}
+		a.SetSink(sink)
+		handler := auth.AuthMiddleware(*ac)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		request := func(headers map[string]string) int {
+			r := httptest.NewRequest(http.MethodPost, "/query", nil)
+			r.Header.Set("User-Agent", "audit-test")
+			for k, v := range headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Code
+		}
+		request(map[string]string{"x-hugr-secret-key": "admin-secret", "x-hugr-user-id": "ops"})
+		request(map[string]string{"x-hugr-secret-key": "wrong"})
+		request(map[string]string{"x-hugr-api-key": "etl-key"})
+		request(map[string]string{"x-hugr-api-key": "wrong"})
+		request(nil)
+
+		events := sink.wait(t, 5)
+		want := []AuditEvent{
+			{Provider: "x-hugr-secret", ProviderType: "apiKey", UserID: "ops", Role: "admin", Outcome: AuditSuccess},
+			{Provider: "x-hugr-secret", ProviderType: "apiKey", Outcome: AuditFailure, ErrorClass: "ErrForbidden"},
+			{Provider: "etl", ProviderType: "apiKey", UserID: "api", Role: "loader", Outcome: AuditSuccess},
+			{Provider: "etl", ProviderType: "apiKey", Outcome: AuditFailure, ErrorClass: "ErrInvalidKeyType"},
+			{Outcome: AuditFailure, ErrorClass: "ErrNeedAuth"},
+		}
+		if anonymous {
+			want[4] = AuditEvent{Outcome: AuditAnonymous, Role: "public"}
+		}
+		if len(events) != len(want) {
+			t.Fatalf("anonymous %t: events = %+v", anonymous, events)
+		}
+		for i, e := range events {
+			w := want[i]
+			if e.Provider != w.Provider || e.ProviderType != w.ProviderType || e.UserID != w.UserID || e.Role != w.Role ||
+				e.Outcome != w.Outcome || e.ErrorClass != w.ErrorClass {
+				t.Errorf("anonymous %t: event %d = %+v, want %+v", anonymous, i, e, w)
+			}
+			if e.ClientIP != "192.0.2.1" || e.UserAgent != "audit-test" || e.Path != "/query" || e.Time.IsZero() {
+				t.Errorf("anonymous %t: event %d request fields = %+v", anonymous, i, e)
+			}
+		}
+		a.pending.Range(func(k, v any) bool {
+			t.Errorf("pending decision is left: %+v", v)
+			return false
+		})
+	}
+}
+
+func TestAuditor_BufferUntilSink(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	a, err := NewAuditor(ctx, AuditConfig{Sink: AuditSinkCoreDB, BufferSize: 2, FlushInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"a", "b", "c"} {
+		a.Record(AuditEvent{UserID: user, Outcome: AuditSuccess})
+		time.Sleep(20 * time.Millisecond)
+	}
+	sink := &memoryAuditSink{}
+	a.SetSink(sink)
+	events := sink.wait(t, 2)
+	if len(events) != 2 || events[0].UserID != "b" || events[1].UserID != "c" {
+		t.Errorf("buffered events = %+v, want the newest 2", events)
+	}
+
+	// the buffered events are written on the shutdown
+	a.Record(AuditEvent{UserID: "d", Outcome: AuditSuccess})
+	cancel()
+	if events := sink.wait(t, 1); events[0].UserID != "d" {
+		t.Errorf("events written on shutdown = %+v", events)
+	}
+
+	if _, err := NewAuditor(t.Context(), AuditConfig{Sink: "syslog"}); err == nil {
+		t.Error("unknown sink must be rejected")
+	}
+	if _, err := NewAuditor(t.Context(), AuditConfig{Sink: AuditSinkFile}); err == nil {
+		t.Error("file sink without the file must be rejected")
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := newFileAuditSink(AuditConfig{File: path, MaxFileSize: 300, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for i := range 10 {
+		err := s.WriteEvents(t.Context(), []AuditEvent{{Time: now, UserID: "user", Outcome: AuditSuccess, Path: "/query"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			time.Sleep(2 * time.Millisecond) // the rotated files get the distinct names
+		}
+	}
+	files, err := s.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("rotated files = %v, want 2 (max_files)", files)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 || fi.Size() > 300 {
+		t.Errorf("current file: %v, %v", fi, err)
+	}
+
+	// the event of the next day rotates the file
+	if err := s.WriteEvents(t.Context(), []AuditEvent{{Time: now.Add(24 * time.Hour), Outcome: AuditSuccess}}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() > 150 {
+		t.Errorf("file is not rotated daily: %v, %v", fi, err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(files[1], old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveBefore(t.Context(), time.Now().Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[1]); !os.IsNotExist(err) {
+		t.Errorf("file out of the retention period is not removed: %v", err)
+	}
+}
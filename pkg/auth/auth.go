@@ -1,16 +1,17 @@
 package auth
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
-	"strings"
+	"slices"
 
 	"github.com/hugr-lab/query-engine/pkg/auth"
-	"go.yaml.in/yaml/v3"
 )
 
 type Config struct {
@@ -18,24 +19,57 @@ type Config struct {
 	AllowedAnonymous  bool       `json:"allowed_anonymous"`
 	AnonymousRole     string     `json:"anonymous_role"`
 	OIDC              OIDCConfig `json:"oidc"`
+	// OIDCProviders are the additional named OIDC providers (e.g. federated IdPs),
+	// each of them is added to the chain as a separate provider.
+	OIDCProviders map[string]OIDCConfig `json:"oidc_providers"`
+	// APIKeysLifecycle configures the usage tracking, rotation and expiration of the managed API keys
+	APIKeysLifecycle ManagedAPIKeysConfig `json:"api_keys_lifecycle"`
+	// Denylist is the denylist of the revoked tokens, subjects and sessions
+	Denylist DenylistConfig `json:"denylist"`
+	// Audit is the audit log of the authentication decisions
+	Audit AuditConfig `json:"audit"`
+	// Lockout is the brute-force protection of the API keys, the secret key and the basic credentials
+	Lockout LockoutConfig `json:"lockout"`
+	// Impersonation limits the roles that can be impersonated or turns the impersonation off
+	Impersonation ImpersonationConfig `json:"impersonation"`
+	// Login is the browser login by the default OIDC provider
+	Login LoginConfig `json:"login"`
+	// TrustedProxies are the CIDRs of the reverse proxies, the client IP of their requests is taken from X-Forwarded-For
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// RedirectLoginPaths are the path suffixes of the unauthenticated requests that are redirected to the LoginUrl
+	RedirectLoginPaths []string `json:"redirect_login_paths"`
+	LoginUrl           string   `json:"login_url"`
+	// RedirectUrl is the base URL of the page to return to after the login
+	RedirectUrl string `json:"redirect_url"`
 
 	// API Key with default admin role should be provided in the header x-hugr-secret-key
 	SecretKey string `json:"-"`
+	// SecretKeyHash is the hash of the secret key, if it is set the key is checked by the hash
+	SecretKeyHash string `json:"-"`
 
 	ConfigFile string `json:"-"`
 }
 
 func (c *Config) Configure(ctx context.Context) (*auth.Config, error) {
 	config := &auth.Config{}
+	// the introspection providers go after the OIDC ones,
+	// so the JWT tokens are verified locally without the introspection requests
+	var introspection []auth.AuthProvider
+	// keyHeaders are the headers of the API keys counted by the lockout
+	var keyHeaders []string
 	if c.ConfigFile != "" {
 		pc, err := LoadFile(c.ConfigFile)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load auth config file: %w", err)
 		}
 		for name, apiKeyConfig := range pc.APIKeys {
-			config.Providers = append(config.Providers,
-				auth.NewApiKey(name, apiKeyConfig),
-			)
+			p, err := apiKeyConfig.provider(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create api key provider %s: %w", name, err)
+			}
+			config.Providers = append(config.Providers, p)
+			keyHeaders = append(keyHeaders, cmp.Or(apiKeyConfig.Header, "x-hugr-api-key"))
 		}
 		for _, jwtConfig := range pc.JWT {
 			jwtProvider, err := auth.NewJwt(&jwtConfig)
@@ -45,9 +79,39 @@ func (c *Config) Configure(ctx context.Context) (*auth.Config, error) {
 			config.Providers = append(config.Providers, jwtProvider)
 		}
 
+		for _, name := range slices.Sorted(maps.Keys(pc.Basic)) {
+			bp, err := NewBasicProvider(ctx, name, pc.Basic[name])
+			if err != nil {
+				return nil, fmt.Errorf("failed to create basic auth provider %s: %w", name, err)
+			}
+			config.Providers = append(config.Providers, bp)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(pc.LDAP)) {
+			lp, err := NewLDAPProvider(name, pc.LDAP[name])
+			if err != nil {
+				return nil, fmt.Errorf("failed to create LDAP provider %s: %w", name, err)
+			}
+			config.Providers = append(config.Providers, lp)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(pc.Introspection)) {
+			ip, err := NewIntrospectionProvider(name, pc.Introspection[name])
+			if err != nil {
+				return nil, fmt.Errorf("failed to create introspection provider %s: %w", name, err)
+			}
+			introspection = append(introspection, ip)
+		}
+
 		if pc.OIDC.Issuer != "" {
 			c.OIDC = pc.OIDC
 		}
+		for name, oc := range pc.OIDCProviders {
+			if c.OIDCProviders == nil {
+				c.OIDCProviders = make(map[string]OIDCConfig)
+			}
+			c.OIDCProviders[name] = oc
+		}
 
 		if pc.Anonymous.Allowed {
 			c.AllowedAnonymous = true
@@ -56,14 +120,58 @@ func (c *Config) Configure(ctx context.Context) (*auth.Config, error) {
 		if pc.SecretKey != "" {
 			c.SecretKey = pc.SecretKey
 		}
+		if pc.SecretKeyHash != "" {
+			c.SecretKeyHash = pc.SecretKeyHash
+		}
 		if pc.ManagedAPIKeysEnabled {
 			c.ManagementApiKeys = pc.ManagedAPIKeysEnabled
 		}
+		if pc.APIKeysLifecycle != (ManagedAPIKeysConfig{}) {
+			c.APIKeysLifecycle = pc.APIKeysLifecycle
+		}
+		if pc.Denylist.Enabled {
+			c.Denylist = pc.Denylist
+		}
+		if pc.Audit.Enabled {
+			c.Audit = pc.Audit
+		}
+		if pc.Lockout.Enabled {
+			c.Lockout = pc.Lockout
+		}
+		c.Impersonation.Disabled = c.Impersonation.Disabled || pc.Impersonation.Disabled
+		if len(pc.Impersonation.Targets) != 0 {
+			c.Impersonation.Targets = pc.Impersonation.Targets
+		}
+		if pc.Login.Enabled {
+			c.Login = pc.Login
+		}
+		if len(pc.TrustedProxies) != 0 {
+			c.TrustedProxies = pc.TrustedProxies
+		}
+		if len(pc.RedirectLoginPaths) != 0 {
+			c.RedirectLoginPaths = pc.RedirectLoginPaths
+		}
+		if pc.LoginUrl != "" {
+			c.LoginUrl = pc.LoginUrl
+		}
+		if pc.RedirectUrl != "" {
+			c.RedirectUrl = pc.RedirectUrl
+		}
 	}
 
-	if c.SecretKey != "" {
-		config.Providers = append(config.Providers,
-			auth.NewApiKey("x-hugr-secret", auth.ApiKeyConfig{
+	if c.ManagementApiKeys {
+		// the keys are stored hashed, so the engine provider (plaintext lookup) is replaced
+		config.Providers = append([]auth.AuthProvider{
+			NewManagedAPIKeyProvider("managed-api-keys", "x-hugr-api-key", c.APIKeysLifecycle),
+		}, config.Providers...)
+		keyHeaders = append(keyHeaders, "x-hugr-api-key")
+	}
+
+	var secret auth.AuthProvider
+	if c.SecretKey != "" || c.SecretKeyHash != "" {
+		// the secret key is checked by its hash if it is set, the raw key is still used to encrypt the OAuth state
+		skc := APIKeyConfig{
+			ApiKeyConfig: auth.ApiKeyConfig{
 				Key:         c.SecretKey,
 				Header:      "x-hugr-secret-key",
 				DefaultRole: "admin",
@@ -72,105 +180,290 @@ func (c *Config) Configure(ctx context.Context) (*auth.Config, error) {
 					UserId:   "x-hugr-user-id",
 					UserName: "x-hugr-user-name",
 				},
-			}),
-		)
+			},
+			KeyHash: c.SecretKeyHash,
+		}
+		if c.SecretKeyHash != "" {
+			skc.Key = ""
+		}
+		sk, err := skc.provider("x-hugr-secret")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create secret key provider: %w", err)
+		}
+		config.Providers = append(config.Providers, sk)
+		secret = sk
+		keyHeaders = append(keyHeaders, "x-hugr-secret-key")
 	}
 
-	if c.OIDC.Issuer != "" {
-		oidc, err := NewOIDCProvider(ctx, c.OIDC)
+	if _, ok := c.OIDCProviders[DefaultOIDCProviderName]; ok && c.OIDC.Issuer != "" {
+		return nil, fmt.Errorf("OIDC provider name %q is reserved for the default OIDC provider", DefaultOIDCProviderName)
+	}
+	for _, name := range c.oidcNames() {
+		oidc, err := NewOIDCProvider(ctx, name, c.oidcConfig(name))
 		if err != nil {
-			return nil, fmt.Errorf("failed to create OIDC provider: %w", err)
+			return nil, fmt.Errorf("failed to create OIDC provider %s: %w", name, err)
 		}
 		config.Providers = append(config.Providers, oidc)
 	}
+	config.Providers = append(config.Providers, introspection...)
+
+	// the lockout sees the provider errors before the denylist check
+	var lockout *Lockout
+	if c.Lockout.Enabled && len(config.Providers) != 0 {
+		if err := c.Lockout.validate(); err != nil {
+			return nil, fmt.Errorf("invalid auth lockout config: %w", err)
+		}
+		slices.Sort(keyHeaders)
+		lockout = NewLockout(c.Lockout, slices.Compact(keyHeaders))
+		for i, p := range config.Providers {
+			config.Providers[i] = &lockoutProvider{AuthProvider: p, lockout: lockout, last: i == len(config.Providers)-1}
+		}
+	}
+
+	if c.Denylist.Enabled && len(config.Providers) != 0 {
+		dl := NewDenylist(c.Denylist)
+		for i, p := range config.Providers {
+			config.Providers[i] = &denylistProvider{AuthProvider: p, denylist: dl}
+		}
+	}
+
+	// the impersonated identity is built before the audit, so both identities are recorded
+	for i, p := range config.Providers {
+		ip := &impersonationProvider{AuthProvider: p, c: c.Impersonation, last: i == len(config.Providers)-1}
+		if unwrapProvider(p) == secret {
+			ip.secret = &auth.AuthInfo{Role: "admin", UserId: "api", UserName: "api"}
+		}
+		config.Providers[i] = ip
+	}
+
+	if c.Audit.Enabled && len(config.Providers) != 0 {
+		a, err := NewAuditor(ctx, c.Audit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create auth audit log: %w", err)
+		}
+		// the anonymous provider is evaluated by the engine after the others,
+		// so the anonymous access is recorded by the last provider
+		a.anonymous, a.anonymousRole = c.AllowedAnonymous, c.AnonymousRole
+		for i, p := range config.Providers {
+			config.Providers[i] = &auditProvider{AuthProvider: p, auditor: a, last: i == len(config.Providers)-1}
+		}
+		if lockout != nil {
+			// the requests rejected by the lockout are recorded as well
+			lockout.auditor = a
+		}
+	}
 
 	if c.AllowedAnonymous {
-		config.Providers = append(config.Providers,
-			auth.NewAnonymous(auth.AnonymousConfig{
-				Allowed: true,
-				Role:    c.AnonymousRole,
-			}),
-		)
+		var anonymous auth.AuthProvider = auth.NewAnonymous(auth.AnonymousConfig{
+			Allowed: true,
+			Role:    c.AnonymousRole,
+		})
+		if len(config.Providers) == 0 {
+			// there is no provider to reject the impersonation of the anonymous access
+			anonymous = &anonymousProvider{AuthProvider: anonymous}
+		}
+		config.Providers = append(config.Providers, anonymous)
 	}
-	config.DBApiKeysEnabled = c.ManagementApiKeys
 
 	if len(config.Providers) == 0 {
 		return nil, nil
 	}
+	if c.LoginUrl == "" && c.LoginEnabled() {
+		c.LoginUrl = DefaultLoginURL
+	}
+	config.RedirectLoginPaths = c.RedirectLoginPaths
+	config.LoginUrl = c.LoginUrl
+	config.RedirectUrl = c.RedirectUrl
 	return config, nil
 }
 
 type ProvidersConfig struct {
-	ManagedAPIKeysEnabled bool                         `json:"managed_api_keys" yaml:"managed-api-keys"`
-	Anonymous             auth.AnonymousConfig         `json:"anonymous" yaml:"anonymous"`
-	APIKeys               map[string]auth.ApiKeyConfig `json:"api_keys" yaml:"api-keys"`
-	JWT                   map[string]auth.JwtConfig    `json:"jwt" yaml:"jwt"`
-	OIDC                  OIDCConfig                   `json:"oidc" yaml:"oidc"`
+	ManagedAPIKeysEnabled bool                           `json:"managed_api_keys" yaml:"managed-api-keys"`
+	Anonymous             auth.AnonymousConfig           `json:"anonymous" yaml:"anonymous"`
+	APIKeysLifecycle      ManagedAPIKeysConfig           `json:"api_keys_lifecycle" yaml:"api-keys-lifecycle"`
+	APIKeys               map[string]APIKeyConfig        `json:"api_keys" yaml:"api-keys"`
+	JWT                   map[string]auth.JwtConfig      `json:"jwt" yaml:"jwt"`
+	OIDC                  OIDCConfig                     `json:"oidc" yaml:"oidc"`
+	OIDCProviders         map[string]OIDCConfig          `json:"oidc_providers" yaml:"oidc-providers"`
+	Introspection         map[string]IntrospectionConfig `json:"introspection" yaml:"introspection"`
+	Basic                 map[string]BasicConfig         `json:"basic" yaml:"basic"`
+	LDAP                  map[string]LDAPConfig          `json:"ldap" yaml:"ldap"`
+	Denylist              DenylistConfig                 `json:"denylist" yaml:"denylist"`
+	Audit                 AuditConfig                    `json:"audit" yaml:"audit"`
+	Lockout               LockoutConfig                  `json:"lockout" yaml:"lockout"`
+	Impersonation         ImpersonationConfig            `json:"impersonation" yaml:"impersonation"`
+	Login                 LoginConfig                    `json:"login" yaml:"login"`
+	TrustedProxies        []string                       `json:"trusted_proxies" yaml:"trusted-proxies"`
 
 	RedirectLoginPaths []string `json:"redirect_login_paths" yaml:"redirect-login-paths"`
 	LoginUrl           string   `json:"login_url" yaml:"login-url"`
 	RedirectUrl        string   `json:"redirect_url" yaml:"redirect-url"`
 	SecretKey          string   `json:"secret_key" yaml:"secret-key"`
+	SecretKeyHash      string   `json:"secret_key_hash" yaml:"secret-key-hash"`
 }
 
-func LoadFile(configFile string) (c *ProvidersConfig, err error) {
+// LoadFile loads the auth providers config file (JSON or YAML), the unknown fields are rejected.
+func LoadFile(configFile string) (*ProvidersConfig, error) {
 	b, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 	var conf ProvidersConfig
-	switch {
-	case strings.HasSuffix(configFile, ".json"):
-		err = json.Unmarshal(b, &conf)
-	case strings.HasSuffix(configFile, ".yaml") ||
-		strings.HasSuffix(configFile, ".yml"):
-		err = yaml.Unmarshal(b, &conf)
-	default:
-		return nil, fmt.Errorf("unsupported config file format: %s", configFile)
-	}
-	return &conf, err
+	if err := decodeConfigFile(configFile, b, &conf); err != nil {
+		return nil, err
+	}
+	return &conf, nil
 }
 
+// DefaultOIDCProviderName is the name of the OIDC provider configured by the OIDC_* variables
+// or the oidc section of the config file.
+const DefaultOIDCProviderName = "oidc"
+
 // OIDCEnabled returns true if OIDC authentication is configured.
 func (c *Config) OIDCEnabled() bool {
-	return c.OIDC.Issuer != ""
+	return len(c.oidcNames()) != 0
+}
+
+// oidcNames returns the names of the configured OIDC providers,
+// the default provider goes first and the named ones follow in the alphabetical order.
+func (c *Config) oidcNames() []string {
+	var names []string
+	if c.OIDC.Issuer != "" {
+		names = append(names, DefaultOIDCProviderName)
+	}
+	named := slices.Sorted(maps.Keys(c.OIDCProviders))
+	for _, name := range named {
+		if name == DefaultOIDCProviderName && c.OIDC.Issuer != "" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *Config) oidcConfig(name string) OIDCConfig {
+	if name == DefaultOIDCProviderName && c.OIDC.Issuer != "" {
+		return c.OIDC
+	}
+	return c.OIDCProviders[name]
+}
+
+// OIDCProviderInfo is the public configuration of an OIDC provider.
+type OIDCProviderInfo struct {
+	Name       string `json:"name"`
+	Issuer     string `json:"issuer"`
+	ClientID   string `json:"client_id"`
+	CookieName string `json:"cookie_name,omitempty"`
 }
 
 // AuthConfigHandler returns an http.HandlerFunc that responds with
-// the public OIDC configuration (issuer and client_id).
+// the public OIDC configuration: issuer and client_id of the default provider
+// and the list of all configured OIDC providers.
 // Intended for public clients that need to perform OIDC login.
 func (c *Config) AuthConfigHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		names := c.oidcNames()
+		providers := make([]OIDCProviderInfo, 0, len(names))
+		for _, name := range names {
+			oc := c.oidcConfig(name)
+			providers = append(providers, OIDCProviderInfo{
+				Name:       name,
+				Issuer:     oc.Issuer,
+				ClientID:   oc.ClientID,
+				CookieName: oc.CookieName,
+			})
+		}
+		resp := map[string]any{
+			"providers": providers,
+		}
+		if len(providers) != 0 {
+			resp["issuer"] = providers[0].Issuer
+			resp["client_id"] = providers[0].ClientID
+		}
+		if c.LoginEnabled() {
+			loginURL := c.LoginUrl
+			if loginURL == "" {
+				loginURL = DefaultLoginURL
+			}
+			resp["login_url"] = loginURL
+			resp["logout_url"] = "/auth/logout"
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"issuer":    c.OIDC.Issuer,
-			"client_id": c.OIDC.ClientID,
-		})
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// RediscoverOIDC re-runs the discovery of all OIDC providers in the auth config
+// and returns the number of refreshed providers.
+func RediscoverOIDC(ctx context.Context, c *auth.Config) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+	n := 0
+	for _, p := range c.Providers {
+		op, ok := unwrapProvider(p).(*OIDCProvider)
+		if !ok {
+			continue
+		}
+		if err := op.Rediscover(ctx); err != nil {
+			return n, fmt.Errorf("oidc provider %s: %w", op.Name(), err)
+		}
+		n++
 	}
+	return n, nil
 }
 
 func PrintSummary(c *auth.Config) {
 	log.Printf("Auth: Number of providers: %d", len(c.Providers))
 	for i, p := range c.Providers {
-		switch v := p.(type) {
+		switch v := unwrapProvider(p).(type) {
 		case *auth.ApiKeyProvider:
 			if v.Name() == "x-hugr-secret" {
 				log.Printf("Provider %d: Type: Secret", i)
 				continue
 			}
 			log.Printf("Auth: Provider %d: Type: APIKey, Name: %s", i, v.Name())
+		case *HashedAPIKeyProvider:
+			if v.Name() == "x-hugr-secret" {
+				log.Printf("Provider %d: Type: Secret (hashed)", i)
+				continue
+			}
+			log.Printf("Auth: Provider %d: Type: APIKey (hashed), Name: %s", i, v.Name())
+		case *ManagedAPIKeyProvider:
+			log.Printf("Auth: Provider %d: Type: Managed API Keys, Name: %s, Header: %s", i, v.Name(), v.header)
 		case *auth.JwtProvider:
 			log.Printf("Auth: Provider %d: Type: JWT, Issuer: %s", i, v.Issuer)
 		case *auth.AnonymousProvider:
 			log.Printf("Auth: Provider %d: Type: Anonymous, Allowed: %t, Role: %s", i, v.Config.Allowed, v.Config.Role)
 		case *OIDCProvider:
-			log.Printf("Auth: Provider %d: Type: OIDC, Issuer: %s, ClientID: %s", i, v.c.Issuer, v.c.ClientID)
+			log.Printf("Auth: Provider %d: Type: OIDC, Name: %s, Issuer: %s, ClientID: %s", i, v.Name(), v.c.Issuer, v.c.ClientID)
+		case *BasicProvider:
+			log.Printf("Auth: Provider %d: Type: Basic, Name: %s, File: %s", i, v.Name(), v.c.File)
+		case *LDAPProvider:
+			log.Printf("Auth: Provider %d: Type: LDAP, Name: %s, URL: %s, StartTLS: %t", i, v.Name(), v.c.URL, v.c.StartTLS)
+		case *IntrospectionProvider:
+			log.Printf("Auth: Provider %d: Type: Introspection, Name: %s, Endpoint: %s", i, v.Name(), v.c.Endpoint)
 		default:
 			log.Printf("Auth: Provider %d: Type: %T", i, v)
 		}
 	}
-	if c.DBApiKeysEnabled {
-		log.Printf("Auth: Managed API Keys enabled")
+	if dl := ConfiguredDenylist(c); dl != nil {
+		log.Printf("Auth: Denylist enabled, refresh interval: %s", dl.Config.Interval())
+	}
+	if a := ConfiguredAuditor(c); a != nil {
+		log.Printf("Auth: Audit log enabled, sink: %s, retention: %s", a.Config.sink(), a.Config.Retention)
+	}
+	if ic, ok := configuredImpersonation(c); ok {
+		switch {
+		case ic.Disabled:
+			log.Printf("Auth: Impersonation disabled")
+		case len(ic.Targets) != 0:
+			log.Printf("Auth: Impersonation targets: %v", ic.Targets)
+		}
+	}
+	if l := ConfiguredLockout(c); l != nil {
+		log.Printf("Auth: Lockout enabled, max failures: ip %d, credential %d, window: %s",
+			l.Config.maxFailures(LockoutScopeIP), l.Config.maxFailures(LockoutScopeCredential), l.Config.window())
 	}
 	if c.LoginUrl != "" {
 		log.Printf("Auth: LoginUrl: %+v", c.LoginUrl)
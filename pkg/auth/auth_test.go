@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadFile_OIDCProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	err := os.WriteFile(path, []byte(`
+oidc:
+  issuer: https://main.example.com
+  client_id: hugr
+oidc-providers:
+  partner:
+    issuer: https://partner.example.com
+    client_id: hugr-partner
+    cookie_name: partner_token
+    scope_role_prefix: "hugr:"
+  corp:
+    issuer: https://corp.example.com
+    claims:
+      role: groups
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if len(pc.OIDCProviders) != 2 {
+		t.Fatalf("oidc providers = %d, want 2", len(pc.OIDCProviders))
+	}
+	if p := pc.OIDCProviders["partner"]; p.CookieName != "partner_token" || p.ScopeRolePrefix != "hugr:" {
+		t.Fatalf("partner = %+v", p)
+	}
+	if p := pc.OIDCProviders["corp"]; p.Claims.Role != "groups" {
+		t.Fatalf("corp claims = %+v", p.Claims)
+	}
+}
+
+func TestConfig_OIDCProviders(t *testing.T) {
+	c := &Config{
+		OIDC: OIDCConfig{Issuer: "https://main.example.com", ClientID: "hugr"},
+		OIDCProviders: map[string]OIDCConfig{
+			"partner": {Issuer: "https://partner.example.com", ClientID: "hugr-partner", CookieName: "partner_token"},
+			"corp":    {Issuer: "https://corp.example.com", ClientID: "hugr-corp"},
+		},
+	}
+	if !c.OIDCEnabled() {
+		t.Fatal("OIDCEnabled = false, want true")
+	}
+	if names := c.oidcNames(); !slices.Equal(names, []string{"oidc", "corp", "partner"}) {
+		t.Fatalf("names = %v", names)
+	}
+
+	w := httptest.NewRecorder()
+	c.AuthConfigHandler()(w, httptest.NewRequest("GET", "/auth/config", nil))
+	var resp struct {
+		Issuer    string             `json:"issuer"`
+		ClientID  string             `json:"client_id"`
+		Providers []OIDCProviderInfo `json:"providers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Issuer != "https://main.example.com" || resp.ClientID != "hugr" {
+		t.Fatalf("default provider = %s %s", resp.Issuer, resp.ClientID)
+	}
+	if len(resp.Providers) != 3 || resp.Providers[2].Name != "partner" || resp.Providers[2].CookieName != "partner_token" {
+		t.Fatalf("providers = %+v", resp.Providers)
+	}
+
+	// the named provider can't replace the default one
+	c.OIDCProviders["oidc"] = OIDCConfig{Issuer: "https://other.example.com"}
+	if _, err := c.Configure(t.Context()); err == nil {
+		t.Fatal("OIDC provider named oidc is accepted with the default provider")
+	}
+	if err := (&ProvidersConfig{OIDC: c.OIDC, OIDCProviders: c.OIDCProviders}).Validate(); err == nil {
+		t.Fatal("config file with OIDC provider named oidc is valid")
+	}
+	delete(c.OIDCProviders, "oidc")
+
+	// only the named providers are configured
+	c.OIDC = OIDCConfig{}
+	if names := c.oidcNames(); !slices.Equal(names, []string{"corp", "partner"}) {
+		t.Fatalf("names = %v", names)
+	}
+}
+
+func TestConfigure_Login(t *testing.T) {
+	idp := httptest.NewServer(http.NotFoundHandler())
+	defer idp.Close()
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	err := os.WriteFile(path, []byte(`
+oidc:
+  issuer: `+idp.URL+`
+  client_id: hugr
+login:
+  enabled: true
+  session_ttl: 8h
+redirect-login-paths: [/admin]
+redirect-url: https://hugr.example.com
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{ConfigFile: path}
+	ac, err := c.Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.LoginEnabled() || c.Login.SessionTTL.Hours() != 8 {
+		t.Fatalf("login = %+v", c.Login)
+	}
+	// the unauthenticated requests of the redirect paths are sent to the login endpoint
+	if ac.LoginUrl != DefaultLoginURL || !slices.Equal(ac.RedirectLoginPaths, []string{"/admin"}) || ac.RedirectUrl != "https://hugr.example.com" {
+		t.Fatalf("engine login config = %q %v %q", ac.LoginUrl, ac.RedirectLoginPaths, ac.RedirectUrl)
+	}
+	if lc := c.OAuthLoginConfig(); lc.RedirectURL != "https://hugr.example.com" || lc.SessionTTL != c.Login.SessionTTL {
+		t.Fatalf("oauth login config = %+v", lc)
+	}
+
+	w := httptest.NewRecorder()
+	c.AuthConfigHandler()(w, httptest.NewRequest("GET", "/auth/config", nil))
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["login_url"] != DefaultLoginURL || resp["logout_url"] != "/auth/logout" {
+		t.Fatalf("auth config = %v", resp)
+	}
+
+	// the custom login URL is advertised
+	c.LoginUrl = "/portal/login"
+	w = httptest.NewRecorder()
+	c.AuthConfigHandler()(w, httptest.NewRequest("GET", "/auth/config", nil))
+	resp = nil
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["login_url"] != "/portal/login" {
+		t.Fatalf("auth config with custom login url = %v", resp)
+	}
+}
@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned if the password doesn't match the user.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+const defaultBasicRefreshInterval = 30 * time.Second
+
+// BasicConfig is the configuration of the HTTP Basic authentication provider (for the legacy clients, e.g. BI tools).
+// The users are read from the htpasswd-style file, one entry per line:
+//
+//	username:hash[:role[:claim=value,claim=value]]
+//
+// The hash is bcrypt ($2y$, $2a$, $2b$) or argon2 ($argon2id$, $argon2i$ in the PHC format).
+type BasicConfig struct {
+	File string `json:"file" yaml:"file"`
+	// DefaultRole is assigned to the users without the role in the file.
+	DefaultRole string `json:"default_role" yaml:"default_role"`
+	// RefreshInterval is the interval to check the file for changes (default 30s).
+	RefreshInterval time.Duration `json:"refresh_interval" yaml:"refresh_interval"`
+	// CacheTTL is the time the verified credentials are cached to skip the slow hash verification, 0 - disabled.
+	CacheTTL time.Duration `json:"cache_ttl" yaml:"cache_ttl"`
+}
+
+type basicUser struct {
+	name   string
+	hash   string
+	role   string
+	claims map[string]any
+}
+
+// BasicProvider authenticates the requests by the HTTP Basic credentials of the users from the htpasswd-style file.
+type BasicProvider struct {
+	name string
+	c    BasicConfig
+
+	mu      sync.RWMutex
+	users   map[string]basicUser
+	modTime time.Time
+	// dummyHash is verified for the unknown users, so they cost the same as the known ones
+	dummyHash string
+
+	cache *tokenCache[*basicUser]
+}
+
+func NewBasicProvider(ctx context.Context, name string, c BasicConfig) (*BasicProvider, error) {
+	if c.File == "" {
+		return nil, errors.New("basic auth users file is required")
+	}
+	p := &BasicProvider{
+		name: name,
+		c:    c,
+	}
+	if c.CacheTTL > 0 {
+		p.cache = newTokenCache[*basicUser](name, 1000, c.CacheTTL)
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	go p.run(ctx)
+	return p, nil
+}
+
+func (p *BasicProvider) Name() string {
+	return p.name
+}
+
+func (p *BasicProvider) Type() string {
+	return "basic"
+}
+
+func (p *BasicProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, auth.ErrSkipAuth
+	}
+	p.mu.RLock()
+	u, ok := p.users[username]
+	dummyHash := p.dummyHash
+	p.mu.RUnlock()
+	if !ok {
+		// the unknown users must not be told apart from the wrong passwords by the response time
+		verifyPassword(dummyHash, password)
+		// the user can be authenticated by the next basic provider (e.g. LDAP)
+		return nil, auth.ErrInvalidKeyType
+	}
+	key := sha256.Sum256([]byte(u.hash + "\x00" + password))
+	if p.cache == nil {
+		if !verifyPassword(u.hash, password) {
+			log.Printf("Auth: %s: invalid password for user %q", p.name, username)
+			return nil, ErrInvalidCredentials
+		}
+	} else if _, ok := p.cache.get(key); !ok {
+		if !verifyPassword(u.hash, password) {
+			log.Printf("Auth: %s: invalid password for user %q", p.name, username)
+			return nil, ErrInvalidCredentials
+		}
+		p.cache.add(key, &u, time.Time{})
+	}
+	role := u.role
+	if role == "" {
+		role = p.c.DefaultRole
+	}
+	if role == "" {
+		log.Printf("Auth: %s: user %q has no role", p.name, username)
+		return nil, auth.ErrForbidden
+	}
+	claims := make(map[string]any, len(u.claims)+1)
+	for k, v := range u.claims {
+		claims[k] = v
+	}
+	claims["sub"] = u.name
+	userName := u.name
+	if n, ok := u.claims["name"].(string); ok && n != "" {
+		userName = n
+	}
+	return &auth.AuthInfo{
+		Role:         role,
+		UserId:       u.name,
+		UserName:     userName,
+		AuthType:     "basic",
+		AuthProvider: p.name,
+		Claims:       claims,
+	}, nil
+}
+
+// load reads the users file.
+func (p *BasicProvider) load() error {
+	fi, err := os.Stat(p.c.File)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p.c.File)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.c.File, err)
+	}
+	p.mu.Lock()
+	p.users = users
+	p.dummyHash = dummyHash(users)
+	p.modTime = fi.ModTime()
+	p.mu.Unlock()
+	if p.cache != nil {
+		p.cache.purge()
+	}
+	return nil
+}
+
+// dummyHash returns the hash of the first user by name, it has the same algorithm and cost as the configured hashes.
+func dummyHash(users map[string]basicUser) string {
+	var name string
+	for n := range users {
+		if name == "" || n < name {
+			name = n
+		}
+	}
+	return users[name].hash
+}
+
+// reloadIfChanged re-reads the users file if its modification time is changed.
+func (p *BasicProvider) reloadIfChanged() error {
+	fi, err := os.Stat(p.c.File)
+	if err != nil {
+		return err
+	}
+	p.mu.RLock()
+	changed := !fi.ModTime().Equal(p.modTime)
+	p.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	if err := p.load(); err != nil {
+		return err
+	}
+	log.Printf("Auth: %s: users file reloaded", p.name)
+	return nil
+}
+
+// run re-reads the users file until the context is done, the previous users are kept if the file is invalid.
+func (p *BasicProvider) run(ctx context.Context) {
+	interval := p.c.RefreshInterval
+	if interval <= 0 {
+		interval = defaultBasicRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.reloadIfChanged(); err != nil {
+			log.Printf("Auth: %s: users file reload error: %v", p.name, err)
+		}
+	}
+}
+
+// parseHtpasswd parses the users file, the empty lines and the lines started with # are skipped.
+func parseHtpasswd(data []byte) (map[string]basicUser, error) {
+	users := make(map[string]basicUser)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		parts := strings.SplitN(s, ":", 4)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash[:role[:claims]]", line)
+		}
+		u := basicUser{name: parts[0], hash: parts[1]}
+		if !supportedHash(u.hash) {
+			return nil, fmt.Errorf("line %d: unsupported password hash for user %q, bcrypt or argon2 expected", line, u.name)
+		}
+		if len(parts) > 2 {
+			u.role = parts[2]
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			u.claims = make(map[string]any)
+			for kv := range strings.SplitSeq(parts[3], ",") {
+				k, v, ok := strings.Cut(kv, "=")
+				if !ok || k == "" {
+					return nil, fmt.Errorf("line %d: invalid claim %q, expected claim=value", line, kv)
+				}
+				u.claims[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		if _, ok := users[u.name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", line, u.name)
+		}
+		users[u.name] = u
+	}
+	return users, scanner.Err()
+}
+
+func supportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	case strings.HasPrefix(hash, "$argon2"):
+		_, err := parseArgon2(hash)
+		return err == nil
+	}
+	return false
+}
+
+func verifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2") {
+		h, err := parseArgon2(hash)
+		if err != nil {
+			return false
+		}
+		return h.verify(password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// The limits of the argon2 parameters: the memory (KiB) and the number of passes.
+const (
+	argon2MaxMemory = 1 << 20
+	argon2MaxTime   = 64
+)
+
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 parses the argon2 hash in the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func parseArgon2(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2 hash format")
+	}
+	h := &argon2Hash{variant: parts[1]}
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return nil, fmt.Errorf("unsupported argon2 variant %q", h.variant)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	// the parameters out of the range make the argon2 panic or take too much time and memory on every login
+	switch {
+	case h.time < 1 || h.time > argon2MaxTime:
+		return nil, fmt.Errorf("invalid argon2 time %d, must be 1..%d", h.time, argon2MaxTime)
+	case h.threads < 1:
+		return nil, errors.New("invalid argon2 parallelism, must be at least 1")
+	case h.memory < 8*uint32(h.threads) || h.memory > argon2MaxMemory:
+		return nil, fmt.Errorf("invalid argon2 memory %d KiB, must be %d..%d", h.memory, 8*uint32(h.threads), argon2MaxMemory)
+	}
+	var err error
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	if len(h.salt) == 0 || len(h.key) == 0 {
+		return nil, errors.New("invalid argon2 hash: empty salt or key")
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) verify(password string) bool {
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func argon2TestHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestBasicProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.htpasswd")
+	content := "# BI tools\n" +
+		"tableau:" + bcryptHash(t, "pass1") + ":analyst:email=bi@example.com,name=Tableau\n" +
+		"\n" +
+		"powerbi:" + argon2TestHash("pass2") + "\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewBasicProvider(t.Context(), "bi", BasicConfig{File: file, DefaultRole: "readonly", CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticate := func(user, password string, basic bool) (*auth.AuthInfo, error) {
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		if basic {
+			r.SetBasicAuth(user, password)
+		}
+		return p.Authenticate(r)
+	}
+
+	if _, err := authenticate("", "", false); !errors.Is(err, auth.ErrSkipAuth) {
+		t.Errorf("no basic header: err = %v, want ErrSkipAuth", err)
+	}
+	if _, err := authenticate("unknown", "pass1", true); !errors.Is(err, auth.ErrInvalidKeyType) {
+		t.Errorf("unknown user: err = %v, want ErrInvalidKeyType", err)
+	}
+	// the unknown users are verified against the configured hash
+	if p.dummyHash != p.users["powerbi"].hash {
+		t.Errorf("dummy hash = %q, want the hash of the first user", p.dummyHash)
+	}
+	if _, err := authenticate("tableau", "wrong", true); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: err = %v, want ErrInvalidCredentials", err)
+	}
+	for range 2 { // the second request is served from the cache
+		info, err := authenticate("tableau", "pass1", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Role != "analyst" || info.UserId != "tableau" || info.UserName != "Tableau" ||
+			info.Claims["email"] != "bi@example.com" || info.AuthType != "basic" {
+			t.Errorf("unexpected auth info: %+v", info)
+		}
+	}
+	info, err := authenticate("powerbi", "pass2", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Role != "readonly" {
+		t.Errorf("role = %q, want the default role", info.Role)
+	}
+
+	// the changed file is reloaded, the cached credentials are dropped
+	content = "tableau:" + bcryptHash(t, "new-pass") + ":analyst\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Second))
+	if err := p.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate("tableau", "pass1", true); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("old password after reload: err = %v", err)
+	}
+	if _, err := authenticate("tableau", "new-pass", true); err != nil {
+		t.Errorf("new password after reload: %v", err)
+	}
+	if _, err := authenticate("powerbi", "pass2", true); !errors.Is(err, auth.ErrInvalidKeyType) {
+		t.Errorf("removed user: err = %v", err)
+	}
+
+	// the invalid file keeps the previous users
+	if err := os.WriteFile(file, []byte("broken\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(2*time.Second))
+	if err := p.reloadIfChanged(); err == nil {
+		t.Error("invalid file must not be loaded")
+	}
+	if _, err := authenticate("tableau", "new-pass", true); err != nil {
+		t.Errorf("previous users must be kept: %v", err)
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	for _, content := range []string{
+		"user",
+		"user:plain-text",
+		"user:$apr1$abc$def",
+		"user:" + argon2TestHash("x") + ":role:claim",
+		"user:" + argon2TestHash("x") + "\nuser:" + argon2TestHash("y"),
+	} {
+		if _, err := parseHtpasswd([]byte(content)); err == nil {
+			t.Errorf("%q: expected error", content)
+		}
+	}
+}
+
+func TestParseArgon2_InvalidParameters(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	for name, hash := range map[string]string{
+		"zero time":        fmt.Sprintf("$argon2id$v=%d$m=1024,t=0,p=1$%s$%s", argon2.Version, salt, key),
+		"zero parallelism": fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=0$%s$%s", argon2.Version, salt, key),
+		"empty key":        fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$", argon2.Version, salt),
+		"empty salt":       fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$$%s", argon2.Version, key),
+		"low memory":       fmt.Sprintf("$argon2id$v=%d$m=8,t=1,p=4$%s$%s", argon2.Version, salt, key),
+		"huge memory":      fmt.Sprintf("$argon2id$v=%d$m=4294967295,t=1,p=1$%s$%s", argon2.Version, salt, key),
+		"huge time":        fmt.Sprintf("$argon2id$v=%d$m=1024,t=100000,p=1$%s$%s", argon2.Version, salt, key),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if supportedHash(hash) {
+				t.Error("hash must be rejected")
+			}
+			if verifyPassword(hash, "x") {
+				t.Error("password must not match")
+			}
+			if _, err := parseHtpasswd([]byte("user:" + hash)); err == nil {
+				t.Error("htpasswd line must be rejected")
+			}
+			if _, err := (APIKeyConfig{KeyHash: hash}).provider("x"); err == nil {
+				t.Error("key hash must be rejected")
+			}
+		})
+	}
+}
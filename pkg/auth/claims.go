@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RoleMappingRule maps a claim value to the hugr role.
+// The rule matches if the claim (or any element of the array claim) is equal to the Value
+// or matches the glob Pattern (e.g. "*@example.com" to match the email domain).
+type RoleMappingRule struct {
+	// Claim is the claim selector: a top-level claim name, a dotted path (realm_access.roles)
+	// or a JSONPath-like expression ($.resource_access['hugr-app'].roles).
+	Claim   string `json:"claim" yaml:"claim"`
+	Value   string `json:"value" yaml:"value"`
+	Pattern string `json:"pattern" yaml:"pattern"`
+	Role    string `json:"role" yaml:"role"`
+	// Priority defines the order of the rules evaluation, the rules with higher priority go first,
+	// rules with the same priority are evaluated in the order of definition.
+	Priority int `json:"priority" yaml:"priority"`
+}
+
+func (r RoleMappingRule) validate() error {
+	if r.Claim == "" {
+		return fmt.Errorf("role mapping: claim is required")
+	}
+	if r.Role == "" {
+		return fmt.Errorf("role mapping %s: role is required", r.Claim)
+	}
+	if r.Value == "" && r.Pattern == "" {
+		return fmt.Errorf("role mapping %s: value or pattern is required", r.Claim)
+	}
+	if r.Pattern != "" {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("role mapping %s: invalid pattern %q: %w", r.Claim, r.Pattern, err)
+		}
+	}
+	return nil
+}
+
+func (r RoleMappingRule) match(claims jwt.MapClaims) bool {
+	for _, s := range claimStrings(claimValue(claims, r.Claim)) {
+		if r.Value != "" && s == r.Value {
+			return true
+		}
+		if r.Pattern != "" {
+			if ok, _ := path.Match(r.Pattern, s); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sortRoleMapping validates the rules and orders them by priority.
+func sortRoleMapping(rules []RoleMappingRule) ([]RoleMappingRule, error) {
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	rules = slices.Clone(rules)
+	slices.SortStableFunc(rules, func(a, b RoleMappingRule) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	return rules, nil
+}
+
+// mapRoles returns the roles of all matched rules in the rules order.
+func mapRoles(rules []RoleMappingRule, claims jwt.MapClaims) []string {
+	var roles []string
+	for _, r := range rules {
+		if r.match(claims) {
+			roles = append(roles, r.Role)
+		}
+	}
+	return roles
+}
+
+// uniqueStrings removes the duplicates keeping the order of the first occurrences.
+func uniqueStrings(ss []string) []string {
+	seen := make(map[string]struct{}, len(ss))
+	return slices.DeleteFunc(ss, func(s string) bool {
+		if _, ok := seen[s]; ok {
+			return true
+		}
+		seen[s] = struct{}{}
+		return false
+	})
+}
+
+// selectGrantedRole returns the requested role if it is granted,
+// otherwise the default role if it is granted or the first granted role.
+func selectGrantedRole(requested, defaultRole string, roles []string) (string, error) {
+	if len(roles) == 0 {
+		return "", errors.New("no role is granted")
+	}
+	if requested != "" {
+		if !slices.Contains(roles, requested) {
+			return "", fmt.Errorf("requested role %q is not granted", requested)
+		}
+		return requested, nil
+	}
+	if defaultRole != "" && slices.Contains(roles, defaultRole) {
+		return defaultRole, nil
+	}
+	return roles[0], nil
+}
+
+// ClaimCondition is the admission condition on the token claim.
+// The condition is satisfied if the claim exists and:
+// - is equal to Equals (compared by the string representation, e.g. true == "true"), if it is set;
+// - contains the Contains value (the string claim is equal or the array claim has the element), if it is set.
+type ClaimCondition struct {
+	// Claim is the claim selector (see RoleMappingRule.Claim).
+	Claim    string `json:"claim" yaml:"claim"`
+	Equals   any    `json:"equals" yaml:"equals"`
+	Contains string `json:"contains" yaml:"contains"`
+}
+
+func (c ClaimCondition) validate() error {
+	if c.Claim == "" {
+		return fmt.Errorf("required claim: claim is required")
+	}
+	return nil
+}
+
+// check returns the reason if the condition isn't satisfied.
+func (c ClaimCondition) check(claims jwt.MapClaims) error {
+	v := claimValue(claims, c.Claim)
+	if v == nil {
+		return fmt.Errorf("claim %s is missing", c.Claim)
+	}
+	if c.Equals != nil && fmt.Sprint(v) != fmt.Sprint(c.Equals) {
+		return fmt.Errorf("claim %s is not equal to %v", c.Claim, c.Equals)
+	}
+	if c.Contains != "" && !slices.Contains(claimStrings(v), c.Contains) {
+		return fmt.Errorf("claim %s doesn't contain %s", c.Claim, c.Contains)
+	}
+	return nil
+}
+
+// claimValue returns the claim value by the selector.
+// The selector can be:
+// - the top-level claim name, it is checked first, so the names with dots (like "https://example.com/roles") are supported
+// - the dotted path to the nested claim: "realm_access.roles"
+// - the JSONPath-like expression: "$.resource_access['hugr-app'].roles" or "$.groups[0]"
+func claimValue(claims jwt.MapClaims, selector string) any {
+	if len(claims) == 0 || selector == "" {
+		return nil
+	}
+	if v, ok := claims[selector]; ok {
+		return v
+	}
+	var cur any = map[string]any(claims)
+	for _, seg := range claimPath(selector) {
+		switch val := cur.(type) {
+		case map[string]any:
+			v, ok := val[seg]
+			if !ok {
+				return nil
+			}
+			cur = v
+		case []any:
+			var i int
+			if _, err := fmt.Sscanf(seg, "%d", &i); err != nil || i < 0 || i >= len(val) {
+				return nil
+			}
+			cur = val[i]
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// claimPath splits the claim selector into the path segments.
+func claimPath(selector string) []string {
+	selector = strings.TrimPrefix(selector, "$")
+	var segs []string
+	for len(selector) > 0 {
+		switch selector[0] {
+		case '.':
+			selector = selector[1:]
+		case '[':
+			end := strings.IndexByte(selector, ']')
+			if end == -1 {
+				return append(segs, selector[1:])
+			}
+			seg := strings.Trim(selector[1:end], `'"`)
+			segs = append(segs, seg)
+			selector = selector[end+1:]
+		default:
+			end := strings.IndexAny(selector, ".[")
+			if end == -1 {
+				return append(segs, selector)
+			}
+			segs = append(segs, selector[:end])
+			selector = selector[end:]
+		}
+	}
+	return segs
+}
+
+// claimStrings returns the string values of the claim (string or array of strings).
+func claimStrings(v any) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []string:
+		return val
+	case []any:
+		var ss []string
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
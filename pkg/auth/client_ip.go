@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the networks of the reverse proxies (ingress, load balancer) in front of the server,
+// the client IP of their requests is taken from the X-Forwarded-For header.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses the list of the CIDRs or the IP addresses of the trusted proxies.
+func ParseTrustedProxies(list []string) (TrustedProxies, error) {
+	var tp TrustedProxies
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", s, err)
+			}
+			addr = addr.Unmap()
+			tp = append(tp, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", s, err)
+		}
+		tp = append(tp, p.Masked())
+	}
+	return tp, nil
+}
+
+func (tp TrustedProxies) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range tp {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the client IP of the request. If the request comes from a trusted proxy,
+// the X-Forwarded-For addresses are checked from the right (the one added by the nearest proxy)
+// and the first address that isn't a trusted proxy is the client, the addresses on its left can be forged.
+func (tp TrustedProxies) ClientIP(r *http.Request) string {
+	ip := clientIP(r)
+	if !tp.trusted(ip) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// the invalid address is not a client, the last checked proxy is used
+			return ip
+		}
+		ip = addr.Unmap().String()
+		if !tp.trusted(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// Middleware replaces the remote address of the requests from the trusted proxies by the client IP,
+// so the lockout, the audit log and the usage of the API keys see the client instead of the proxy.
+func (tp TrustedProxies) Middleware(next http.Handler) http.Handler {
+	if len(tp) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := tp.ClientIP(r); ip != clientIP(r) {
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the request client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	tp, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{name: "direct client", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer", remote: "203.0.113.5:1234", xff: []string{"198.51.100.1"}, want: "203.0.113.5"},
+		{name: "trusted proxy", remote: "10.1.2.3:1234", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "forged hops", remote: "10.1.2.3:1234", xff: []string{"1.2.3.4, 198.51.100.1, 192.168.1.1"}, want: "198.51.100.1"},
+		{name: "multiple headers", remote: "10.1.2.3:1234", xff: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "invalid hop", remote: "10.1.2.3:1234", xff: []string{"198.51.100.1, unknown, 192.168.1.1"}, want: "192.168.1.1"},
+		{name: "no header", remote: "10.1.2.3:1234", want: "10.1.2.3"},
+		{name: "only proxies", remote: "10.1.2.3:1234", xff: []string{"10.0.0.1"}, want: "10.0.0.1"},
+		{name: "ipv6 proxy", remote: "[fd00::1]:1234", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/query", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := tp.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+			var seen string
+			tp.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = clientIP(r)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if seen != tt.want {
+				t.Errorf("middleware client IP = %q, want %q", seen, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR is accepted")
+	}
+	if _, err := ParseTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Error("host name is accepted")
+	}
+}
+
+func TestTrustedProxies_Lockout(t *testing.T) {
+	tp, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLockout(LockoutConfig{Enabled: true, IPMaxFailures: 2, CredentialMaxFailures: 100}, []string{"x-api-key"})
+	handler := tp.Middleware(l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.failure(r)
+		w.WriteHeader(http.StatusUnauthorized)
+	})))
+	request := func(client string) int {
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", client)
+		r.Header.Set("x-api-key", "guess")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	request("198.51.100.1")
+	request("198.51.100.1")
+	if code := request("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("locked out client: code = %d, want 429", code)
+	}
+	// the other clients behind the same proxy are not locked out
+	if code := request("198.51.100.2"); code != http.StatusUnauthorized {
+		t.Fatalf("other client: code = %d, want 401", code)
+	}
+}
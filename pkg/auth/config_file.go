@@ -0,0 +1,378 @@
+package auth
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"go.yaml.in/yaml/v3"
+)
+
+// The config file values can reference the environment variables and the files:
+//
+//	${NAME}        - the value of the environment variable NAME, it must be set
+//	${file:/path}  - the content of the file without the trailing new lines (e.g. the mounted secret)
+//	$${            - the literal ${
+//
+// The references are expanded in the YAML string values and in the JSON text (the value is JSON escaped).
+var configRefPattern = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandConfigRefs replaces the references in the value, the escape function is applied to the substituted values.
+func expandConfigRefs(s string, escape func(string) string) (string, error) {
+	var errs []error
+	out := configRefPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$${" {
+			return "${"
+		}
+		v, err := resolveConfigRef(m[2 : len(m)-1])
+		if err != nil {
+			errs = append(errs, err)
+			return m
+		}
+		if escape != nil {
+			v = escape(v)
+		}
+		return v
+	})
+	return out, errors.Join(errs...)
+}
+
+func resolveConfigRef(ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		if path == "" {
+			return "", errors.New("empty file reference")
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("file reference: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if !envNamePattern.MatchString(ref) {
+		return "", fmt.Errorf("invalid reference ${%s}", ref)
+	}
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return v, nil
+}
+
+// expandJSONConfig expands the references in the JSON config text.
+func expandJSONConfig(b []byte) ([]byte, error) {
+	s, err := expandConfigRefs(string(b), func(v string) string {
+		q, _ := json.Marshal(v)
+		return string(q[1 : len(q)-1])
+	})
+	return []byte(s), err
+}
+
+// expandYAMLConfig expands the references in the scalar values of the parsed YAML document,
+// the plain scalars are resolved again, so the references can be used for the numbers and booleans.
+func expandYAMLConfig(n *yaml.Node) error {
+	var errs []error
+	if n.Kind == yaml.ScalarNode && strings.Contains(n.Value, "${") {
+		v, err := expandConfigRefs(n.Value, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n.Line, err))
+		}
+		n.Value = v
+		if n.Style == 0 && n.Tag == "!!str" {
+			n.Tag = ""
+		}
+	}
+	for _, c := range n.Content {
+		errs = append(errs, expandYAMLConfig(c))
+	}
+	return errors.Join(errs...)
+}
+
+// decodeConfigFile strictly decodes the config file content, the format is selected by the file extension.
+// The unknown fields are reported with their line numbers, so the misspelled keys don't disable the providers silently.
+func decodeConfigFile(name string, b []byte, conf *ProvidersConfig) error {
+	switch {
+	case strings.HasSuffix(name, ".json"):
+		b, err := expandJSONConfig(b)
+		if err != nil {
+			return err
+		}
+		// JSON is parsed as YAML to get the line numbers of the unknown fields
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err == nil {
+			if err := checkConfigFields(&doc, reflect.TypeOf(conf), "json", ""); err != nil {
+				return err
+			}
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(conf); err != nil {
+			return jsonConfigError(b, err)
+		}
+		if dec.More() {
+			return errors.New("unexpected data after the config object")
+		}
+		return nil
+	case strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml"):
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return err
+		}
+		if doc.Kind == 0 {
+			return nil
+		}
+		if err := expandYAMLConfig(&doc); err != nil {
+			return err
+		}
+		if err := checkConfigFields(&doc, reflect.TypeOf(conf), "yaml", ""); err != nil {
+			return err
+		}
+		return doc.Decode(conf)
+	}
+	return fmt.Errorf("unsupported config file format: %s", name)
+}
+
+// jsonConfigError adds the line number to the JSON syntax and type errors.
+func jsonConfigError(b []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		offset = int64(len(b))
+	default:
+		return err
+	}
+	line := 1 + bytes.Count(b[:min(int(offset), len(b))], []byte("\n"))
+	return fmt.Errorf("line %d: %w", line, err)
+}
+
+var (
+	yamlUnmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// configField is the config struct field as it is named in the file.
+type configField struct {
+	name string
+	typ  reflect.Type
+}
+
+// decodesItself returns true if the type has its own decoding, its content isn't checked.
+func decodesItself(t reflect.Type) bool {
+	pt := reflect.PointerTo(t)
+	return pt.Implements(yamlUnmarshalerType) || pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType)
+}
+
+// configFields returns the fields of the struct as they are matched by the decoder of the format (json or yaml tag):
+// the json decoder promotes the fields of the embedded structs, the yaml decoder promotes the inline ones only.
+func configFields(t reflect.Type, tag string) []configField {
+	var fields []configField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		inline := tag == "yaml" && slices.Contains(strings.Split(opts, ","), "inline") ||
+			tag == "json" && f.Anonymous && name == ""
+		if inline && ft.Kind() == reflect.Struct {
+			fields = append(fields, configFields(ft, tag)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+			if tag == "yaml" {
+				name = strings.ToLower(name)
+			}
+		}
+		fields = append(fields, configField{name: name, typ: f.Type})
+	}
+	return fields
+}
+
+// lookupConfigField finds the field by the key, the json keys are matched case-insensitively as by the decoder.
+func lookupConfigField(fields []configField, key, tag string) (configField, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+	if tag == "json" {
+		for _, f := range fields {
+			if strings.EqualFold(f.name, key) {
+				return f, true
+			}
+		}
+	}
+	return configField{}, false
+}
+
+// checkConfigFields reports the mapping keys that don't match the fields of the config type.
+func checkConfigFields(n *yaml.Node, t reflect.Type, tag, path string) error {
+	var errs []error
+	walkConfigFields(n, t, tag, path, &errs)
+	return errors.Join(errs...)
+}
+
+func walkConfigFields(n *yaml.Node, t reflect.Type, tag, path string, errs *[]error) {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	if n.Kind == yaml.DocumentNode {
+		for _, c := range n.Content {
+			walkConfigFields(c, t, tag, path, errs)
+		}
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if decodesItself(t) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		fields := configFields(t, tag)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if tag == "yaml" && k.Value == "<<" {
+				// the merge key adds the fields of the referenced mapping
+				walkConfigFields(v, t, tag, path, errs)
+				continue
+			}
+			f, ok := lookupConfigField(fields, k.Value, tag)
+			if !ok {
+				*errs = append(*errs, unknownConfigField(k, path, fields))
+				continue
+			}
+			walkConfigFields(v, f.typ, tag, configPath(path, k.Value), errs)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			walkConfigFields(n.Content[i+1], t.Elem(), tag, configPath(path, n.Content[i].Value), errs)
+		}
+	case reflect.Slice, reflect.Array:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, c := range n.Content {
+			walkConfigFields(c, t.Elem(), tag, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+func configPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// unknownConfigField returns the error for the unknown key, the field that differs only in the separators
+// (api_keys and api-keys) or the case is suggested.
+func unknownConfigField(k *yaml.Node, path string, fields []configField) error {
+	in := ""
+	if path != "" {
+		in = " in " + path
+	}
+	normalize := strings.NewReplacer("-", "", "_", "").Replace
+	for _, f := range fields {
+		if strings.EqualFold(normalize(f.name), normalize(k.Value)) {
+			return fmt.Errorf("line %d: unknown field %q%s, did you mean %q?", k.Line, k.Value, in, f.name)
+		}
+	}
+	return fmt.Errorf("line %d: unknown field %q%s", k.Line, k.Value, in)
+}
+
+// Validate checks the providers settings that can be checked without the requests to the external services
+// (the OIDC discovery, LDAP and introspection endpoints are not checked).
+func (c *ProvidersConfig) Validate() error {
+	var errs []error
+	add := func(section, name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", section, name, err))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.APIKeys)) {
+		_, err := c.APIKeys[name].provider(name)
+		add("api key", name, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.JWT)) {
+		jc := c.JWT[name]
+		_, err := auth.NewJwt(&jc)
+		add("jwt", name, err)
+	}
+	if !reflect.ValueOf(c.OIDC).IsZero() {
+		add("oidc", DefaultOIDCProviderName, validateOIDCConfig(c.OIDC))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.OIDCProviders)) {
+		add("oidc provider", name, validateOIDCConfig(c.OIDCProviders[name]))
+	}
+	if _, ok := c.OIDCProviders[DefaultOIDCProviderName]; ok && c.OIDC.Issuer != "" {
+		add("oidc provider", DefaultOIDCProviderName, errors.New("the name is reserved for the default OIDC provider"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Introspection)) {
+		_, err := NewIntrospectionProvider(name, c.Introspection[name])
+		add("introspection", name, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Basic)) {
+		bc := c.Basic[name]
+		if bc.File == "" {
+			add("basic", name, errors.New("basic auth users file is required"))
+			continue
+		}
+		add("basic", name, (&BasicProvider{name: name, c: bc}).load())
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.LDAP)) {
+		_, err := NewLDAPProvider(name, c.LDAP[name])
+		add("ldap", name, err)
+	}
+	if c.SecretKeyHash != "" && !supportedKeyHash(c.SecretKeyHash) {
+		errs = append(errs, errors.New("secret key hash: unsupported key hash format"))
+	}
+	if err := c.Lockout.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("lockout: %w", err))
+	}
+	if _, err := ParseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func validateOIDCConfig(c OIDCConfig) error {
+	if c.Issuer == "" {
+		return errors.New("issuer is required")
+	}
+	_, err := sortRoleMapping(c.RoleMapping)
+	return err
+}
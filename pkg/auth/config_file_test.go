@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestLoadFile_References(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("file-\"secret\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HUGR_TEST_KEY", "env-key")
+	t.Setenv("HUGR_TEST_ALLOWED", "true")
+
+	yamlPath := filepath.Join(dir, "auth.yaml")
+	err := os.WriteFile(yamlPath, []byte(`
+# ${NOT_EXPANDED_IN_COMMENTS}
+anonymous:
+  allowed: ${HUGR_TEST_ALLOWED}
+  role: "$${literal}"
+api-keys:
+  etl:
+    key: ${HUGR_TEST_KEY}
+    header: x-etl-key
+secret-key: ${file:`+secretFile+`}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "auth.json")
+	err = os.WriteFile(jsonPath, []byte(`{
+		"anonymous": {"allowed": ${HUGR_TEST_ALLOWED}, "role": "$${literal}"},
+		"api_keys": {"etl": {"key": "${HUGR_TEST_KEY}", "header": "x-etl-key"}},
+		"secret_key": "${file:`+secretFile+`}"
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		pc, err := LoadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !pc.Anonymous.Allowed || pc.Anonymous.Role != "${literal}" {
+			t.Errorf("%s: anonymous = %+v", path, pc.Anonymous)
+		}
+		if pc.APIKeys["etl"].Key != "env-key" || pc.APIKeys["etl"].Header != "x-etl-key" {
+			t.Errorf("%s: api key = %+v", path, pc.APIKeys["etl"])
+		}
+		if pc.SecretKey != `file-"secret"` {
+			t.Errorf("%s: secret key = %q", path, pc.SecretKey)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"unset variable":  "secret-key: ${HUGR_TEST_UNSET_VARIABLE}\n",
+		"missing file":    "secret-key: ${file:" + filepath.Join(dir, "missing") + "}\n",
+		"invalid name":    "secret-key: ${HUGR TEST}\n",
+		"empty reference": "secret-key: ${}\n",
+	} {
+		path := filepath.Join(dir, "invalid.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadFile(path)
+		if err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("%s: err = %v, want the error at line 1", name, err)
+		}
+	}
+}
+
+func TestLoadFile_UnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		file    string
+		content string
+		errs    []string
+	}{
+		{
+			file: "auth.yaml",
+			content: `anonymous:
+  allowed: true
+api_keys:
+  etl:
+    key: k
+oidc:
+  issuer: https://idp.example.com
+  client-id: hugr
+  claims:
+    user_id: sub
+`,
+			errs: []string{
+				`line 3: unknown field "api_keys", did you mean "api-keys"?`,
+				`line 8: unknown field "client-id" in oidc, did you mean "client_id"?`,
+				`line 10: unknown field "user_id" in oidc.claims, did you mean "user-id"?`,
+			},
+		},
+		{
+			file: "auth.yaml",
+			content: `api-keys:
+  etl:
+    key: k
+    defualt-role: loader
+`,
+			errs: []string{`line 4: unknown field "defualt-role" in api-keys.etl`},
+		},
+		{
+			file: "auth.json",
+			content: `{
+  "api_keys": {"etl": {"key": "k", "key-hash": "x"}},
+  "oidc": {"issuer": "https://idp.example.com"}
+}`,
+			errs: []string{`line 2: unknown field "key-hash" in api_keys.etl, did you mean "key_hash"?`},
+		},
+		{
+			file:    "auth.json",
+			content: "{\n  \"anonymous\": {\"allowed\": \"yes\"}\n}",
+			errs:    []string{"line 2: json: cannot unmarshal string"},
+		},
+		{
+			file:    "auth.json",
+			content: "{\n  \"anonymous\": {\n}",
+			errs:    []string{"line 3: "},
+		},
+	} {
+		path := filepath.Join(dir, tt.file)
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadFile(path)
+		if err == nil {
+			t.Errorf("%s: unknown fields are accepted:\n%s", tt.file, tt.content)
+			continue
+		}
+		for _, want := range tt.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: err = %v, want %q", tt.file, err, want)
+			}
+		}
+	}
+
+	// the JSON names are matched case-insensitively as by the decoder
+	path := filepath.Join(dir, "case.json")
+	if err := os.WriteFile(path, []byte(`{"Anonymous": {"Allowed": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if pc, err := LoadFile(path); err != nil || !pc.Anonymous.Allowed {
+		t.Errorf("case-insensitive JSON fields: %+v, %v", pc, err)
+	}
+}
+
+func TestProvidersConfig_Validate(t *testing.T) {
+	pc := &ProvidersConfig{
+		APIKeys: map[string]APIKeyConfig{
+			"ok":   {ApiKeyConfig: auth.ApiKeyConfig{Key: "k"}},
+			"hash": {KeyHash: "md5$abc"},
+		},
+		OIDCProviders: map[string]OIDCConfig{"partner": {ClientID: "hugr"}},
+		Basic:         map[string]BasicConfig{"bi": {File: filepath.Join(t.TempDir(), "missing")}},
+		LDAP:          map[string]LDAPConfig{"corp": {URL: "ldaps://ldap.example.com"}},
+	}
+	err := pc.Validate()
+	if err == nil {
+		t.Fatal("invalid config is accepted")
+	}
+	for _, want := range []string{
+		"api key hash: unsupported key hash format",
+		"oidc provider partner: issuer is required",
+		"basic bi: ",
+		"ldap corp: LDAP base_dn is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "api key ok") {
+		t.Errorf("valid api key is reported: %v", err)
+	}
+	if err := (&ProvidersConfig{}).Validate(); err != nil {
+		t.Errorf("empty config: %v", err)
+	}
+}
+
+func TestConfigSchema_Published(t *testing.T) {
+	for format, file := range map[string]string{
+		"json": "auth-config.schema.json",
+		"yaml": "auth-config.yaml.schema.json",
+	} {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ConfigSchema(format)); err != nil {
+			t.Fatal(err)
+		}
+		published, err := os.ReadFile(filepath.Join("..", "..", "schemas", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), published) {
+			t.Errorf("schemas/%s is outdated, regenerate it by: server auth schema %s > schemas/%s", file, format, file)
+		}
+	}
+
+	props := ConfigSchema("yaml")["properties"].(map[string]any)
+	if _, ok := props["api-keys"]; !ok {
+		t.Error("yaml schema has no api-keys")
+	}
+	keys := props["api-keys"].(map[string]any)["additionalProperties"].(map[string]any)["properties"].(map[string]any)
+	if _, ok := keys["key-hash"]; !ok {
+		t.Errorf("inline api key fields are not promoted: %v", keys)
+	}
+	if _, ok := ConfigSchema("json")["properties"].(map[string]any)["api_keys"]; !ok {
+		t.Error("json schema has no api_keys")
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"reflect"
+	"time"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// ConfigSchema returns the JSON Schema of the auth providers config file, the format (json or yaml)
+// selects the field names, as they differ in the YAML and JSON files. The schema rejects the unknown fields.
+func ConfigSchema(format string) map[string]any {
+	tag := "yaml"
+	if format == "json" {
+		tag = "json"
+	}
+	s := configTypeSchema(reflect.TypeFor[ProvidersConfig](), tag)
+	s["$schema"] = jsonSchemaDraft
+	s["title"] = "Hugr auth providers config (" + tag + ")"
+	return s
+}
+
+func configTypeSchema(t reflect.Type, tag string) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeFor[time.Duration]() {
+		if tag == "yaml" {
+			return map[string]any{
+				"type":        []string{"string", "integer"},
+				"description": "Duration (e.g. 30s, 5m, 1h) or nanoseconds",
+			}
+		}
+		return map[string]any{"type": "integer", "description": "Duration in nanoseconds"}
+	}
+	if decodesItself(t) {
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": configTypeSchema(t.Elem(), tag)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": configTypeSchema(t.Elem(), tag)}
+	case reflect.Struct:
+		props := make(map[string]any)
+		for _, f := range configFields(t, tag) {
+			props[f.name] = configTypeSchema(f.typ, tag)
+		}
+		return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	// interfaces (e.g. the claim values) accept any value
+	return map[string]any{}
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// The kinds of the denylist entries.
+const (
+	DenyJTI     = "jti"
+	DenySubject = "subject"
+	DenySession = "session"
+)
+
+const defaultDenylistRefreshInterval = 30 * time.Second
+
+// DenylistConfig configures the token denylist, the entries are stored in the CoreDB
+// and are reloaded by every node periodically.
+type DenylistConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// RefreshInterval is the interval to reload the denylist from the CoreDB (default 30s)
+	RefreshInterval time.Duration `json:"refresh_interval" yaml:"refresh_interval"`
+	// AdminRoles are the roles allowed to manage the denylist (default admin)
+	AdminRoles []string `json:"admin_roles" yaml:"admin_roles"`
+}
+
+// Interval returns the denylist refresh interval.
+func (c DenylistConfig) Interval() time.Duration {
+	if c.RefreshInterval <= 0 {
+		return defaultDenylistRefreshInterval
+	}
+	return c.RefreshInterval
+}
+
+// IsAdmin returns true if the role is allowed to manage the denylist.
+func (c DenylistConfig) IsAdmin(role string) bool {
+	if len(c.AdminRoles) == 0 {
+		return role == "admin"
+	}
+	return slices.Contains(c.AdminRoles, role)
+}
+
+// DenylistEntry is the revoked token id (jti), subject or session.
+type DenylistEntry struct {
+	Kind      string
+	Value     string
+	Reason    string
+	CreatedBy string
+	CreatedAt time.Time
+	// ExpiresAt is the time when the entry is removed, zero means never
+	ExpiresAt time.Time
+}
+
+func (e DenylistEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// ValidDenyKind checks the kind of the denylist entry.
+func ValidDenyKind(kind string) error {
+	switch kind {
+	case DenyJTI, DenySubject, DenySession:
+		return nil
+	}
+	return fmt.Errorf("unknown denylist kind %q, expected %s, %s or %s", kind, DenyJTI, DenySubject, DenySession)
+}
+
+type denyKey struct {
+	kind  string
+	value string
+}
+
+// Denylist is the in-memory copy of the token denylist checked by the auth providers.
+type Denylist struct {
+	Config DenylistConfig
+
+	mu      sync.RWMutex
+	entries map[denyKey]DenylistEntry
+}
+
+func NewDenylist(c DenylistConfig) *Denylist {
+	return &Denylist{
+		Config:  c,
+		entries: make(map[denyKey]DenylistEntry),
+	}
+}
+
+// Set replaces the denylist entries (e.g. reloaded from the CoreDB).
+func (d *Denylist) Set(entries []DenylistEntry) {
+	m := make(map[denyKey]DenylistEntry, len(entries))
+	for _, e := range entries {
+		m[denyKey{e.Kind, e.Value}] = e
+	}
+	d.mu.Lock()
+	d.entries = m
+	d.mu.Unlock()
+}
+
+// Add adds or replaces the entry.
+func (d *Denylist) Add(e DenylistEntry) {
+	d.mu.Lock()
+	d.entries[denyKey{e.Kind, e.Value}] = e
+	d.mu.Unlock()
+}
+
+// Remove removes the entry.
+func (d *Denylist) Remove(kind, value string) {
+	d.mu.Lock()
+	delete(d.entries, denyKey{kind, value})
+	d.mu.Unlock()
+}
+
+// Entries returns the active entries ordered by the creation time.
+func (d *Denylist) Entries() []DenylistEntry {
+	now := time.Now()
+	d.mu.RLock()
+	entries := make([]DenylistEntry, 0, len(d.entries))
+	for _, e := range d.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	d.mu.RUnlock()
+	slices.SortFunc(entries, func(a, b DenylistEntry) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return entries
+}
+
+func (d *Denylist) denied(kind, value string, now time.Time) (DenylistEntry, bool) {
+	if value == "" {
+		return DenylistEntry{}, false
+	}
+	e, ok := d.entries[denyKey{kind, value}]
+	if !ok || e.expired(now) {
+		return DenylistEntry{}, false
+	}
+	return e, true
+}
+
+// Check returns the matched entry if the token id, the subject or the session of the request is denied.
+// The subject is matched with the user id and the sub claim, the session with the sid and session_state claims.
+func (d *Denylist) Check(info *auth.AuthInfo) (DenylistEntry, bool) {
+	if info == nil {
+		return DenylistEntry{}, false
+	}
+	claim := func(name string) string {
+		s, _ := info.Claims[name].(string)
+		return s
+	}
+	now := time.Now()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.entries) == 0 {
+		return DenylistEntry{}, false
+	}
+	for _, c := range []struct{ kind, value string }{
+		{DenyJTI, claim("jti")},
+		{DenySubject, info.UserId},
+		{DenySubject, claim("sub")},
+		{DenySession, claim("sid")},
+		{DenySession, claim("session_state")},
+	} {
+		if e, ok := d.denied(c.kind, c.value, now); ok {
+			return e, true
+		}
+	}
+	return DenylistEntry{}, false
+}
+
+// denylistProvider checks the requests authenticated by the wrapped provider against the denylist,
+// the check is done on every request, so the tokens cached by the provider are denied as well.
+type denylistProvider struct {
+	auth.AuthProvider
+	denylist *Denylist
+}
+
+func (p *denylistProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	info, err := p.AuthProvider.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := p.denylist.Check(info); ok {
+		log.Printf("Auth: %s: request denied: %s %q is in the denylist", p.Name(), e.Kind, e.Value)
+		return nil, auth.ErrForbidden
+	}
+	return info, nil
+}
+
+// Unwrap returns the wrapped provider.
+func (p *denylistProvider) Unwrap() auth.AuthProvider {
+	return p.AuthProvider
+}
+
+// unwrapProvider returns the provider wrapped by the lockout, denylist, impersonation and audit checks.
+func unwrapProvider(p auth.AuthProvider) auth.AuthProvider {
+	for {
+		w, ok := p.(interface{ Unwrap() auth.AuthProvider })
+		if !ok {
+			return p
+		}
+		p = w.Unwrap()
+	}
+}
+
+// findWrapper returns the first wrapper of the type in the providers.
+func findWrapper[T auth.AuthProvider](providers []auth.AuthProvider) (T, bool) {
+	for _, p := range providers {
+		for {
+			if w, ok := p.(T); ok {
+				return w, true
+			}
+			w, ok := p.(interface{ Unwrap() auth.AuthProvider })
+			if !ok {
+				break
+			}
+			p = w.Unwrap()
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// ConfiguredDenylist returns the denylist checked by the auth providers, nil if it is disabled.
+func ConfiguredDenylist(c *auth.Config) *Denylist {
+	if c == nil {
+		return nil
+	}
+	if dp, ok := findWrapper[*denylistProvider](c.Providers); ok {
+		return dp.denylist
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestDenylist_Check(t *testing.T) {
+	dl := NewDenylist(DenylistConfig{Enabled: true})
+	dl.Set([]DenylistEntry{
+		{Kind: DenyJTI, Value: "token-1"},
+		{Kind: DenySubject, Value: "bob"},
+		{Kind: DenySession, Value: "sess-1"},
+		{Kind: DenySubject, Value: "expired", ExpiresAt: time.Now().Add(-time.Minute)},
+	})
+
+	tests := []struct {
+		name   string
+		info   *auth.AuthInfo
+		denied bool
+	}{
+		{"nil", nil, false},
+		{"allowed", &auth.AuthInfo{UserId: "alice", Claims: map[string]any{"jti": "token-2", "sid": "sess-2"}}, false},
+		{"jti", &auth.AuthInfo{UserId: "alice", Claims: map[string]any{"jti": "token-1"}}, true},
+		{"user id", &auth.AuthInfo{UserId: "bob"}, true},
+		{"sub claim", &auth.AuthInfo{UserId: "bob@example.com", Claims: map[string]any{"sub": "bob"}}, true},
+		{"sid", &auth.AuthInfo{UserId: "alice", Claims: map[string]any{"sid": "sess-1"}}, true},
+		{"session_state", &auth.AuthInfo{UserId: "alice", Claims: map[string]any{"session_state": "sess-1"}}, true},
+		{"expired entry", &auth.AuthInfo{UserId: "expired"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, denied := dl.Check(tt.info)
+			if denied != tt.denied {
+				t.Errorf("denied = %v, want %v", denied, tt.denied)
+			}
+		})
+	}
+
+	if n := len(dl.Entries()); n != 3 {
+		t.Errorf("entries = %d, want 3 (expired are skipped)", n)
+	}
+	dl.Remove(DenySubject, "bob")
+	if _, denied := dl.Check(&auth.AuthInfo{UserId: "bob"}); denied {
+		t.Error("removed subject is still denied")
+	}
+}
+
+func TestConfigure_Denylist(t *testing.T) {
+	c := &Config{
+		SecretKey:        "secret",
+		AllowedAnonymous: true,
+		AnonymousRole:    "public",
+		Denylist:         DenylistConfig{Enabled: true},
+	}
+	ac, err := c.Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := ConfiguredDenylist(ac)
+	if dl == nil {
+		t.Fatal("denylist is not configured")
+	}
+	if _, ok := ac.Providers[len(ac.Providers)-1].(*auth.AnonymousProvider); !ok {
+		t.Errorf("anonymous provider must not be wrapped, got %T", ac.Providers[len(ac.Providers)-1])
+	}
+
+	mw := auth.AuthMiddleware(*ac)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		r.Header.Set("x-hugr-secret-key", "secret")
+		r.Header.Set("x-hugr-user-id", "bob")
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	dl.Add(DenylistEntry{Kind: DenySubject, Value: "bob"})
+	if code := request(); code != http.StatusUnauthorized {
+		t.Errorf("denied status = %d, want 401", code)
+	}
+
+	ac, err = (&Config{SecretKey: "secret"}).Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ConfiguredDenylist(ac) != nil {
+		t.Error("denylist must be disabled by default")
+	}
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hugr-lab/hugr/pkg/auth/discovery"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// ErrProviderUnavailable is returned by the providers that can't authenticate the requests
+// until their IdP becomes available (e.g. the OIDC discovery hasn't succeeded yet).
+var ErrProviderUnavailable = discovery.ErrProviderUnavailable
+
+// CheckProviders returns an error if any of the auth providers is unavailable,
+// intended for the readiness probe.
+func CheckProviders(c *auth.Config) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if c == nil {
+			return nil
+		}
+		var errs []error
+		for _, p := range c.Providers {
+			if rp, ok := unwrapProvider(p).(interface{ Ready() error }); ok {
+				errs = append(errs, rp.Ready())
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,38 @@
+// Package discovery contains the helpers of the auth providers and the OAuth proxy
+// that depend on the IdP discovery.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrProviderUnavailable is returned by the providers that can't authenticate the requests
+// until their IdP becomes available (e.g. the OIDC discovery hasn't succeeded yet).
+var ErrProviderUnavailable = errors.New("auth provider unavailable")
+
+const (
+	retryMin = time.Second
+	retryMax = time.Minute
+)
+
+// Retry calls the discovery with the exponential backoff until it succeeds or the context is done.
+func Retry(ctx context.Context, name string, discover func(ctx context.Context) error) {
+	delay := retryMin
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := discover(ctx)
+		if err == nil {
+			log.Printf("Auth: %s: discovery succeeded", name)
+			return
+		}
+		delay = min(delay*2, retryMax)
+		log.Printf("Auth: %s: discovery failed: %v, retry in %s", name, err, delay)
+	}
+}
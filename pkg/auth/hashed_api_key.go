@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// hashedAPIKeyCacheTTL is the time the keys verified by the slow (bcrypt, argon2) hash are cached.
+const hashedAPIKeyCacheTTL = 5 * time.Minute
+
+// APIKeyConfig is the static API key of the config file. The key can be set by its hash (key_hash)
+// instead of the raw value, so the config file doesn't contain the key itself.
+type APIKeyConfig struct {
+	auth.ApiKeyConfig `yaml:",inline"`
+	// KeyHash is the salted SHA-256 (sha256$<salt>$<hex>), bcrypt or argon2 (PHC format) hash of the key.
+	KeyHash string `json:"key_hash" yaml:"key-hash"`
+}
+
+// provider returns the engine API key provider for the raw key or the hashed key provider.
+func (c APIKeyConfig) provider(name string) (auth.AuthProvider, error) {
+	if c.KeyHash == "" {
+		return auth.NewApiKey(name, c.ApiKeyConfig), nil
+	}
+	if c.Key != "" {
+		return nil, errors.New("either key or key hash should be set")
+	}
+	return NewHashedAPIKeyProvider(name, c.KeyHash, c.ApiKeyConfig)
+}
+
+// supportedKeyHash returns true if the value is the supported API key hash.
+func supportedKeyHash(hash string) bool {
+	return IsHashedAPIKey(hash) || supportedHash(hash)
+}
+
+// HashedAPIKeyProvider authenticates the requests by the static API key that is set by its hash,
+// the user identity is read from the headers as by the engine API key provider.
+type HashedAPIKeyProvider struct {
+	name string
+	hash string
+	c    auth.ApiKeyConfig
+
+	// cache is set for the slow hashes only
+	cache *tokenCache[bool]
+}
+
+func NewHashedAPIKeyProvider(name, hash string, c auth.ApiKeyConfig) (*HashedAPIKeyProvider, error) {
+	if !supportedKeyHash(hash) {
+		return nil, errors.New("unsupported key hash format")
+	}
+	if c.Header == "" {
+		c.Header = "x-hugr-api-key"
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = "admin"
+	}
+	if c.Headers.Role == "" {
+		c.Headers.Role = "x-hugr-role"
+	}
+	if c.Headers.UserId == "" {
+		c.Headers.UserId = "x-hugr-user-id"
+	}
+	if c.Headers.UserName == "" {
+		c.Headers.UserName = "x-hugr-user-name"
+	}
+	p := &HashedAPIKeyProvider{
+		name: name,
+		hash: hash,
+		c:    c,
+	}
+	if !IsHashedAPIKey(hash) {
+		p.cache = newTokenCache[bool](name, 100, hashedAPIKeyCacheTTL)
+	}
+	return p, nil
+}
+
+func (p *HashedAPIKeyProvider) Name() string {
+	return p.name
+}
+
+func (p *HashedAPIKeyProvider) Type() string {
+	return "apiKey"
+}
+
+func (p *HashedAPIKeyProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	key := r.Header.Get(p.c.Header)
+	if key == "" {
+		return nil, auth.ErrSkipAuth
+	}
+	if !p.verify(key) {
+		// the key can match the next provider with the same header
+		return nil, auth.ErrInvalidKeyType
+	}
+
+	role := r.Header.Get(p.c.Headers.Role)
+	if role == "" {
+		role = p.c.DefaultRole
+	}
+	userId := r.Header.Get(p.c.Headers.UserId)
+	if userId == "" {
+		userId = "api"
+	}
+	userName := r.Header.Get(p.c.Headers.UserName)
+	if userName == "" {
+		userName = "api"
+	}
+	return &auth.AuthInfo{
+		Role:         role,
+		UserId:       userId,
+		UserName:     userName,
+		AuthType:     "apiKey",
+		AuthProvider: p.name,
+	}, nil
+}
+
+func (p *HashedAPIKeyProvider) verify(key string) bool {
+	if p.cache == nil {
+		return VerifyAPIKey(p.hash, key)
+	}
+	ck := sha256.Sum256([]byte(key))
+	if _, ok := p.cache.get(ck); ok {
+		return true
+	}
+	if !verifyPassword(p.hash, key) {
+		return false
+	}
+	p.cache.add(ck, true, time.Time{})
+	return true
+}
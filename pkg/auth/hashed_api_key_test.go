@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestHashedAPIKeyProvider(t *testing.T) {
+	sha, err := HashAPIKey("etl-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, hash := range map[string]string{
+		"sha256": sha,
+		"bcrypt": bcryptHash(t, "etl-key"),
+		"argon2": argon2TestHash("etl-key"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, err := APIKeyConfig{
+				ApiKeyConfig: auth.ApiKeyConfig{Header: "x-etl-key", DefaultRole: "loader"},
+				KeyHash:      hash,
+			}.provider("etl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			authenticate := func(key string, headers map[string]string) (*auth.AuthInfo, error) {
+				r := httptest.NewRequest(http.MethodGet, "/query", nil)
+				if key != "" {
+					r.Header.Set("x-etl-key", key)
+				}
+				for k, v := range headers {
+					r.Header.Set(k, v)
+				}
+				return p.Authenticate(r)
+			}
+			if _, err := authenticate("", nil); !errors.Is(err, auth.ErrSkipAuth) {
+				t.Errorf("no key: err = %v, want ErrSkipAuth", err)
+			}
+			if _, err := authenticate("wrong-key", nil); !errors.Is(err, auth.ErrInvalidKeyType) {
+				t.Errorf("wrong key: err = %v, want ErrInvalidKeyType", err)
+			}
+			for range 2 { // the second check of the slow hashes is served from the cache
+				info, err := authenticate("etl-key", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Role != "loader" || info.UserId != "api" || info.UserName != "api" || info.AuthProvider != "etl" {
+					t.Errorf("unexpected auth info: %+v", info)
+				}
+			}
+			info, err := authenticate("etl-key", map[string]string{"x-hugr-role": "reader", "x-hugr-user-id": "job-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Role != "reader" || info.UserId != "job-1" {
+				t.Errorf("identity headers are ignored: %+v", info)
+			}
+		})
+	}
+
+	if _, err := (APIKeyConfig{KeyHash: "plain-value"}).provider("x"); err == nil {
+		t.Error("unsupported hash must be rejected")
+	}
+	if _, err := (APIKeyConfig{ApiKeyConfig: auth.ApiKeyConfig{Key: "k"}, KeyHash: sha}).provider("x"); err == nil {
+		t.Error("both key and hash must be rejected")
+	}
+	if p, err := (APIKeyConfig{ApiKeyConfig: auth.ApiKeyConfig{Key: "k"}}).provider("x"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := p.(*auth.ApiKeyProvider); !ok {
+		t.Errorf("raw key provider = %T, want the engine API key provider", p)
+	}
+}
+
+func TestConfig_SecretKeyHash(t *testing.T) {
+	hash, err := HashAPIKey("admin-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{SecretKey: "oauth-state-key", SecretKeyHash: hash}
+	ac, err := c.Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+	r.Header.Set("x-hugr-secret-key", "admin-secret")
+	info, err := ac.Providers[0].Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Role != "admin" || info.AuthProvider != "x-hugr-secret" {
+		t.Errorf("unexpected auth info: %+v", info)
+	}
+	r.Header.Set("x-hugr-secret-key", "oauth-state-key")
+	if _, err := ac.Providers[0].Authenticate(r); err == nil {
+		t.Error("raw secret key must not be accepted if the hash is set")
+	}
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// The impersonation headers, applied by the engine after the authentication.
+const (
+	impersonatedRoleHeader     = "x-hugr-impersonated-role"
+	impersonatedUserIDHeader   = "x-hugr-impersonated-user-id"
+	impersonatedUserNameHeader = "x-hugr-impersonated-user-name"
+)
+
+// ImpersonationConfig limits the impersonation: the x-hugr-impersonated-* headers and the identity
+// overrides of the secret key (x-hugr-role, x-hugr-user-id and x-hugr-user-name headers).
+// The role of the original identity should have can_impersonate set in the CoreDB roles as well.
+type ImpersonationConfig struct {
+	// Disabled rejects the requests with the impersonation headers
+	Disabled bool `json:"disabled" yaml:"disabled"`
+	// Targets are the roles each role can impersonate, "*" - any role.
+	// If it is set, the roles that are not listed can't impersonate.
+	Targets map[string][]string `json:"targets" yaml:"targets"`
+}
+
+// Allowed returns true if the role can impersonate the target role.
+func (c ImpersonationConfig) Allowed(role, target string) bool {
+	if c.Disabled {
+		return false
+	}
+	if len(c.Targets) == 0 {
+		return true
+	}
+	targets := c.Targets[role]
+	return slices.Contains(targets, "*") || slices.Contains(targets, target)
+}
+
+// impersonationProvider applies the impersonation to the identity of the wrapped provider,
+// the impersonated identity keeps the original one in ImpersonatedBy, so the engine doesn't apply
+// the impersonation headers again.
+type impersonationProvider struct {
+	auth.AuthProvider
+	c ImpersonationConfig
+	// secret is the identity of the secret key that is overridden by the x-hugr-role,
+	// x-hugr-user-id and x-hugr-user-name headers, nil for the other providers
+	secret *auth.AuthInfo
+	last   bool
+}
+
+func (p *impersonationProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	info, err := p.AuthProvider.Authenticate(r)
+	if err == nil && info != nil {
+		return p.impersonate(r, info)
+	}
+	if p.last && errors.Is(err, auth.ErrSkipAuth) && r.Header.Get(impersonatedRoleHeader) != "" {
+		// the anonymous access can't be impersonated, the engine applies the headers to it otherwise
+		return nil, auth.ErrNeedAuth
+	}
+	return info, err
+}
+
+func (p *impersonationProvider) impersonate(r *http.Request, info *auth.AuthInfo) (*auth.AuthInfo, error) {
+	original, target := info, (*auth.AuthInfo)(nil)
+	if p.secret != nil && (r.Header.Get("x-hugr-role") != "" || r.Header.Get("x-hugr-user-id") != "" || r.Header.Get("x-hugr-user-name") != "") {
+		original = &auth.AuthInfo{
+			Role:         p.secret.Role,
+			UserId:       p.secret.UserId,
+			UserName:     p.secret.UserName,
+			AuthType:     info.AuthType,
+			AuthProvider: info.AuthProvider,
+		}
+		target = auth.BuildImpersonatedAuthInfo(original, info.UserId, info.UserName, info.Role)
+	}
+	if role := r.Header.Get(impersonatedRoleHeader); role != "" {
+		if target != nil || info.ImpersonatedBy != nil {
+			log.Printf("Auth: %s: nested impersonation of role %q is rejected", p.Name(), role)
+			return nil, auth.ErrForbidden
+		}
+		target = auth.BuildImpersonatedAuthInfo(info,
+			r.Header.Get(impersonatedUserIDHeader), r.Header.Get(impersonatedUserNameHeader), role)
+	}
+	if target == nil {
+		return info, nil
+	}
+	if !p.c.Allowed(original.Role, target.Role) {
+		log.Printf("Auth: %s: user %q (role %q) is not allowed to impersonate role %q", p.Name(), original.UserId, original.Role, target.Role)
+		return nil, auth.ErrForbidden
+	}
+	log.Printf("Auth: %s: user %q (role %q) impersonates user %q (role %q)",
+		p.Name(), original.UserId, original.Role, target.UserId, target.Role)
+	return target, nil
+}
+
+// Unwrap returns the wrapped provider.
+func (p *impersonationProvider) Unwrap() auth.AuthProvider {
+	return p.AuthProvider
+}
+
+// anonymousProvider rejects the impersonation headers if the anonymous provider is the only one,
+// otherwise they are rejected by the impersonation provider of the last provider in the chain.
+// The engine evaluates the wrapped provider in the chain order, that is the same without the other providers.
+type anonymousProvider struct {
+	auth.AuthProvider
+}
+
+func (p *anonymousProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	if r.Header.Get(impersonatedRoleHeader) != "" {
+		return nil, auth.ErrNeedAuth
+	}
+	return p.AuthProvider.Authenticate(r)
+}
+
+// Unwrap returns the wrapped provider.
+func (p *anonymousProvider) Unwrap() auth.AuthProvider {
+	return p.AuthProvider
+}
+
+// configuredImpersonation returns the impersonation limits of the auth providers.
+func configuredImpersonation(c *auth.Config) (ImpersonationConfig, bool) {
+	if c == nil {
+		return ImpersonationConfig{}, false
+	}
+	ip, ok := findWrapper[*impersonationProvider](c.Providers)
+	if !ok {
+		return ImpersonationConfig{}, false
+	}
+	return ip.c, true
+}
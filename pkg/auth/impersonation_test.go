@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestImpersonationConfig_Allowed(t *testing.T) {
+	c := ImpersonationConfig{Targets: map[string][]string{
+		"admin":   {"*"},
+		"support": {"analyst", "readonly"},
+	}}
+	for _, tt := range []struct {
+		role, target string
+		want         bool
+	}{
+		{"admin", "anything", true},
+		{"support", "analyst", true},
+		{"support", "admin", false},
+		{"analyst", "readonly", false},
+	} {
+		if got := c.Allowed(tt.role, tt.target); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %t, want %t", tt.role, tt.target, got, tt.want)
+		}
+	}
+	if !(ImpersonationConfig{}).Allowed("analyst", "admin") {
+		t.Error("no targets must not limit the impersonation")
+	}
+	if (ImpersonationConfig{Disabled: true}).Allowed("admin", "admin") {
+		t.Error("disabled impersonation must not be allowed")
+	}
+}
+
+func TestImpersonation_Chain(t *testing.T) {
+	hash, err := HashAPIKey("etl-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "auth.yaml")
+	err = os.WriteFile(file, []byte(`api-keys:
+  etl:
+    key-hash: `+hash+`
+    default-role: loader
+impersonation:
+  targets:
+    admin: [analyst]
+    loader: [readonly]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configure := func(c *Config) (http.Handler, *memoryAuditSink, **auth.AuthInfo) {
+		t.Helper()
+		ac, err := c.Configure(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink := &memoryAuditSink{}
+		ConfiguredAuditor(ac).SetSink(sink)
+		var got *auth.AuthInfo
+		handler := auth.AuthMiddleware(*ac)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = auth.AuthInfoFromContext(r.Context())
+		}))
+		return handler, sink, &got
+	}
+	request := func(handler http.Handler, headers map[string]string) int {
+		r := httptest.NewRequest(http.MethodPost, "/query", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	handler, sink, got := configure(&Config{
+		ConfigFile:       file,
+		SecretKey:        "admin-secret",
+		AllowedAnonymous: true,
+		AnonymousRole:    "public",
+		Audit:            AuditConfig{Enabled: true, FlushInterval: 10 * time.Millisecond},
+	})
+
+	// the secret key without the overrides isn't impersonated
+	if code := request(handler, map[string]string{"x-hugr-secret-key": "admin-secret"}); code != http.StatusOK {
+		t.Fatalf("secret key: status = %d", code)
+	}
+	if info := *got; info.Role != "admin" || info.ImpersonatedBy != nil {
+		t.Errorf("secret key identity = %+v", info)
+	}
+
+	// the overrides of the secret key are recorded as the impersonation
+	code := request(handler, map[string]string{"x-hugr-secret-key": "admin-secret", "x-hugr-role": "analyst", "x-hugr-user-id": "bob"})
+	if code != http.StatusOK {
+		t.Fatalf("secret key overrides: status = %d", code)
+	}
+	if info := *got; info.Role != "analyst" || info.UserId != "bob" || info.ImpersonatedBy == nil ||
+		info.ImpersonatedBy.Role != "admin" || info.ImpersonatedBy.UserId != "api" {
+		t.Errorf("secret key overrides identity = %+v, by %+v", info, info.ImpersonatedBy)
+	}
+
+	// the impersonation headers are limited by the targets of the original role
+	code = request(handler, map[string]string{"x-hugr-api-key": "etl-key",
+		"x-hugr-impersonated-role": "readonly", "x-hugr-impersonated-user-id": "carol"})
+	if code != http.StatusOK {
+		t.Fatalf("impersonation headers: status = %d", code)
+	}
+	if info := *got; info.Role != "readonly" || info.UserId != "carol" || info.ImpersonatedBy == nil || info.ImpersonatedBy.Role != "loader" {
+		t.Errorf("impersonated identity = %+v, by %+v", info, info.ImpersonatedBy)
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"secret key target": {"x-hugr-secret-key": "admin-secret", "x-hugr-role": "public"},
+		"api key target":    {"x-hugr-api-key": "etl-key", "x-hugr-impersonated-role": "analyst"},
+		"nested":            {"x-hugr-secret-key": "admin-secret", "x-hugr-role": "analyst", "x-hugr-impersonated-role": "analyst"},
+		"anonymous":         {"x-hugr-impersonated-role": "public"},
+	} {
+		if code := request(handler, headers); code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", name, code)
+		}
+	}
+
+	events := sink.wait(t, 7)
+	if e := events[1]; e.UserID != "bob" || e.Role != "analyst" || e.RealUserID != "api" || e.RealRole != "admin" {
+		t.Errorf("impersonation audit event = %+v", e)
+	}
+	if e := events[0]; e.RealUserID != "" || e.RealRole != "" {
+		t.Errorf("audit event without impersonation = %+v", e)
+	}
+
+	// the impersonation can be turned off
+	handler, _, _ = configure(&Config{
+		ConfigFile:    file,
+		SecretKey:     "admin-secret",
+		Impersonation: ImpersonationConfig{Disabled: true},
+		Audit:         AuditConfig{Enabled: true},
+	})
+	if code := request(handler, map[string]string{"x-hugr-secret-key": "admin-secret"}); code != http.StatusOK {
+		t.Errorf("disabled impersonation: secret key status = %d", code)
+	}
+	for _, headers := range []map[string]string{
+		{"x-hugr-secret-key": "admin-secret", "x-hugr-user-id": "bob"},
+		{"x-hugr-api-key": "etl-key", "x-hugr-impersonated-role": "readonly"},
+	} {
+		if code := request(handler, headers); code != http.StatusUnauthorized {
+			t.Errorf("disabled impersonation %v: status = %d, want 401", headers, code)
+		}
+	}
+}
+
+func TestImpersonation_AnonymousOnly(t *testing.T) {
+	ac, err := (&Config{AllowedAnonymous: true, AnonymousRole: "public"}).Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *auth.AuthInfo
+	handler := auth.AuthMiddleware(*ac)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.AuthInfoFromContext(r.Context())
+	}))
+	request := func(headers map[string]string) int {
+		r := httptest.NewRequest(http.MethodPost, "/query", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := request(nil); code != http.StatusOK || got == nil || got.Role != "public" {
+		t.Fatalf("anonymous: status = %d, identity = %+v", code, got)
+	}
+	if code := request(map[string]string{"x-hugr-impersonated-role": "admin"}); code != http.StatusUnauthorized {
+		t.Errorf("anonymous impersonation: status = %d, want 401", code)
+	}
+}
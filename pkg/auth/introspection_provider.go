@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/golang-jwt/jwt/v5/request"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// IntrospectionConfig is the configuration of the provider that validates the opaque access tokens
+// by the OAuth 2.0 token introspection endpoint (RFC 7662).
+type IntrospectionConfig struct {
+	// Endpoint is the token introspection endpoint URL.
+	Endpoint     string        `json:"endpoint" yaml:"endpoint"`
+	ClientID     string        `json:"client_id" yaml:"client_id"`
+	ClientSecret string        `json:"-" yaml:"client_secret"`
+	Timeout      time.Duration `json:"timeout" yaml:"timeout"`
+	TLSInsecure  bool          `json:"tls_insecure" yaml:"tls_insecure"`
+	CookieName   string        `json:"cookie_name" yaml:"cookie_name"`
+
+	// ScopeRolePrefix is the prefix of the role in the scope field (space separated list).
+	ScopeRolePrefix string `json:"scope_role_prefix" yaml:"scope_role_prefix"`
+	// Claims maps the introspection response fields to the role, user id and user name.
+	Claims OIDCClaims `json:"claims" yaml:"claims"`
+	// DefaultRole is assigned if the role is not found in the response.
+	DefaultRole string `json:"default_role" yaml:"default_role"`
+	// CacheTTL limits the time the active token is cached, the token is cached until its expiration (exp) by default.
+	CacheTTL time.Duration `json:"cache_ttl" yaml:"cache_ttl"`
+	// NegativeCacheTTL is the time the inactive (unknown, expired or revoked) token is cached,
+	// default 30s, a negative value disables the cache.
+	NegativeCacheTTL time.Duration `json:"negative_cache_ttl" yaml:"negative_cache_ttl"`
+}
+
+// IntrospectionProvider authenticates the requests by the opaque access tokens,
+// the tokens are validated by the introspection endpoint and the active ones are cached until their expiration,
+// the inactive ones are cached for a short time, so the unknown tokens don't hit the endpoint on every request.
+type IntrospectionProvider struct {
+	name      string
+	c         IntrospectionConfig
+	client    *http.Client
+	extractor request.Extractor
+
+	mu        sync.Mutex
+	cache     map[[sha256.Size]byte]introspectionEntry
+	lastSweep time.Time
+}
+
+type introspectionEntry struct {
+	info     auth.AuthInfo
+	inactive bool
+	expires  time.Time
+}
+
+const (
+	introspectionCacheSweepInterval = time.Minute
+	defaultIntrospectionNegativeTTL = 30 * time.Second
+	// maxIntrospectionCacheSize limits the cache, the new tokens (active and inactive) are not cached if it is full
+	maxIntrospectionCacheSize = 100000
+)
+
+func NewIntrospectionProvider(name string, c IntrospectionConfig) (*IntrospectionProvider, error) {
+	if c.Endpoint == "" {
+		return nil, errors.New("introspection endpoint is required")
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid introspection endpoint: %w", err)
+	}
+	if c.Claims.Role == "" {
+		c.Claims.Role = "x-hugr-role"
+	}
+	if c.NegativeCacheTTL == 0 {
+		c.NegativeCacheTTL = defaultIntrospectionNegativeTTL
+	}
+	if c.Claims.UserId == "" {
+		c.Claims.UserId = "sub"
+	}
+	if c.Claims.UserName == "" {
+		c.Claims.UserName = "username"
+	}
+	var extractor request.Extractor = request.OAuth2Extractor
+	if c.CookieName != "" {
+		extractor = &request.MultiExtractor{
+			request.OAuth2Extractor,
+			auth.CookieExtractor(c.CookieName),
+		}
+	}
+	client := &http.Client{
+		Timeout: c.Timeout,
+	}
+	if c.TLSInsecure {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	return &IntrospectionProvider{
+		name:      name,
+		c:         c,
+		client:    client,
+		extractor: extractor,
+		cache:     make(map[[sha256.Size]byte]introspectionEntry),
+	}, nil
+}
+
+func (p *IntrospectionProvider) Name() string {
+	return p.name
+}
+
+func (p *IntrospectionProvider) Type() string {
+	return "introspection"
+}
+
+func (p *IntrospectionProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	token, err := p.extractor.ExtractToken(r)
+	if errors.Is(err, request.ErrNoTokenInRequest) || (err == nil && token == "") {
+		return nil, auth.ErrSkipAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256([]byte(token))
+	if e, ok := p.cached(key); ok {
+		if e.inactive {
+			return nil, auth.ErrInvalidKeyType
+		}
+		info := e.info
+		return &info, nil
+	}
+
+	claims, err := p.introspect(r.Context(), token)
+	if err != nil {
+		// the endpoint details are logged only, the error is sent to the client
+		log.Printf("Auth: %s: token introspection error: %v", p.name, err)
+		return nil, ErrProviderUnavailable
+	}
+	if active, _ := claims["active"].(bool); !active {
+		// The token is unknown, expired or revoked,
+		// let the next provider try it (the token is never downgraded to the anonymous access).
+		p.storeInactive(key)
+		return nil, auth.ErrInvalidKeyType
+	}
+	delete(claims, "active")
+
+	role := claimString(claims, p.c.Claims.Role, p.c.ScopeRolePrefix)
+	if role == "" {
+		role = p.scopeRole(claims)
+	}
+	if role == "" {
+		role = p.c.DefaultRole
+	}
+	if role == "" {
+		return nil, auth.ErrForbidden
+	}
+
+	info := auth.AuthInfo{
+		Role:         role,
+		UserId:       claimString(claims, p.c.Claims.UserId, ""),
+		UserName:     claimString(claims, p.c.Claims.UserName, ""),
+		AuthType:     p.Type(),
+		AuthProvider: p.Name(),
+		Token:        token,
+		Claims:       auth.ScalarClaims(claims),
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		p.store(key, info, exp.Time)
+	}
+	return &info, nil
+}
+
+// scopeRole returns the first scope with the role prefix, the scope field is a space separated list (RFC 7662).
+func (p *IntrospectionProvider) scopeRole(claims jwt.MapClaims) string {
+	scope, _ := claims["scope"].(string)
+	for s := range strings.FieldsSeq(scope) {
+		if after, ok := strings.CutPrefix(s, p.c.ScopeRolePrefix); ok && after != "" {
+			return after
+		}
+	}
+	return ""
+}
+
+func (p *IntrospectionProvider) introspect(ctx context.Context, token string) (jwt.MapClaims, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.c.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.c.ClientID != "" {
+		// client credentials are form-urlencoded before the basic auth encoding (RFC 6749 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(p.c.ClientID), url.QueryEscape(p.c.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	claims := jwt.MapClaims{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return claims, nil
+}
+
+func (p *IntrospectionProvider) cached(key [sha256.Size]byte) (introspectionEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.cache[key]
+	if !ok {
+		return introspectionEntry{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(p.cache, key)
+		return introspectionEntry{}, false
+	}
+	return e, true
+}
+
+// storeInactive caches the inactive token for the negative cache TTL.
+func (p *IntrospectionProvider) storeInactive(key [sha256.Size]byte) {
+	if p.c.NegativeCacheTTL < 0 {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	if len(p.cache) >= maxIntrospectionCacheSize {
+		return
+	}
+	p.cache[key] = introspectionEntry{inactive: true, expires: now.Add(p.c.NegativeCacheTTL)}
+}
+
+// sweep removes the expired entries once per the sweep interval, the caller holds the lock.
+func (p *IntrospectionProvider) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) <= introspectionCacheSweepInterval {
+		return
+	}
+	for k, e := range p.cache {
+		if now.After(e.expires) {
+			delete(p.cache, k)
+		}
+	}
+	p.lastSweep = now
+}
+
+func (p *IntrospectionProvider) store(key [sha256.Size]byte, info auth.AuthInfo, expires time.Time) {
+	now := time.Now()
+	if p.c.CacheTTL > 0 && expires.After(now.Add(p.c.CacheTTL)) {
+		expires = now.Add(p.c.CacheTTL)
+	}
+	if !expires.After(now) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	if _, ok := p.cache[key]; !ok && len(p.cache) >= maxIntrospectionCacheSize {
+		return
+	}
+	p.cache[key] = introspectionEntry{info: info, expires: expires}
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// newIntrospectionIdP starts the stand-in IdP with the RFC 7662 introspection endpoint.
+func newIntrospectionIdP(t *testing.T, tokens map[string]map[string]any) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "hugr" || secret != "s3cret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.PostFormValue("token_type_hint") != "access_token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]any{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestIntrospectionProvider_Authenticate(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	srv, calls := newIntrospectionIdP(t, map[string]map[string]any{
+		"opaque-admin": {"active": true, "sub": "u1", "username": "alice", "scope": "openid hugr:admin", "exp": exp},
+		"opaque-role":  {"active": true, "sub": "u2", "username": "bob", "roles": []any{"app:analyst"}, "exp": exp},
+		"no-exp":       {"active": true, "sub": "u3", "username": "carol", "scope": "hugr:user"},
+		"no-role":      {"active": true, "sub": "u4", "exp": exp},
+	})
+	p, err := NewIntrospectionProvider("idp", IntrospectionConfig{
+		Endpoint:        srv.URL,
+		ClientID:        "hugr",
+		ClientSecret:    "s3cret",
+		ScopeRolePrefix: "hugr:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate := func(token string) (*auth.AuthInfo, error) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return p.Authenticate(req)
+	}
+
+	info, err := authenticate("opaque-admin")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if info.Role != "admin" || info.UserId != "u1" || info.UserName != "alice" || info.AuthProvider != "idp" || info.AuthType != "introspection" {
+		t.Fatalf("auth info = %+v", info)
+	}
+	// the active token is cached until exp
+	if _, err := authenticate("opaque-admin"); err != nil {
+		t.Fatalf("cached authenticate: %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("introspection calls = %d, want 1", n)
+	}
+
+	// the token without exp is not cached
+	for range 2 {
+		if info, err := authenticate("no-exp"); err != nil || info.UserName != "carol" {
+			t.Fatalf("no-exp: %+v, %v", info, err)
+		}
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("introspection calls = %d, want 3", n)
+	}
+
+	// the inactive token is cached for the negative cache TTL
+	for range 2 {
+		if _, err := authenticate("revoked"); !errors.Is(err, auth.ErrInvalidKeyType) {
+			t.Fatalf("inactive token err = %v, want ErrInvalidKeyType", err)
+		}
+	}
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("introspection calls = %d, want 4", n)
+	}
+	if _, err := authenticate("no-role"); !errors.Is(err, auth.ErrForbidden) {
+		t.Fatalf("no role err = %v, want ErrForbidden", err)
+	}
+	if _, err := authenticate(""); !errors.Is(err, auth.ErrSkipAuth) {
+		t.Fatalf("no token err = %v, want ErrSkipAuth", err)
+	}
+
+	p.c.Claims.Role = "roles"
+	p.c.ScopeRolePrefix = "app:"
+	if info, err := authenticate("opaque-role"); err != nil || info.Role != "analyst" {
+		t.Fatalf("role claim: %+v, %v", info, err)
+	}
+
+	// the endpoint errors are not sent to the client
+	p.c.ClientSecret = "wrong"
+	_, err = authenticate("opaque-unknown")
+	if !errors.Is(err, ErrProviderUnavailable) || strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), srv.URL) {
+		t.Fatalf("invalid client err = %v, want ErrProviderUnavailable", err)
+	}
+}
+
+func TestIntrospectionProvider_CacheTTL(t *testing.T) {
+	srv, calls := newIntrospectionIdP(t, map[string]map[string]any{
+		"opaque": {"active": true, "sub": "u1", "x-hugr-role": "user", "exp": time.Now().Add(time.Hour).Unix()},
+	})
+	p, err := NewIntrospectionProvider("idp", IntrospectionConfig{
+		Endpoint:     srv.URL,
+		ClientID:     "hugr",
+		ClientSecret: "s3cret",
+		CacheTTL:     time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer opaque")
+		if _, err := p.Authenticate(req); err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("introspection calls = %d, want 2", n)
+	}
+}
+
+func TestIntrospectionProvider_CacheSize(t *testing.T) {
+	p, err := NewIntrospectionProvider("idp", IntrospectionConfig{Endpoint: "http://idp.example.com/introspect"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	for i := range maxIntrospectionCacheSize + 10 {
+		p.store(sha256.Sum256([]byte(strconv.Itoa(i))), auth.AuthInfo{Role: "user"}, expires)
+	}
+	if n := len(p.cache); n != maxIntrospectionCacheSize {
+		t.Fatalf("cache size = %d, want %d", n, maxIntrospectionCacheSize)
+	}
+	// the cached token is updated when the cache is full
+	key := sha256.Sum256([]byte("0"))
+	p.store(key, auth.AuthInfo{Role: "admin"}, expires)
+	if e, ok := p.cached(key); !ok || e.info.Role != "admin" {
+		t.Fatalf("cached entry = %+v, %t", e, ok)
+	}
+}
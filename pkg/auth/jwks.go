@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+)
+
+const defaultJWKSRefreshInterval = 5 * time.Minute
+
+// jwksSigningAlgs are the signing algorithms accepted with the local key set.
+var jwksSigningAlgs = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+// localKeySet is the OIDC key set loaded from the local JWKS file or the inline JWKS,
+// it is used to verify the tokens without the OIDC discovery (air-gapped deployments).
+// The file is re-read periodically if it is changed, so the keys can be rotated.
+type localKeySet struct {
+	provider string
+	file     string
+	inline   string
+	// onChange is called after the keys are reloaded
+	onChange func()
+
+	mu      sync.RWMutex
+	keys    jose.JSONWebKeySet
+	modTime time.Time
+}
+
+func newLocalKeySet(provider string, c OIDCConfig) (*localKeySet, error) {
+	ks := &localKeySet{
+		provider: provider,
+		file:     c.JWKSFile,
+		inline:   c.JWKS,
+	}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// load reads and parses the key set.
+func (ks *localKeySet) load() error {
+	err := ks.read()
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	jwksRefreshes.WithLabelValues(ks.provider, result).Inc()
+	return err
+}
+
+func (ks *localKeySet) read() error {
+	data := []byte(ks.inline)
+	var modTime time.Time
+	if ks.file != "" {
+		fi, err := os.Stat(ks.file)
+		if err != nil {
+			return err
+		}
+		modTime = fi.ModTime()
+		data, err = os.ReadFile(ks.file)
+		if err != nil {
+			return err
+		}
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parse JWKS: %w", err)
+	}
+	if len(keys.Keys) == 0 {
+		return errors.New("JWKS doesn't contain keys")
+	}
+	for _, k := range keys.Keys {
+		if !k.IsPublic() {
+			return fmt.Errorf("JWKS key %q is not a public key", k.KeyID)
+		}
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.modTime = modTime
+	ks.mu.Unlock()
+	jwksKeys.WithLabelValues(ks.provider).Set(float64(len(keys.Keys)))
+	if ks.onChange != nil {
+		ks.onChange()
+	}
+	return nil
+}
+
+// reloadIfChanged re-reads the JWKS file if its modification time is changed.
+func (ks *localKeySet) reloadIfChanged() error {
+	if ks.file == "" {
+		return nil
+	}
+	fi, err := os.Stat(ks.file)
+	if err != nil {
+		return err
+	}
+	ks.mu.RLock()
+	changed := !fi.ModTime().Equal(ks.modTime)
+	ks.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return ks.load()
+}
+
+// run re-reads the JWKS file until the context is done, the previous keys are kept if the file is invalid.
+func (ks *localKeySet) run(ctx context.Context, interval time.Duration) {
+	if ks.file == "" {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultJWKSRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := ks.reloadIfChanged(); err != nil {
+			log.Printf("Auth: OIDC %s: JWKS reload error: %v", ks.provider, err)
+		}
+	}
+}
+
+// VerifySignature implements oidc.KeySet.
+func (ks *localKeySet) VerifySignature(ctx context.Context, token string) ([]byte, error) {
+	jws, err := jose.ParseSigned(token, jwksSigningAlgs)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %w", err)
+	}
+	if len(jws.Signatures) == 0 {
+		return nil, errors.New("jwt has no signature")
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	ks.mu.RLock()
+	keys := ks.keys.Keys
+	if kid != "" {
+		keys = ks.keys.Key(kid)
+	}
+	ks.mu.RUnlock()
+	if len(keys) == 0 {
+		jwksUnknownKid.WithLabelValues(ks.provider).Inc()
+		return nil, fmt.Errorf("unknown signing key id %q", kid)
+	}
+	for _, key := range keys {
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("failed to verify the signature")
+}
+
+// newLocalVerifier creates the token verifier with the local key set and the expected issuer.
+func newLocalVerifier(issuer string, ks *localKeySet) verifier {
+	algs := make([]string, len(jwksSigningAlgs))
+	for i, alg := range jwksSigningAlgs {
+		algs[i] = string(alg)
+	}
+	return oidc.NewVerifier(issuer, ks, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: algs,
+	})
+}
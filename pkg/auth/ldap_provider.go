@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+const (
+	defaultLDAPPoolSize       = 4
+	defaultLDAPCacheTTL       = time.Minute
+	defaultLDAPTimeout        = 5 * time.Second
+	defaultLDAPUserFilter     = "(|(uid={username})(sAMAccountName={username}))"
+	defaultLDAPGroupAttribute = "memberOf"
+)
+
+// LDAPConfig is the configuration of the provider that authenticates the HTTP Basic credentials
+// by binding to the LDAP server (e.g. Active Directory).
+// The user is searched by the service account (or anonymously) and the password is checked by the bind as the user.
+type LDAPConfig struct {
+	// URL is the LDAP server URL: ldap://host:389 or ldaps://host:636.
+	URL         string        `json:"url" yaml:"url"`
+	StartTLS    bool          `json:"start_tls" yaml:"start_tls"`
+	TLSInsecure bool          `json:"tls_insecure" yaml:"tls_insecure"`
+	Timeout     time.Duration `json:"timeout" yaml:"timeout"`
+	// TLSCAFile is the PEM file with the CA certificates to verify the server, the system roots if empty.
+	TLSCAFile string `json:"tls_ca_file" yaml:"tls_ca_file"`
+
+	// BindDN and BindPassword are the service account credentials to search the users, anonymous search if empty.
+	BindDN       string `json:"bind_dn" yaml:"bind_dn"`
+	BindPassword string `json:"-" yaml:"bind_password"`
+
+	// BaseDN is the base of the user search.
+	BaseDN string `json:"base_dn" yaml:"base_dn"`
+	// UserFilter is the user search filter, {username} is replaced by the escaped user name.
+	UserFilter string `json:"user_filter" yaml:"user_filter"`
+	// GroupAttribute is the user attribute with the group DNs (default memberOf).
+	GroupAttribute string `json:"group_attribute" yaml:"group_attribute"`
+	// GroupBaseDN and GroupFilter search the user groups additionally to the group attribute
+	// (e.g. groupOfNames in OpenLDAP: (member={dn})), {dn} and {username} are replaced by the escaped values.
+	GroupBaseDN string `json:"group_base_dn" yaml:"group_base_dn"`
+	GroupFilter string `json:"group_filter" yaml:"group_filter"`
+
+	// UserNameAttribute is the attribute with the user display name (default displayName).
+	UserNameAttribute string `json:"user_name_attribute" yaml:"user_name_attribute"`
+	// Attributes are the user attributes added to the claims (the first value).
+	Attributes []string `json:"attributes" yaml:"attributes"`
+
+	// RoleMapping maps the groups to the roles, the rule claims are groups (the group DNs) and group_names (the group CNs).
+	RoleMapping []RoleMappingRule `json:"role_mapping" yaml:"role_mapping"`
+	// DefaultRole is assigned if no mapping rule is matched, otherwise such users are rejected.
+	DefaultRole string `json:"default_role" yaml:"default_role"`
+	// RoleHeader is the request header to select one of the granted roles (default x-hugr-role).
+	RoleHeader string `json:"role_header" yaml:"role_header"`
+
+	// PoolSize is the number of the idle connections kept open (default 4).
+	PoolSize int `json:"pool_size" yaml:"pool_size"`
+	// CacheTTL is the time the successful binds are cached (default 1m), negative disables the cache.
+	CacheTTL time.Duration `json:"cache_ttl" yaml:"cache_ttl"`
+}
+
+// ldapUser is the authenticated LDAP user.
+type ldapUser struct {
+	dn     string
+	name   string
+	claims jwt.MapClaims
+	roles  []string
+}
+
+// LDAPProvider authenticates the requests by the HTTP Basic credentials binding to the LDAP server.
+type LDAPProvider struct {
+	name string
+	c    LDAPConfig
+	tls  *tls.Config
+
+	conns chan *ldap.Conn
+	cache *tokenCache[*ldapUser]
+}
+
+func NewLDAPProvider(name string, c LDAPConfig) (*LDAPProvider, error) {
+	if c.URL == "" {
+		return nil, errors.New("LDAP url is required")
+	}
+	if c.BaseDN == "" {
+		return nil, errors.New("LDAP base_dn is required")
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = defaultLDAPUserFilter
+	}
+	if !strings.Contains(c.UserFilter, "{username}") {
+		return nil, errors.New("LDAP user_filter should contain {username}")
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = defaultLDAPGroupAttribute
+	}
+	if c.GroupFilter != "" && c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.UserNameAttribute == "" {
+		c.UserNameAttribute = "displayName"
+	}
+	if c.RoleHeader == "" {
+		c.RoleHeader = "x-hugr-role"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultLDAPTimeout
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = defaultLDAPPoolSize
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = defaultLDAPCacheTTL
+	}
+	rules, err := sortRoleMapping(c.RoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	c.RoleMapping = rules
+
+	p := &LDAPProvider{
+		name:  name,
+		c:     c,
+		conns: make(chan *ldap.Conn, c.PoolSize),
+	}
+	if strings.HasPrefix(c.URL, "ldaps://") || c.StartTLS {
+		p.tls, err = c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.CacheTTL > 0 {
+		p.cache = newTokenCache[*ldapUser](name, 1000, c.CacheTTL)
+	}
+	return p, nil
+}
+
+// tlsConfig returns the TLS configuration to verify the server by the URL host name,
+// StartTLS doesn't set the server name from the dialed address.
+func (c LDAPConfig) tlsConfig() (*tls.Config, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP url: %w", err)
+	}
+	tc := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: c.TLSInsecure,
+	}
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP tls_ca_file: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("LDAP tls_ca_file: no certificates in %s", c.TLSCAFile)
+		}
+	}
+	return tc, nil
+}
+
+func (p *LDAPProvider) Name() string {
+	return p.name
+}
+
+func (p *LDAPProvider) Type() string {
+	return "ldap"
+}
+
+func (p *LDAPProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, auth.ErrSkipAuth
+	}
+	// the empty password is the unauthenticated bind that always succeeds (RFC 4513 5.1.2)
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	var u *ldapUser
+	if p.cache != nil {
+		u, _ = p.cache.get(key)
+	}
+	if u == nil {
+		var err error
+		u, err = p.login(username, password)
+		if err != nil {
+			return nil, err
+		}
+		if p.cache != nil {
+			p.cache.add(key, u, time.Time{})
+		}
+	}
+	role, err := selectGrantedRole(r.Header.Get(p.c.RoleHeader), p.c.DefaultRole, u.roles)
+	if err != nil {
+		log.Printf("Auth: %s: user %q: %v", p.name, username, err)
+		return nil, auth.ErrForbidden
+	}
+	return &auth.AuthInfo{
+		Role:         role,
+		UserId:       username,
+		UserName:     u.name,
+		AuthType:     "ldap",
+		AuthProvider: p.name,
+		Claims:       auth.ScalarClaims(u.claims),
+	}, nil
+}
+
+// login searches the user, checks the password by the bind as the user and resolves the user groups.
+func (p *LDAPProvider) login(username, password string) (*ldapUser, error) {
+	conn, err := p.conn()
+	if err != nil {
+		log.Printf("Auth: %s: LDAP connection error: %v", p.name, err)
+		return nil, ErrProviderUnavailable
+	}
+	reuse := false
+	defer func() {
+		p.release(conn, reuse)
+	}()
+
+	attrs := append([]string{p.c.GroupAttribute, p.c.UserNameAttribute, "cn", "mail"}, p.c.Attributes...)
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.c.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.c.Timeout.Seconds()), false,
+		strings.ReplaceAll(p.c.UserFilter, "{username}", ldap.EscapeFilter(username)),
+		attrs, nil,
+	))
+	if err != nil {
+		// the directory errors are logged only, they are not sent to the client
+		log.Printf("Auth: %s: LDAP user search error: %v", p.name, err)
+		return nil, ErrProviderUnavailable
+	}
+	reuse = true
+	switch len(res.Entries) {
+	case 0:
+		// the user can be authenticated by the next provider
+		return nil, auth.ErrInvalidKeyType
+	case 1:
+	default:
+		log.Printf("Auth: %s: LDAP user %q is ambiguous", p.name, username)
+		return nil, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		// the failed bind resets the connection to anonymous
+		reuse = p.bind(conn) == nil
+		if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			log.Printf("Auth: %s: LDAP bind error for user %q: %v", p.name, username, err)
+			return nil, ErrProviderUnavailable
+		}
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			log.Printf("Auth: %s: invalid password for user %q", p.name, username)
+		} else {
+			// e.g. the account is locked or disabled
+			log.Printf("Auth: %s: LDAP bind failed for user %q: %v", p.name, username, err)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	// the connection is bound as the user, rebind to the service account to search the groups and reuse it
+	if err := p.bind(conn); err != nil {
+		reuse = false
+		log.Printf("Auth: %s: LDAP service account bind error: %v", p.name, err)
+		return nil, ErrProviderUnavailable
+	}
+
+	groups := entry.GetAttributeValues(p.c.GroupAttribute)
+	if p.c.GroupFilter != "" {
+		filter := strings.NewReplacer(
+			"{dn}", ldap.EscapeFilter(entry.DN),
+			"{username}", ldap.EscapeFilter(username),
+		).Replace(p.c.GroupFilter)
+		gr, err := conn.Search(ldap.NewSearchRequest(
+			p.c.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(p.c.Timeout.Seconds()), false,
+			filter, []string{"dn"}, nil,
+		))
+		if err != nil {
+			log.Printf("Auth: %s: LDAP group search error for user %q: %v", p.name, username, err)
+			return nil, ErrProviderUnavailable
+		}
+		for _, g := range gr.Entries {
+			groups = append(groups, g.DN)
+		}
+	}
+
+	groups = uniqueStrings(groups)
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if cn := groupName(g); cn != "" {
+			names = append(names, cn)
+		}
+	}
+	claims := jwt.MapClaims{
+		"sub":         username,
+		"dn":          entry.DN,
+		"groups":      groups,
+		"group_names": names,
+	}
+	if mail := entry.GetAttributeValue("mail"); mail != "" {
+		claims["email"] = mail
+	}
+	for _, a := range p.c.Attributes {
+		if v := entry.GetAttributeValue(a); v != "" {
+			claims[a] = v
+		}
+	}
+	u := &ldapUser{
+		dn:     entry.DN,
+		name:   entry.GetAttributeValue(p.c.UserNameAttribute),
+		claims: claims,
+		roles:  uniqueStrings(mapRoles(p.c.RoleMapping, claims)),
+	}
+	if u.name == "" {
+		u.name = username
+	}
+	claims["name"] = u.name
+	if len(u.roles) == 0 && p.c.DefaultRole != "" {
+		u.roles = []string{p.c.DefaultRole}
+	}
+	return u, nil
+}
+
+// groupName returns the CN of the group DN.
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, a := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(a.Type, "cn") {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// conn returns the idle pooled connection or opens the new one bound to the service account.
+func (p *LDAPProvider) conn() (*ldap.Conn, error) {
+idle:
+	for {
+		select {
+		case conn := <-p.conns:
+			if !conn.IsClosing() {
+				return conn, nil
+			}
+		default:
+			break idle
+		}
+	}
+	conn, err := ldap.DialURL(p.c.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: p.c.Timeout}),
+		ldap.DialWithTLSConfig(p.tls),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(p.c.Timeout)
+	if p.c.StartTLS && !strings.HasPrefix(p.c.URL, "ldaps://") {
+		if err := conn.StartTLS(p.tls); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	if err := p.bind(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bind binds the connection to the service account (or anonymously).
+func (p *LDAPProvider) bind(conn *ldap.Conn) error {
+	if p.c.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(p.c.BindDN, p.c.BindPassword)
+}
+
+// release returns the connection to the pool or closes it if the pool is full or the connection can't be reused.
+func (p *LDAPProvider) release(conn *ldap.Conn, reuse bool) {
+	if !reuse || conn.IsClosing() {
+		conn.Close()
+		return
+	}
+	select {
+	case p.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
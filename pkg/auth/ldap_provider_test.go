@@ -0,0 +1,400 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// ldapEntry is the directory entry of the LDAP stand-in server.
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapServer is the minimal in-process LDAP server: simple bind, search by the attribute equality and StartTLS.
+type ldapServer struct {
+	addr    string
+	entries []ldapEntry
+	tls     *tls.Config
+	cert    *x509.Certificate
+
+	binds atomic.Int32
+	conns atomic.Int32
+}
+
+func newLDAPServer(t *testing.T, entries []ldapEntry) *ldapServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reuse the httptest certificate for StartTLS
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	s := &ldapServer{
+		addr:    ln.Addr().String(),
+		entries: entries,
+		tls:     &tls.Config{Certificates: ts.TLS.Certificates},
+		cert:    ts.Certificate(),
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Go(func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Go(func() { s.serve(conn) })
+		}
+	})
+	return s
+}
+
+func (s *ldapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		id := req.Children[0].Value
+		op := req.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.binds.Add(1)
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if dn == "" && password == "" {
+				code, bound = ldap.LDAPResultSuccess, ""
+			}
+			for _, e := range s.entries {
+				if e.dn == dn && e.password == password && password != "" {
+					code, bound = ldap.LDAPResultSuccess, dn
+				}
+			}
+			if code != ldap.LDAPResultSuccess {
+				bound = ""
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			if bound != "cn=hugr,dc=example,dc=com" {
+				conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights).Bytes())
+				continue
+			}
+			base := op.Children[0].Data.String()
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, e := range s.entries {
+				if strings.HasSuffix(e.dn, base) && e.match(filter) {
+					conn.Write(ldapSearchEntry(id, e).Bytes())
+				}
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationExtendedRequest:
+			conn.Write(ldapResponse(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn = tc
+		default:
+			return
+		}
+	}
+}
+
+// match checks the filter: the attribute equality or the OR of them, e.g. (|(uid=alice)(sAMAccountName=alice)).
+func (e ldapEntry) match(filter string) bool {
+	filter = strings.TrimPrefix(filter, "(|")
+	for _, cond := range strings.Split(filter, ")") {
+		attr, value, ok := strings.Cut(strings.Trim(cond, "()"), "=")
+		if !ok {
+			continue
+		}
+		value = strings.ReplaceAll(value, `\2c`, ",")
+		if attr == "dn" && e.dn == value {
+			return true
+		}
+		for _, v := range e.attrs[attr] {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ldapResponse(id any, tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.NewSequence("response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "op")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matched dn"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapSearchEntry(id any, e ldapEntry) *ber.Packet {
+	p := ber.NewSequence("response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "dn"))
+	attrs := ber.NewSequence("attributes")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	p.AppendChild(op)
+	return p
+}
+
+func newTestLDAPServer(t *testing.T) *ldapServer {
+	return newLDAPServer(t, []ldapEntry{
+		{dn: "cn=hugr,dc=example,dc=com", password: "service"},
+		{
+			dn: "uid=alice,ou=people,dc=example,dc=com", password: "alice-pass",
+			attrs: map[string][]string{
+				"uid":         {"alice"},
+				"displayName": {"Alice Smith"},
+				"mail":        {"alice@example.com"},
+				"department":  {"finance"},
+				"memberOf":    {"cn=hugr-admins,ou=groups,dc=example,dc=com", "cn=analysts,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			dn: "uid=bob,ou=people,dc=example,dc=com", password: "bob-pass",
+			attrs: map[string][]string{"uid": {"bob"}},
+		},
+		{
+			dn: "cn=readers,ou=groups,dc=example,dc=com",
+			attrs: map[string][]string{
+				"member": {"uid=bob,ou=people,dc=example,dc=com"},
+			},
+		},
+	})
+}
+
+func testLDAPConfig(s *ldapServer) LDAPConfig {
+	return LDAPConfig{
+		URL:          "ldap://" + s.addr,
+		BindDN:       "cn=hugr,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Attributes:   []string{"department"},
+		RoleMapping: []RoleMappingRule{
+			{Claim: "group_names", Value: "hugr-admins", Role: "admin", Priority: 10},
+			{Claim: "groups", Pattern: "cn=analysts,*", Role: "analyst"},
+			{Claim: "group_names", Value: "readers", Role: "readonly"},
+		},
+	}
+}
+
+func ldapAuthenticate(p *LDAPProvider, user, password, role string) (*auth.AuthInfo, error) {
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+	if user != "" || password != "" {
+		r.SetBasicAuth(user, password)
+	}
+	if role != "" {
+		r.Header.Set("x-hugr-role", role)
+	}
+	return p.Authenticate(r)
+}
+
+func TestLDAPProvider(t *testing.T) {
+	s := newTestLDAPServer(t)
+	p, err := NewLDAPProvider("ad", testLDAPConfig(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ldapAuthenticate(p, "", "", ""); !errors.Is(err, auth.ErrSkipAuth) {
+		t.Errorf("no basic header: err = %v, want ErrSkipAuth", err)
+	}
+	if _, err := ldapAuthenticate(p, "alice", "", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("empty password: err = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := ldapAuthenticate(p, "carol", "pass", ""); !errors.Is(err, auth.ErrInvalidKeyType) {
+		t.Errorf("unknown user: err = %v, want ErrInvalidKeyType", err)
+	}
+	if _, err := ldapAuthenticate(p, "alice", "wrong", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: err = %v, want ErrInvalidCredentials", err)
+	}
+
+	info, err := ldapAuthenticate(p, "alice", "alice-pass", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Role != "admin" || info.UserId != "alice" || info.UserName != "Alice Smith" || info.AuthType != "ldap" ||
+		info.Claims["email"] != "alice@example.com" || info.Claims["department"] != "finance" {
+		t.Errorf("unexpected auth info: %+v", info)
+	}
+
+	// the successful bind is cached, the role is selected on each request
+	binds := s.binds.Load()
+	info, err = ldapAuthenticate(p, "alice", "alice-pass", "analyst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Role != "analyst" {
+		t.Errorf("role = %q, want the requested analyst", info.Role)
+	}
+	if n := s.binds.Load(); n != binds {
+		t.Errorf("cached credentials: %d binds, want none", n-binds)
+	}
+	if _, err := ldapAuthenticate(p, "alice", "alice-pass", "readonly"); !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("not granted role: err = %v, want ErrForbidden", err)
+	}
+
+	// bob has no groups and there is no default role
+	if _, err := ldapAuthenticate(p, "bob", "bob-pass", ""); !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("user without roles: err = %v, want ErrForbidden", err)
+	}
+
+	// the connections are pooled
+	if n := s.conns.Load(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
+
+func TestLDAPProvider_GroupSearchStartTLS(t *testing.T) {
+	s := newTestLDAPServer(t)
+	c := testLDAPConfig(s)
+	c.StartTLS = true
+	c.TLSInsecure = true
+	c.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupFilter = "(member={dn})"
+	c.CacheTTL = -1
+	p, err := NewLDAPProvider("openldap", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ldapAuthenticate(p, "bob", "bob-pass", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Role != "readonly" {
+		t.Errorf("role = %q, want readonly by the group search", info.Role)
+	}
+	binds := s.binds.Load()
+	if _, err := ldapAuthenticate(p, "bob", "bob-pass", ""); err != nil {
+		t.Fatal(err)
+	}
+	if s.binds.Load() == binds {
+		t.Error("the cache is disabled, the user must be bound again")
+	}
+}
+
+func TestLDAPProvider_StartTLSVerify(t *testing.T) {
+	s := newTestLDAPServer(t)
+	c := testLDAPConfig(s)
+	c.StartTLS = true
+	c.CacheTTL = -1
+
+	// the server certificate isn't signed by the system roots
+	p, err := NewLDAPProvider("tls", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ldapAuthenticate(p, "alice", "alice-pass", ""); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("untrusted certificate: err = %v, want ErrProviderUnavailable", err)
+	}
+
+	// the certificate is verified by the CA file and the URL host name
+	c.TLSCAFile = filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(c.TLSCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewLDAPProvider("tls", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ldapAuthenticate(p, "alice", "alice-pass", ""); err != nil {
+		t.Fatalf("verified StartTLS: %v", err)
+	}
+
+	// the host name must match the certificate
+	c.URL = strings.Replace(c.URL, "127.0.0.1", "127.0.0.2", 1)
+	p, err = NewLDAPProvider("tls", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.c.URL = testLDAPConfig(s).URL
+	if _, err := ldapAuthenticate(p, "alice", "alice-pass", ""); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("host name mismatch: err = %v, want ErrProviderUnavailable", err)
+	}
+}
+
+func TestLDAPProvider_DirectoryErrors(t *testing.T) {
+	s := newTestLDAPServer(t)
+	c := testLDAPConfig(s)
+	// the anonymous search is refused by the server
+	c.BindDN, c.BindPassword = "", ""
+	p, err := NewLDAPProvider("anonymous", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ldapAuthenticate(p, "alice", "alice-pass", "")
+	if !errors.Is(err, ErrProviderUnavailable) || strings.Contains(err.Error(), "Insufficient") {
+		t.Errorf("search error: err = %v, want ErrProviderUnavailable without the details", err)
+	}
+}
+
+func TestLDAPProvider_Unavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	p, err := NewLDAPProvider("ad", LDAPConfig{URL: "ldap://" + addr, BaseDN: "dc=example,dc=com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ldapAuthenticate(p, "alice", "pass", ""); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("err = %v, want ErrProviderUnavailable", err)
+	}
+}
@@ -0,0 +1,580 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// ErrLockedOut is returned for the requests of the client IP or the credential that is locked out
+// after the repeated authentication failures.
+var ErrLockedOut = errors.New("too many failed authentication attempts")
+
+// The scopes of the failure counters.
+const (
+	LockoutScopeIP         = "ip"
+	LockoutScopeCredential = "credential"
+)
+
+const (
+	defaultLockoutIPMaxFailures         = 50
+	defaultLockoutCredentialMaxFailures = 5
+	defaultLockoutWindow                = 15 * time.Minute
+	defaultLockoutDuration              = time.Minute
+	defaultLockoutMaxDuration           = time.Hour
+
+	// lockoutMemoryMaxEntries limits the in-memory counters, the expired ones are removed when it is reached
+	lockoutMemoryMaxEntries = 100000
+	lockoutCacheKeyPrefix   = "hugr:auth:lockout:"
+)
+
+// LockoutConfig configures the brute-force protection of the credential-based auth
+// (the API keys, the secret key, the basic and LDAP users). The failures are counted
+// by the client IP and by the credential, the lockout duration is doubled on every failure
+// after the threshold is reached.
+type LockoutConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// IPMaxFailures is the number of the failures from the client IP to lock it out (default 50)
+	IPMaxFailures int `json:"ip_max_failures" yaml:"ip_max_failures"`
+	// CredentialMaxFailures is the number of the failures of the API key or the user name to lock it out (default 5)
+	CredentialMaxFailures int `json:"credential_max_failures" yaml:"credential_max_failures"`
+	// Window is the time the failures are counted after the last one (default 15m)
+	Window time.Duration `json:"window" yaml:"window"`
+	// Duration is the first lockout duration (default 1m)
+	Duration time.Duration `json:"duration" yaml:"duration"`
+	// MaxDuration limits the lockout duration (default 1h)
+	MaxDuration time.Duration `json:"max_duration" yaml:"max_duration"`
+}
+
+func (c LockoutConfig) maxFailures(scope string) int {
+	if scope == LockoutScopeIP {
+		if c.IPMaxFailures <= 0 {
+			return defaultLockoutIPMaxFailures
+		}
+		return c.IPMaxFailures
+	}
+	if c.CredentialMaxFailures <= 0 {
+		return defaultLockoutCredentialMaxFailures
+	}
+	return c.CredentialMaxFailures
+}
+
+func (c LockoutConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return defaultLockoutWindow
+	}
+	return c.Window
+}
+
+func (c LockoutConfig) maxDuration() time.Duration {
+	if c.MaxDuration <= 0 {
+		return defaultLockoutMaxDuration
+	}
+	return c.MaxDuration
+}
+
+// lockoutDuration returns the lockout duration after the failures: the duration is doubled
+// on every failure after the threshold.
+func (c LockoutConfig) lockoutDuration(failures, threshold int) time.Duration {
+	d := c.Duration
+	if d <= 0 {
+		d = defaultLockoutDuration
+	}
+	maxD := c.maxDuration()
+	if n := failures - threshold; n > 0 {
+		if f := float64(d) * math.Pow(2, float64(n)); f < float64(maxD) {
+			d = time.Duration(f)
+		} else {
+			d = maxD
+		}
+	}
+	return min(d, maxD)
+}
+
+func (c LockoutConfig) validate() error {
+	if c.IPMaxFailures < 0 || c.CredentialMaxFailures < 0 {
+		return errors.New("max failures can't be negative")
+	}
+	if c.Duration < 0 || c.MaxDuration < 0 || c.Window < 0 {
+		return errors.New("durations can't be negative")
+	}
+	if c.Duration > c.maxDuration() {
+		return fmt.Errorf("duration %s exceeds max duration %s", c.Duration, c.maxDuration())
+	}
+	return nil
+}
+
+// LockoutState is the failures counter of the client IP or the credential.
+type LockoutState struct {
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// LockoutStore keeps the failure counters, the counters are removed after the ttl.
+type LockoutStore interface {
+	// Get returns the counter of the key, the zero counter if there are no failures.
+	Get(ctx context.Context, key string) (LockoutState, error)
+	// Incr atomically increments the failures of the key and returns the new number,
+	// the failures are removed after the ttl since the last one.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int, error)
+	// Lock locks the key out until the time, the later lockout is kept.
+	Lock(ctx context.Context, key string, until time.Time) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Lockout counts the authentication failures of the credential-based providers and rejects
+// the requests of the locked out client IPs and credentials with 429 Too Many Requests.
+// The requests are rejected by the Middleware before the auth providers are called,
+// the failures are recorded by the providers of the chain.
+type Lockout struct {
+	Config LockoutConfig
+
+	// headers are the API key headers of the providers
+	headers []string
+	auditor *Auditor
+
+	mu    sync.RWMutex
+	store LockoutStore
+
+	// pending are the requests with the credential rejected by a provider (ErrInvalidKeyType),
+	// the next provider can accept it.
+	pending sync.Map
+}
+
+// NewLockout creates the lockout with the in-memory counters of the node.
+func NewLockout(c LockoutConfig, headers []string) *Lockout {
+	return &Lockout{
+		Config:  c,
+		headers: headers,
+		store:   newMemoryLockoutStore(lockoutMemoryMaxEntries),
+	}
+}
+
+// SetStore sets the store of the failure counters, e.g. the cache shared by the cluster nodes.
+func (l *Lockout) SetStore(s LockoutStore) {
+	l.mu.Lock()
+	l.store = s
+	l.mu.Unlock()
+}
+
+func (l *Lockout) getStore() LockoutStore {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.store
+}
+
+type lockoutKey struct {
+	scope string
+	key   string
+}
+
+// credentials returns the counter keys of the credentials in the request: the API key headers
+// and the basic auth user name. The values are hashed, so the keys are not stored.
+func (l *Lockout) credentials(r *http.Request) []lockoutKey {
+	var keys []lockoutKey
+	for _, h := range l.headers {
+		if v := r.Header.Get(h); v != "" {
+			keys = append(keys, lockoutKey{LockoutScopeCredential, lockoutHash("key", h, v)})
+		}
+	}
+	if username, _, ok := r.BasicAuth(); ok {
+		keys = append(keys, lockoutKey{LockoutScopeCredential, lockoutHash("basic", username)})
+	}
+	return keys
+}
+
+func lockoutHash(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func (k lockoutKey) String() string {
+	return k.scope + ":" + k.key
+}
+
+// Locked returns the remaining lockout time if the client IP or the credential of the request
+// is locked out. The requests without the credentials are not checked.
+func (l *Lockout) Locked(r *http.Request) (time.Duration, bool) {
+	creds := l.credentials(r)
+	if len(creds) == 0 {
+		return 0, false
+	}
+	keys := append([]lockoutKey{{LockoutScopeIP, clientIP(r)}}, creds...)
+	store := l.getStore()
+	now := time.Now()
+	var wait time.Duration
+	var scope string
+	for _, k := range keys {
+		s, err := store.Get(r.Context(), k.String())
+		if err != nil {
+			// the counters are not available, the requests are not rejected
+			log.Printf("Auth: lockout: get counter error: %v", err)
+			return 0, false
+		}
+		if d := s.LockedUntil.Sub(now); d > wait {
+			wait, scope = d, k.scope
+		}
+	}
+	if wait <= 0 {
+		return 0, false
+	}
+	lockedRequests.WithLabelValues(scope).Inc()
+	return wait, true
+}
+
+// Middleware rejects the requests of the locked out client IPs and credentials with 429 Too Many Requests.
+func (l *Lockout) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, ok := l.Locked(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if l.auditor != nil {
+			l.auditor.failure(r, nil, ErrLockedOut)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, ErrLockedOut.Error(), http.StatusTooManyRequests)
+	})
+}
+
+// failure counts the failure of the client IP and the credentials of the request.
+func (l *Lockout) failure(r *http.Request) {
+	l.pending.Delete(r)
+	creds := l.credentials(r)
+	if len(creds) == 0 {
+		return
+	}
+	keys := append([]lockoutKey{{LockoutScopeIP, clientIP(r)}}, creds...)
+	ctx := context.WithoutCancel(r.Context())
+	store := l.getStore()
+	now := time.Now()
+	for _, k := range keys {
+		failures, err := store.Incr(ctx, k.String(), l.Config.window())
+		if err != nil {
+			log.Printf("Auth: lockout: count failure error: %v", err)
+			return
+		}
+		threshold := l.Config.maxFailures(k.scope)
+		if failures < threshold {
+			continue
+		}
+		d := l.Config.lockoutDuration(failures, threshold)
+		if err := store.Lock(ctx, k.String(), now.Add(d)); err != nil {
+			log.Printf("Auth: lockout: lock error: %v", err)
+			continue
+		}
+		lockouts.WithLabelValues(k.scope).Inc()
+		if k.scope == LockoutScopeIP {
+			log.Printf("Auth: lockout: client %s is locked out for %s after %d failures", k.key, d, failures)
+		} else {
+			log.Printf("Auth: lockout: credential of the request from %s is locked out for %s after %d failures", clientIP(r), d, failures)
+		}
+	}
+}
+
+// success resets the failures of the accepted credentials, the client IP failures are kept.
+func (l *Lockout) success(r *http.Request) {
+	l.pending.Delete(r)
+	store := l.getStore()
+	for _, k := range l.credentials(r) {
+		if err := store.Delete(context.WithoutCancel(r.Context()), k.String()); err != nil {
+			log.Printf("Auth: lockout: reset counter error: %v", err)
+		}
+	}
+}
+
+// credentialProvider returns true if the provider authenticates the requests by the credentials
+// that are counted (the API keys, the basic and LDAP users).
+func credentialProvider(p auth.AuthProvider) bool {
+	switch p.Type() {
+	case "apiKey", "db-api-key", "basic", "ldap":
+		return true
+	}
+	return false
+}
+
+// lockoutProvider records the failures of the wrapped provider. A credential rejected by a provider
+// (ErrInvalidKeyType) is counted if no other credential provider accepts it.
+type lockoutProvider struct {
+	auth.AuthProvider
+	lockout *Lockout
+	last    bool
+}
+
+func (p *lockoutProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	info, err := p.AuthProvider.Authenticate(r)
+	credential := credentialProvider(p.AuthProvider)
+	switch {
+	case err == nil && info != nil:
+		if _, rejected := p.lockout.pending.Load(r); rejected && !credential {
+			// the request is accepted by the token, but the credential was rejected
+			p.lockout.failure(r)
+			break
+		}
+		p.lockout.success(r)
+	case errors.Is(err, auth.ErrInvalidKeyType):
+		if credential {
+			p.lockout.pending.Store(r, struct{}{})
+		}
+		if p.last {
+			p.chainEnd(r)
+		}
+	case errors.Is(err, auth.ErrSkipAuth):
+		if p.last {
+			p.chainEnd(r)
+		}
+	case errors.Is(err, ErrInvalidCredentials),
+		// the engine API key provider rejects the wrong key with ErrForbidden
+		errors.Is(err, auth.ErrForbidden) && p.Type() == "apiKey":
+		p.lockout.failure(r)
+	case err != nil:
+		p.lockout.pending.Delete(r)
+	}
+	return info, err
+}
+
+func (p *lockoutProvider) chainEnd(r *http.Request) {
+	if _, rejected := p.lockout.pending.Load(r); rejected {
+		p.lockout.failure(r)
+	}
+}
+
+// Unwrap returns the wrapped provider.
+func (p *lockoutProvider) Unwrap() auth.AuthProvider {
+	return p.AuthProvider
+}
+
+// ConfiguredLockout returns the brute-force protection of the auth providers, nil if it is disabled.
+func ConfiguredLockout(c *auth.Config) *Lockout {
+	if c == nil {
+		return nil
+	}
+	if lp, ok := findWrapper[*lockoutProvider](c.Providers); ok {
+		return lp.lockout
+	}
+	return nil
+}
+
+// memoryLockoutStore keeps the failure counters of the node.
+type memoryLockoutStore struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]memoryLockoutEntry
+}
+
+type memoryLockoutEntry struct {
+	state   LockoutState
+	expires time.Time
+}
+
+func newMemoryLockoutStore(maxEntries int) *memoryLockoutStore {
+	return &memoryLockoutStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]memoryLockoutEntry),
+	}
+}
+
+func (s *memoryLockoutStore) Get(_ context.Context, key string) (LockoutState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return LockoutState{}, nil
+	}
+	if !time.Now().Before(e.expires) {
+		delete(s.entries, key)
+		return LockoutState{}, nil
+	}
+	return e.state, nil
+}
+
+func (s *memoryLockoutStore) Incr(_ context.Context, key string, ttl time.Duration) (int, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.entry(key, now)
+	if err != nil {
+		return 0, err
+	}
+	e.state.Failures++
+	if expires := now.Add(ttl); expires.After(e.expires) {
+		e.expires = expires
+	}
+	s.entries[key] = e
+	return e.state.Failures, nil
+}
+
+func (s *memoryLockoutStore) Lock(_ context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.entry(key, time.Now())
+	if err != nil {
+		return err
+	}
+	if until.After(e.state.LockedUntil) {
+		e.state.LockedUntil = until
+	}
+	if until.After(e.expires) {
+		e.expires = until
+	}
+	s.entries[key] = e
+	return nil
+}
+
+// entry returns the not expired entry of the key, the new entry is checked against the max entries.
+// It should be called under the lock.
+func (s *memoryLockoutStore) entry(key string, now time.Time) (memoryLockoutEntry, error) {
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		return e, nil
+	}
+	delete(s.entries, key)
+	if len(s.entries) >= s.maxEntries {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= s.maxEntries {
+			// the client IP counters still limit the failures
+			return memoryLockoutEntry{}, errors.New("too many lockout counters")
+		}
+	}
+	return memoryLockoutEntry{}, nil
+}
+
+func (s *memoryLockoutStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// CacheCounter increments the counters in the cache backend atomically (e.g. INCR and EXPIRE in redis).
+type CacheCounter interface {
+	// Incr increments the counter of the key, sets its ttl and returns the new value.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// CacheLockoutStore keeps the failure counters in the cache backend (e.g. the L2 cache),
+// so the counters are shared by the cluster nodes. The failures are incremented by the counter
+// of the backend atomically, the lockout time is kept in a separate key.
+type CacheLockoutStore struct {
+	store   func(ctx context.Context) (store.StoreInterface, error)
+	counter CacheCounter
+}
+
+// NewCacheLockoutStore creates the store of the failure counters in the cache backend,
+// the backend is returned by the function on every call (it can be connected lazily).
+func NewCacheLockoutStore(s func(ctx context.Context) (store.StoreInterface, error), c CacheCounter) *CacheLockoutStore {
+	return &CacheLockoutStore{store: s, counter: c}
+}
+
+func lockoutFailuresKey(key string) string {
+	return lockoutCacheKeyPrefix + "failures:" + key
+}
+
+func (s *CacheLockoutStore) Get(ctx context.Context, key string) (LockoutState, error) {
+	cs, err := s.store(ctx)
+	if err != nil {
+		return LockoutState{}, err
+	}
+	var state LockoutState
+	b, err := cacheBytes(ctx, cs, lockoutCacheKeyPrefix+key)
+	if err != nil {
+		return LockoutState{}, err
+	}
+	if b != nil {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return LockoutState{}, err
+		}
+	}
+	b, err = cacheBytes(ctx, cs, lockoutFailuresKey(key))
+	if err != nil {
+		return LockoutState{}, err
+	}
+	if b != nil {
+		state.Failures, err = strconv.Atoi(string(b))
+		if err != nil {
+			return LockoutState{}, fmt.Errorf("invalid lockout counter: %w", err)
+		}
+	}
+	return state, nil
+}
+
+// cacheBytes returns the value of the key, nil if it is not found.
+func cacheBytes(ctx context.Context, cs store.StoreInterface, key string) ([]byte, error) {
+	v, err := cs.Get(ctx, key)
+	if errors.Is(err, store.NotFound{}) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("unexpected lockout counter type %T", v)
+	}
+}
+
+func (s *CacheLockoutStore) Incr(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	n, err := s.counter.Incr(ctx, lockoutFailuresKey(key), ttl)
+	return int(n), err
+}
+
+func (s *CacheLockoutStore) Lock(ctx context.Context, key string, until time.Time) error {
+	cs, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	// the later lockout of the concurrent failure (e.g. on the other node) is kept
+	b, err := cacheBytes(ctx, cs, lockoutCacheKeyPrefix+key)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		var state LockoutState
+		if err := json.Unmarshal(b, &state); err == nil && !state.LockedUntil.Before(until) {
+			return nil
+		}
+	}
+	b, err = json.Marshal(LockoutState{LockedUntil: until})
+	if err != nil {
+		return err
+	}
+	return cs.Set(ctx, lockoutCacheKeyPrefix+key, b, store.WithExpiration(time.Until(until)))
+}
+
+func (s *CacheLockoutStore) Delete(ctx context.Context, key string) error {
+	cs, err := s.store(ctx)
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{lockoutCacheKeyPrefix + key, lockoutFailuresKey(key)} {
+		if err := cs.Delete(ctx, k); err != nil && !errors.Is(err, store.NotFound{}) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestLockoutConfig_Duration(t *testing.T) {
+	c := LockoutConfig{Duration: time.Minute, MaxDuration: time.Hour}
+	for _, tt := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{7, 4 * time.Minute},
+		{11, time.Hour},
+		{1000, time.Hour},
+	} {
+		if got := c.lockoutDuration(tt.failures, 5); got != tt.want {
+			t.Errorf("failures %d: duration = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLockout_Chain(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users")
+	if err := os.WriteFile(users, []byte("alice:"+bcryptHash(t, "alice-pw")+":analyst\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashAPIKey("etl-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "auth.yaml")
+	err = os.WriteFile(file, []byte(`api-keys:
+  etl:
+    key-hash: `+hash+`
+basic:
+  users:
+    file: `+users+`
+lockout:
+  enabled: true
+  ip_max_failures: 8
+  credential_max_failures: 3
+  duration: 1m
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, err := (&Config{ConfigFile: file, SecretKey: "admin-secret"}).Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ConfiguredLockout(ac)
+	if l == nil {
+		t.Fatal("lockout is not configured")
+	}
+	handler := l.Middleware(auth.AuthMiddleware(*ac)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	request := func(ip string, set func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/query", nil)
+		r.RemoteAddr = ip + ":40000"
+		set(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	basic := func(user, pw string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, pw) }
+	}
+	header := func(name, value string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set(name, value) }
+	}
+
+	// the success resets the failures of the credential
+	for range 2 {
+		if w := request("10.0.0.1", basic("alice", "wrong")); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password: status = %d", w.Code)
+		}
+	}
+	if w := request("10.0.0.1", basic("alice", "alice-pw")); w.Code != http.StatusOK {
+		t.Fatalf("valid password: status = %d", w.Code)
+	}
+	for range 2 {
+		request("10.0.0.1", basic("alice", "wrong"))
+	}
+	if w := request("10.0.0.1", basic("alice", "alice-pw")); w.Code != http.StatusOK {
+		t.Fatalf("valid password after reset: status = %d", w.Code)
+	}
+
+	// the user is locked out after 3 failures, even with the valid password and from the other IP
+	for range 3 {
+		request("10.0.0.2", basic("alice", "wrong"))
+	}
+	w := request("10.0.0.3", basic("alice", "alice-pw"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked user: status = %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	// the wrong API keys rejected by all providers are counted
+	for range 3 {
+		if w := request("10.0.0.4", header("x-hugr-api-key", "guess")); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong api key: status = %d", w.Code)
+		}
+	}
+	if w := request("10.0.0.5", header("x-hugr-api-key", "guess")); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked api key: status = %d", w.Code)
+	}
+	if w := request("10.0.0.5", header("x-hugr-api-key", "etl-key")); w.Code != http.StatusOK {
+		t.Fatalf("other api key: status = %d", w.Code)
+	}
+
+	// the client IP is locked out after 8 failures with the different credentials
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5", "k6", "k7", "k8"} {
+		request("10.0.0.6", header("x-hugr-secret-key", key))
+	}
+	if w := request("10.0.0.6", header("x-hugr-secret-key", "admin-secret")); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked ip: status = %d", w.Code)
+	}
+	if w := request("10.0.0.7", header("x-hugr-secret-key", "admin-secret")); w.Code != http.StatusOK {
+		t.Fatalf("other ip: status = %d", w.Code)
+	}
+	// the requests without the credentials are not checked
+	if w := request("10.0.0.6", func(*http.Request) {}); w.Code == http.StatusTooManyRequests {
+		t.Fatal("request without credentials is rejected by the lockout")
+	}
+}
+
+// memoryCacheStore is the cache backend storing the values as the redis store does (strings).
+type memoryCacheStore struct {
+	store.StoreInterface
+	mu     sync.Mutex
+	values map[any]string
+}
+
+func (s *memoryCacheStore) Get(_ context.Context, key any) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, store.NotFound{}
+	}
+	return v, nil
+}
+
+func (s *memoryCacheStore) Set(_ context.Context, key any, value any, _ ...store.Option) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = string(value.([]byte))
+	return nil
+}
+
+func (s *memoryCacheStore) Delete(_ context.Context, key any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// memoryCacheCounter increments the counters of the memory cache backend as the redis INCR does.
+type memoryCacheCounter struct {
+	*memoryCacheStore
+}
+
+func (c memoryCacheCounter) Incr(_ context.Context, key string, _ time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, _ := strconv.ParseInt(c.values[key], 10, 64)
+	n++
+	c.values[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func TestCacheLockoutStore(t *testing.T) {
+	backend := &memoryCacheStore{values: make(map[any]string)}
+	s := NewCacheLockoutStore(func(context.Context) (store.StoreInterface, error) { return backend, nil }, memoryCacheCounter{backend})
+	ctx := t.Context()
+
+	st, err := s.Get(ctx, "ip:10.0.0.1")
+	if err != nil || st.Failures != 0 {
+		t.Fatalf("missing counter = %+v, %v", st, err)
+	}
+	for want := 1; want <= 3; want++ {
+		if n, err := s.Incr(ctx, "ip:10.0.0.1", time.Minute); err != nil || n != want {
+			t.Fatalf("failures = %d, %v, want %d", n, err, want)
+		}
+	}
+	until := time.Now().Add(time.Minute).Truncate(time.Second)
+	if err := s.Lock(ctx, "ip:10.0.0.1", until); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.values[lockoutCacheKeyPrefix+"ip:10.0.0.1"]; !ok {
+		t.Fatalf("lockout is not stored with the prefix: %v", backend.values)
+	}
+	// the later lockout is kept
+	if err := s.Lock(ctx, "ip:10.0.0.1", until.Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	st, err = s.Get(ctx, "ip:10.0.0.1")
+	if err != nil || st.Failures != 3 || !st.LockedUntil.Equal(until) {
+		t.Fatalf("counter = %+v, %v", st, err)
+	}
+	later := until.Add(time.Minute)
+	if err := s.Lock(ctx, "ip:10.0.0.1", later); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := s.Get(ctx, "ip:10.0.0.1"); err != nil || !st.LockedUntil.Equal(later) {
+		t.Fatalf("extended lockout = %+v, %v", st, err)
+	}
+	if err := s.Delete(ctx, "ip:10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := s.Get(ctx, "ip:10.0.0.1"); st.Failures != 0 || !st.LockedUntil.IsZero() {
+		t.Fatalf("deleted counter = %+v", st)
+	}
+}
+
+func TestLockout_ParallelFailures(t *testing.T) {
+	backend := &memoryCacheStore{values: make(map[any]string)}
+	for name, store := range map[string]LockoutStore{
+		"memory": newMemoryLockoutStore(lockoutMemoryMaxEntries),
+		"cache":  NewCacheLockoutStore(func(context.Context) (store.StoreInterface, error) { return backend, nil }, memoryCacheCounter{backend}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := NewLockout(LockoutConfig{Enabled: true, IPMaxFailures: 100, CredentialMaxFailures: 20}, []string{"x-api-key"})
+			l.SetStore(store)
+			request := func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/query", nil)
+				r.RemoteAddr = "10.0.0.1:1234"
+				r.Header.Set("x-api-key", "guess")
+				return r
+			}
+			var wg sync.WaitGroup
+			for range 20 {
+				wg.Go(func() { l.failure(request()) })
+			}
+			wg.Wait()
+			if _, ok := l.Locked(request()); !ok {
+				t.Fatal("credential is not locked out after the parallel failures")
+			}
+			st, err := store.Get(t.Context(), l.credentials(request())[0].String())
+			if err != nil || st.Failures != 20 {
+				t.Fatalf("counter = %+v, %v, want 20 failures", st, err)
+			}
+		})
+	}
+}
+
+func TestMemoryLockoutStore_Expiration(t *testing.T) {
+	s := newMemoryLockoutStore(2)
+	ctx := t.Context()
+	s.Incr(ctx, "a", time.Millisecond)
+	s.Incr(ctx, "b", time.Hour)
+	time.Sleep(5 * time.Millisecond)
+	if st, _ := s.Get(ctx, "a"); st.Failures != 0 {
+		t.Fatalf("expired counter = %+v", st)
+	}
+	s.Incr(ctx, "a", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	// the expired counters are removed when the store is full
+	if _, err := s.Incr(ctx, "c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Incr(ctx, "d", time.Hour); err == nil {
+		t.Fatal("full store accepts the new counter")
+	}
+	// the lockout keeps the counter until the lockout end
+	if err := s.Lock(ctx, "b", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := s.Get(ctx, "b"); st.Failures != 1 || st.LockedUntil.Before(time.Now()) {
+		t.Fatalf("locked counter = %+v", st)
+	}
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/hugr-lab/hugr/pkg/auth/oauth"
+)
+
+// DefaultLoginURL is the path of the browser login endpoint.
+const DefaultLoginURL = "/auth/login"
+
+// LoginConfig configures the browser login by the default OIDC provider: the authorization code flow
+// with PKCE, the tokens are kept in the encrypted HttpOnly session cookie and refreshed transparently.
+type LoginConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// CookieName is the name of the session cookie (default hugr_session)
+	CookieName string `json:"cookie_name" yaml:"cookie_name"`
+	// SessionTTL is the maximum session lifetime since the login (default 12h)
+	SessionTTL time.Duration `json:"session_ttl" yaml:"session_ttl"`
+}
+
+// LoginEnabled returns true if the browser login is enabled and the default OIDC provider is configured.
+func (c *Config) LoginEnabled() bool {
+	return c.Login.Enabled && c.OIDC.Issuer != ""
+}
+
+// OAuthLoginConfig returns the browser login endpoints config.
+func (c *Config) OAuthLoginConfig() oauth.LoginConfig {
+	return oauth.LoginConfig{
+		CookieName:  c.Login.CookieName,
+		SessionTTL:  c.Login.SessionTTL,
+		RedirectURL: c.RedirectUrl,
+	}
+}
@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+// The managed API keys are stored in the core.api_keys table as the salted SHA-256 hashes:
+//
+//	sha256$<salt>$<hex(sha256(salt + key))>
+//
+// and are looked up by the short key prefix stored in the key_prefix column.
+// The keys are random high-entropy values, so the fast hash is enough and keeps the check cheap.
+const (
+	apiKeyHashScheme  = "sha256"
+	apiKeyPrefixLen   = 8
+	apiKeyRandomBytes = 32
+
+	managedAPIKeysCacheTTL = time.Minute
+
+	defaultAPIKeysUsageFlushInterval  = time.Minute
+	defaultAPIKeysRotationGracePeriod = 24 * time.Hour
+)
+
+// ManagedAPIKeysConfig configures the lifecycle of the managed API keys.
+type ManagedAPIKeysConfig struct {
+	// UsageFlushInterval is the interval to write the keys last usage time and IP to the CoreDB (default 1m)
+	UsageFlushInterval time.Duration `json:"usage_flush_interval" yaml:"usage_flush_interval"`
+	// InactiveAfter is the period after that the unused keys are reported as inactive, 0 - disabled
+	InactiveAfter time.Duration `json:"inactive_after" yaml:"inactive_after"`
+	// ExpireInactive expires the inactive keys automatically
+	ExpireInactive bool `json:"expire_inactive" yaml:"expire_inactive"`
+	// RotationGracePeriod is the default period the previous key is valid after the rotation (default 24h)
+	RotationGracePeriod time.Duration `json:"rotation_grace_period" yaml:"rotation_grace_period"`
+}
+
+// FlushInterval returns the interval to write the keys usage.
+func (c ManagedAPIKeysConfig) FlushInterval() time.Duration {
+	if c.UsageFlushInterval <= 0 {
+		return defaultAPIKeysUsageFlushInterval
+	}
+	return c.UsageFlushInterval
+}
+
+// GracePeriod returns the default rotation grace period.
+func (c ManagedAPIKeysConfig) GracePeriod() time.Duration {
+	if c.RotationGracePeriod <= 0 {
+		return defaultAPIKeysRotationGracePeriod
+	}
+	return c.RotationGracePeriod
+}
+
+// ErrAPIKeyNotFound is returned by the managed API keys store if no key matches.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// GenerateAPIKey returns the new random API key.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, apiKeyRandomBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// APIKeyPrefix returns the lookup prefix of the key, at most the half of the short keys is stored.
+func APIKeyPrefix(key string) string {
+	return key[:min(apiKeyPrefixLen, len(key)/2)]
+}
+
+// HashAPIKey returns the salted hash of the key.
+func HashAPIKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	s := hex.EncodeToString(salt)
+	return apiKeyHashScheme + "$" + s + "$" + apiKeyDigest(s, key), nil
+}
+
+// IsHashedAPIKey returns true if the value is the API key hash produced by HashAPIKey.
+func IsHashedAPIKey(value string) bool {
+	parts := strings.Split(value, "$")
+	return len(parts) == 3 && parts[0] == apiKeyHashScheme && parts[1] != "" && len(parts[2]) == sha256.Size*2
+}
+
+// VerifyAPIKey checks the key against the hash produced by HashAPIKey.
+func VerifyAPIKey(hash, key string) bool {
+	if !IsHashedAPIKey(hash) {
+		return false
+	}
+	parts := strings.Split(hash, "$")
+	return subtle.ConstantTimeCompare([]byte(apiKeyDigest(parts[1], key)), []byte(parts[2])) == 1
+}
+
+func apiKeyDigest(salt, key string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ManagedAPIKey is the API key stored in the CoreDB.
+type ManagedAPIKey struct {
+	Name        string
+	DefaultRole string
+	Disabled    bool
+	IsTemporal  bool
+	ExpiresAt   time.Time
+	// Headers are the request headers to read the role, user id and user name
+	Headers auth.UserAuthInfoConfig
+	// Claims are the key claims, the role, user_id and user_name claims set the static identity
+	Claims map[string]any
+	// Scope limits the requests made with the key
+	Scope APIKeyScope
+	// Previous is true if the key is replaced by the rotation and is valid until GraceExpiresAt
+	Previous       bool
+	GraceExpiresAt time.Time
+}
+
+// APIKeyUsage is the last usage of the managed API key.
+type APIKeyUsage struct {
+	Name       string
+	LastUsedAt time.Time
+	LastUsedIP string
+}
+
+// ManagedAPIKeyStore finds the managed API key by its value.
+type ManagedAPIKeyStore interface {
+	FindAPIKey(ctx context.Context, key string) (*ManagedAPIKey, error)
+}
+
+// ManagedAPIKeyProvider authenticates the requests by the API keys stored in the CoreDB (x-hugr-api-key header),
+// it replaces the engine provider that looks up the plaintext keys.
+// The keys store is set when the CoreDB is attached, the requests are rejected until that.
+type ManagedAPIKeyProvider struct {
+	Config ManagedAPIKeysConfig
+
+	name   string
+	header string
+
+	mu    sync.RWMutex
+	store ManagedAPIKeyStore
+
+	cache *tokenCache[*ManagedAPIKey]
+
+	usageMu sync.Mutex
+	usage   map[string]APIKeyUsage
+}
+
+func NewManagedAPIKeyProvider(name, header string, c ManagedAPIKeysConfig) *ManagedAPIKeyProvider {
+	if header == "" {
+		header = "x-hugr-api-key"
+	}
+	return &ManagedAPIKeyProvider{
+		Config: c,
+		name:   name,
+		header: header,
+		cache:  newTokenCache[*ManagedAPIKey](name, 1000, managedAPIKeysCacheTTL),
+		usage:  make(map[string]APIKeyUsage),
+	}
+}
+
+func (p *ManagedAPIKeyProvider) Name() string {
+	return p.name
+}
+
+func (p *ManagedAPIKeyProvider) Type() string {
+	return "db-api-key"
+}
+
+// SetStore sets the keys store and drops the cached keys.
+func (p *ManagedAPIKeyProvider) SetStore(s ManagedAPIKeyStore) {
+	p.mu.Lock()
+	p.store = s
+	p.mu.Unlock()
+	p.cache.purge()
+}
+
+// Purge drops the cached keys, e.g. after the keys are changed.
+func (p *ManagedAPIKeyProvider) Purge() {
+	p.cache.purge()
+}
+
+// TakeUsage returns the keys usage collected since the previous call, it is written to the CoreDB in batches.
+func (p *ManagedAPIKeyProvider) TakeUsage() []APIKeyUsage {
+	p.usageMu.Lock()
+	defer p.usageMu.Unlock()
+	if len(p.usage) == 0 {
+		return nil
+	}
+	usage := make([]APIKeyUsage, 0, len(p.usage))
+	for _, u := range p.usage {
+		usage = append(usage, u)
+	}
+	p.usage = make(map[string]APIKeyUsage)
+	return usage
+}
+
+func (p *ManagedAPIKeyProvider) recordUsage(name, ip string) {
+	p.usageMu.Lock()
+	p.usage[name] = APIKeyUsage{Name: name, LastUsedAt: time.Now(), LastUsedIP: ip}
+	p.usageMu.Unlock()
+}
+
+func (p *ManagedAPIKeyProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
+	key := r.Header.Get(p.header)
+	if key == "" {
+		return nil, auth.ErrSkipAuth
+	}
+	cacheKey := sha256.Sum256([]byte(key))
+	k, ok := p.cache.get(cacheKey)
+	if !ok {
+		p.mu.RLock()
+		store := p.store
+		p.mu.RUnlock()
+		if store == nil {
+			return nil, ErrProviderUnavailable
+		}
+		var err error
+		k, err = store.FindAPIKey(auth.ContextWithFullAccess(r.Context()), key)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			// the key can be one of the static API keys
+			return nil, auth.ErrInvalidKeyType
+		}
+		if err != nil {
+			log.Printf("Auth: %s: api key lookup error: %v", p.name, err)
+			return nil, ErrProviderUnavailable
+		}
+		p.cache.add(cacheKey, k, time.Time{})
+	}
+	if k.Disabled {
+		return nil, auth.ErrForbidden
+	}
+	if k.IsTemporal && (k.ExpiresAt.IsZero() || !k.ExpiresAt.After(time.Now())) {
+		return nil, auth.ErrForbidden
+	}
+	if k.Previous && !k.GraceExpiresAt.After(time.Now()) {
+		return nil, auth.ErrForbidden
+	}
+	if err := k.Scope.Check(r); err != nil {
+		log.Printf("Auth: %s: request with the api key %q is out of the key scope: %v", p.name, k.Name, err)
+		return nil, auth.ErrForbidden
+	}
+	p.recordUsage(k.Name, clientIP(r))
+
+	role := k.DefaultRole
+	if k.Headers.Role != "" {
+		if hr := r.Header.Get(k.Headers.Role); hr != "" {
+			role = hr
+		}
+	}
+	userId, userName := "", ""
+	if k.Headers.UserId != "" {
+		userId = r.Header.Get(k.Headers.UserId)
+	}
+	if k.Headers.UserName != "" {
+		userName = r.Header.Get(k.Headers.UserName)
+	}
+	if s, _ := k.Claims["role"].(string); s != "" {
+		role = s
+	}
+	if s, _ := k.Claims["user_id"].(string); s != "" {
+		userId = s
+	}
+	if s, _ := k.Claims["user_name"].(string); s != "" {
+		userName = s
+	}
+	if userId == "" {
+		userId = "anonymous"
+	}
+	if userName == "" {
+		userName = "anonymous"
+	}
+	return &auth.AuthInfo{
+		UserId:       userId,
+		UserName:     userName,
+		Role:         role,
+		AuthType:     "db-api-key",
+		AuthProvider: p.name,
+		Claims:       auth.ScalarClaims(k.Claims),
+	}, nil
+}
+
+// ConfiguredManagedAPIKeys returns the managed API keys provider, nil if the managed API keys are disabled.
+func ConfiguredManagedAPIKeys(c *auth.Config) *ManagedAPIKeyProvider {
+	if c == nil {
+		return nil
+	}
+	for _, p := range c.Providers {
+		if mp, ok := unwrapProvider(p).(*ManagedAPIKeyProvider); ok {
+			return mp
+		}
+	}
+	return nil
+}
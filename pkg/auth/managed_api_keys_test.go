@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestHashAPIKey(t *testing.T) {
+	key, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, err := HashAPIKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, _ := HashAPIKey(key)
+	if h1 == h2 {
+		t.Error("hashes of the same key must be salted")
+	}
+	if strings.Contains(h1, key) || !IsHashedAPIKey(h1) {
+		t.Errorf("unexpected hash %q", h1)
+	}
+	if !VerifyAPIKey(h1, key) || !VerifyAPIKey(h2, key) {
+		t.Error("key is not verified")
+	}
+	if VerifyAPIKey(h1, key+"x") || VerifyAPIKey(key, key) {
+		t.Error("wrong key is verified")
+	}
+	if p := APIKeyPrefix(key); len(p) != 8 || !strings.HasPrefix(key, p) {
+		t.Errorf("prefix = %q", p)
+	}
+	if p := APIKeyPrefix("short"); p != "sh" {
+		t.Errorf("short key prefix = %q, want the half of the key", p)
+	}
+}
+
+type testAPIKeyStore struct {
+	keys    map[string]*ManagedAPIKey
+	lookups int
+}
+
+func (s *testAPIKeyStore) FindAPIKey(_ context.Context, key string) (*ManagedAPIKey, error) {
+	s.lookups++
+	k, ok := s.keys[key]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return k, nil
+}
+
+func TestManagedAPIKeyProvider(t *testing.T) {
+	p := NewManagedAPIKeyProvider("managed-api-keys", "", ManagedAPIKeysConfig{})
+	authenticate := func(key string, headers map[string]string) (*auth.AuthInfo, error) {
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		if key != "" {
+			r.Header.Set("x-hugr-api-key", key)
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return p.Authenticate(r)
+	}
+
+	if _, err := authenticate("", nil); !errors.Is(err, auth.ErrSkipAuth) {
+		t.Errorf("no key: err = %v, want ErrSkipAuth", err)
+	}
+	if _, err := authenticate("key-1", nil); !errors.Is(err, ErrProviderUnavailable) {
+		t.Errorf("no store: err = %v, want ErrProviderUnavailable", err)
+	}
+
+	store := &testAPIKeyStore{keys: map[string]*ManagedAPIKey{
+		"key-1": {
+			Name: "etl", DefaultRole: "loader",
+			Headers: auth.UserAuthInfoConfig{Role: "x-hugr-role"},
+			Claims:  map[string]any{"user_id": "etl-service", "tenant": "acme"},
+		},
+		"key-2":       {Name: "old", DefaultRole: "user", IsTemporal: true, ExpiresAt: time.Now().Add(-time.Minute)},
+		"key-3":       {Name: "off", DefaultRole: "user", Disabled: true},
+		"key-tmp":     {Name: "tmp", DefaultRole: "user", IsTemporal: true, ExpiresAt: time.Now().Add(time.Hour)},
+		"key-grace":   {Name: "grace", DefaultRole: "user", Previous: true, GraceExpiresAt: time.Now().Add(time.Hour)},
+		"key-rotated": {Name: "rotated", DefaultRole: "user", Previous: true, GraceExpiresAt: time.Now().Add(-time.Second)},
+		"key-scoped":  {Name: "scoped", DefaultRole: "user", Scope: APIKeyScope{Modules: []string{"sales"}}},
+	}}
+	p.SetStore(store)
+
+	for range 2 { // the second request is served from the cache
+		info, err := authenticate("key-1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Role != "loader" || info.UserId != "etl-service" || info.UserName != "anonymous" ||
+			info.Claims["tenant"] != "acme" || info.AuthProvider != "managed-api-keys" {
+			t.Errorf("unexpected auth info: %+v", info)
+		}
+	}
+	if store.lookups != 1 {
+		t.Errorf("lookups = %d, want 1", store.lookups)
+	}
+	if info, err := authenticate("key-1", map[string]string{"x-hugr-role": "admin"}); err != nil || info.Role != "admin" {
+		t.Errorf("role header: %+v, %v", info, err)
+	}
+	if _, err := authenticate("key-tmp", nil); err != nil {
+		t.Errorf("temporal key: %v", err)
+	}
+	if _, err := authenticate("unknown", nil); !errors.Is(err, auth.ErrInvalidKeyType) {
+		t.Errorf("unknown key: err = %v, want ErrInvalidKeyType", err)
+	}
+	for _, key := range []string{"key-2", "key-3", "key-rotated", "key-scoped"} {
+		if _, err := authenticate(key, nil); !errors.Is(err, auth.ErrForbidden) {
+			t.Errorf("%s: err = %v, want ErrForbidden", key, err)
+		}
+	}
+	if _, err := authenticate("key-grace", nil); err != nil {
+		t.Errorf("previous key in the grace period: %v", err)
+	}
+
+	usage := p.TakeUsage()
+	if len(usage) != 3 {
+		t.Fatalf("usage = %+v, want etl, tmp and grace keys", usage)
+	}
+	for _, u := range usage {
+		if u.LastUsedIP != "192.0.2.1" || u.LastUsedAt.IsZero() {
+			t.Errorf("unexpected usage: %+v", u)
+		}
+	}
+	if usage := p.TakeUsage(); len(usage) != 0 {
+		t.Errorf("usage is not reset: %+v", usage)
+	}
+}
+
+func TestConfigure_ManagedAPIKeys(t *testing.T) {
+	c := &Config{ManagementApiKeys: true}
+	ac, err := c.Configure(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.DBApiKeysEnabled {
+		t.Error("engine managed api keys provider must be replaced")
+	}
+	if ConfiguredManagedAPIKeys(ac) == nil || unwrapProvider(ac.Providers[0]) != ConfiguredManagedAPIKeys(ac) {
+		t.Error("managed api keys provider must go first")
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// The auth providers metrics, registered by RegisterMetrics.
+var (
+	jwksRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hugr_auth_jwks_refreshes_total",
+		Help: "Number of the local JWKS key set loads by the OIDC provider and result (success, error).",
+	}, []string{"provider", "result"})
+	jwksKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hugr_auth_jwks_keys",
+		Help: "Number of keys in the local JWKS key set of the OIDC provider.",
+	}, []string{"provider"})
+	jwksUnknownKid = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hugr_auth_jwks_unknown_kid_total",
+		Help: "Number of tokens signed by the key (kid) that is not in the local JWKS key set of the OIDC provider.",
+	}, []string{"provider"})
+	tokenCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hugr_auth_token_cache_requests_total",
+		Help: "Number of the verified tokens cache lookups by the provider and result (hit, miss).",
+	}, []string{"provider", "result"})
+	tokenCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hugr_auth_token_cache_evictions_total",
+		Help: "Number of the verified tokens evicted from the full cache by the provider.",
+	}, []string{"provider"})
+	tokenCacheEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hugr_auth_token_cache_entries",
+		Help: "Number of the verified tokens in the cache by the provider.",
+	}, []string{"provider"})
+	auditDroppedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hugr_auth_audit_dropped_events_total",
+		Help: "Number of the auth audit events dropped because the buffer is full or the sink write failed.",
+	})
+	lockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hugr_auth_lockouts_total",
+		Help: "Number of the client IP and credential lockouts after the repeated authentication failures by the scope (ip, credential).",
+	}, []string{"scope"})
+	lockedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hugr_auth_locked_requests_total",
+		Help: "Number of the requests rejected with 429 because the client IP or the credential is locked out by the scope (ip, credential).",
+	}, []string{"scope"})
+)
+
+// RegisterMetrics registers the auth providers metrics.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		jwksRefreshes, jwksKeys, jwksUnknownKid,
+		tokenCacheRequests, tokenCacheEvictions, tokenCacheEntries,
+		auditDroppedEvents,
+		lockouts, lockedRequests,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
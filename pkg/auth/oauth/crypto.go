@@ -35,6 +35,27 @@ type AuthCodePayload struct {
 	Timestamp    int64  `json:"timestamp"`
 }
 
+// LoginStatePayload is encrypted into the OAuth state parameter of the browser login.
+// Carried from /auth/login → OIDC provider → /auth/callback.
+type LoginStatePayload struct {
+	// Nonce binds the state to the browser, it is kept in the login cookie as well
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	ReturnTo     string `json:"return_to"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// SessionPayload is encrypted into the session cookie of the browser login.
+type SessionPayload struct {
+	IDToken      string `json:"id_token,omitempty"`
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// Expiry is the expiration time of the token sent to the auth providers
+	Expiry int64 `json:"expiry"`
+	// Timestamp is the login time, the session ends after the session TTL
+	Timestamp int64 `json:"timestamp"`
+}
+
 // deriveKey derives a 32-byte AES-256 key from an arbitrary secret string.
 func deriveKey(secret string) []byte {
 	h := sha256.Sum256([]byte(secret))
@@ -133,3 +154,33 @@ func decryptAuthCode(key []byte, encoded string, ttl time.Duration) (*AuthCodePa
 	}
 	return &a, nil
 }
+
+// encryptLoginState encrypts a LoginStatePayload, setting the timestamp to now.
+func encryptLoginState(key []byte, s LoginStatePayload) (string, error) {
+	s.Timestamp = time.Now().Unix()
+	return encrypt(key, s)
+}
+
+// decryptLoginState decrypts and validates a LoginStatePayload with TTL check.
+func decryptLoginState(key []byte, encoded string, ttl time.Duration) (*LoginStatePayload, error) {
+	var s LoginStatePayload
+	if err := decrypt(key, encoded, &s); err != nil {
+		return nil, err
+	}
+	if time.Since(time.Unix(s.Timestamp, 0)) > ttl {
+		return nil, fmt.Errorf("state expired")
+	}
+	return &s, nil
+}
+
+// decryptSession decrypts and validates a SessionPayload, the session ends after the TTL since the login.
+func decryptSession(key []byte, encoded string, ttl time.Duration) (*SessionPayload, error) {
+	var s SessionPayload
+	if err := decrypt(key, encoded, &s); err != nil {
+		return nil, err
+	}
+	if time.Since(time.Unix(s.Timestamp, 0)) > ttl {
+		return nil, fmt.Errorf("session expired")
+	}
+	return &s, nil
+}
@@ -0,0 +1,466 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultSessionCookie = "hugr_session"
+	defaultSessionTTL    = 12 * time.Hour
+	// loginCookieSuffix is the suffix of the cookie that binds the login state to the browser
+	loginCookieSuffix = "_login"
+	// sessionRefreshBefore is the time before the token expiration to refresh the session
+	sessionRefreshBefore = time.Minute
+	// refreshedSessionTTL is the time the refreshed session is reused for the parallel requests
+	refreshedSessionTTL = 30 * time.Second
+	// maxCookieSize is the size of the cookie value chunk, the browsers limit the cookie by 4KB
+	maxCookieSize   = 3800
+	maxCookieChunks = 5
+)
+
+// LoginConfig configures the browser login (the /auth/login, /auth/callback and /auth/logout endpoints).
+type LoginConfig struct {
+	// CookieName is the name of the encrypted session cookie (default hugr_session)
+	CookieName string
+	// SessionTTL is the maximum session lifetime since the login (default 12h), the tokens are refreshed until it ends
+	SessionTTL time.Duration
+	// RedirectURL is the page to return to after the login and logout if the request doesn't set it (default /)
+	RedirectURL string
+}
+
+func (c LoginConfig) cookieName() string {
+	if c.CookieName == "" {
+		return defaultSessionCookie
+	}
+	return c.CookieName
+}
+
+func (c LoginConfig) sessionTTL() time.Duration {
+	if c.SessionTTL <= 0 {
+		return defaultSessionTTL
+	}
+	return c.SessionTTL
+}
+
+type refreshedSession struct {
+	session *SessionPayload
+	at      time.Time
+}
+
+// RegisterLoginHandlers registers the browser login endpoints on the mux. The session cookie is read
+// by the SessionMiddleware.
+func (p *Proxy) RegisterLoginHandlers(mux *http.ServeMux, c LoginConfig) {
+	p.login = c
+	mux.HandleFunc("GET /auth/login", p.handleLogin)
+	mux.HandleFunc("GET /auth/callback", p.handleLoginCallback)
+	// the logout is accepted only by the same origin POST, so other sites can't log the user out
+	mux.Handle("POST /auth/logout", http.NewCrossOriginProtection().Handler(http.HandlerFunc(p.handleLogout)))
+}
+
+// loginCallbackURL returns the browser login callback URL for Hugr.
+func loginCallbackURL(r *http.Request) string {
+	return baseURL(r) + "/auth/callback"
+}
+
+// returnTo returns the page to return to after the login or logout: the path of the server,
+// the URL of the server or the URL under the configured redirect URL.
+func (p *Proxy) returnTo(r *http.Request, target string) string {
+	def := p.login.RedirectURL
+	if def == "" {
+		def = "/"
+	}
+	if target == "" {
+		return def
+	}
+	u, err := url.Parse(target)
+	if err != nil || strings.ContainsAny(target, "\\\r\n") {
+		return def
+	}
+	if u.Scheme == "" && u.Host == "" {
+		if strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(target, "//") {
+			return target
+		}
+		return def
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return def
+	}
+	if u.Host == r.Host {
+		return target
+	}
+	if base, err := url.Parse(p.login.RedirectURL); err == nil && base.Host != "" &&
+		base.Scheme == u.Scheme && base.Host == u.Host && strings.HasPrefix(u.Path, base.Path) {
+		return target
+	}
+	return def
+}
+
+func (p *Proxy) setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setSession sets the encrypted session cookie, the value is split into several cookies
+// (<name>, <name>_1, ...) if it exceeds the cookie size limit. The previous chunks are removed.
+func (p *Proxy) setSession(w http.ResponseWriter, r *http.Request, s *SessionPayload) error {
+	value, err := encrypt(p.key, s)
+	if err != nil {
+		return err
+	}
+	name := p.login.cookieName()
+	maxAge := int(time.Until(time.Unix(s.Timestamp, 0).Add(p.login.sessionTTL())).Seconds())
+	n := 0
+	for ; value != "" || n == 0; n++ {
+		if n == maxCookieChunks {
+			return errors.New("session cookie is too large")
+		}
+		chunk := value[:min(len(value), maxCookieSize)]
+		value = value[len(chunk):]
+		p.setCookie(w, r, sessionCookieName(name, n), chunk, maxAge)
+	}
+	for ; n < maxCookieChunks; n++ {
+		if _, err := r.Cookie(sessionCookieName(name, n)); err == nil {
+			p.setCookie(w, r, sessionCookieName(name, n), "", -1)
+		}
+	}
+	return nil
+}
+
+func sessionCookieName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	return name + "_" + strconv.Itoa(n)
+}
+
+// sessionCookie returns the encrypted session joined from the cookie chunks.
+func (p *Proxy) sessionCookie(r *http.Request) string {
+	name := p.login.cookieName()
+	var b strings.Builder
+	for n := range maxCookieChunks {
+		c, err := r.Cookie(sessionCookieName(name, n))
+		if err != nil {
+			break
+		}
+		b.WriteString(c.Value)
+	}
+	return b.String()
+}
+
+func (p *Proxy) clearSession(w http.ResponseWriter, r *http.Request) {
+	name := p.login.cookieName()
+	for n := range maxCookieChunks {
+		if _, err := r.Cookie(sessionCookieName(name, n)); err == nil {
+			p.setCookie(w, r, sessionCookieName(name, n), "", -1)
+		}
+	}
+}
+
+// handleLogin starts the authorization code flow with PKCE: the code verifier is encrypted
+// into the state, the state is bound to the browser by the login cookie.
+func (p *Proxy) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if p.unavailable(w) {
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	verifier := generateCodeVerifier()
+	state, err := encryptLoginState(p.key, LoginStatePayload{
+		Nonce:        hex.EncodeToString(nonce),
+		CodeVerifier: verifier,
+		ReturnTo:     p.returnTo(r, r.URL.Query().Get("redirect_uri")),
+	})
+	if err != nil {
+		log.Printf("oauth: encrypt login state error: %v", err)
+		http.Error(w, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	p.setCookie(w, r, p.login.cookieName()+loginCookieSuffix, hex.EncodeToString(nonce), int(stateTTL.Seconds()))
+
+	cfg := p.oauth2Config
+	cfg.RedirectURL = loginCallbackURL(r)
+	http.Redirect(w, r, cfg.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", codeChallengeS256(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), http.StatusFound)
+}
+
+// handleLoginCallback exchanges the code for the tokens, stores them in the session cookie
+// and returns to the page the login was started from.
+func (p *Proxy) handleLoginCallback(w http.ResponseWriter, r *http.Request) {
+	if p.unavailable(w) {
+		return
+	}
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		log.Printf("oauth: login: OIDC provider error: %s: %s", errCode, q.Get("error_description"))
+		http.Error(w, "login failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+	code, encryptedState := q.Get("code"), q.Get("state")
+	if code == "" || encryptedState == "" {
+		http.Error(w, "missing code or state", http.StatusBadRequest)
+		return
+	}
+	state, err := decryptLoginState(p.key, encryptedState, stateTTL)
+	if err != nil {
+		log.Printf("oauth: login: decrypt state error: %v", err)
+		http.Error(w, "invalid or expired state", http.StatusBadRequest)
+		return
+	}
+	loginCookie := p.login.cookieName() + loginCookieSuffix
+	if c, err := r.Cookie(loginCookie); err != nil || c.Value != state.Nonce {
+		http.Error(w, "login state doesn't match the browser", http.StatusBadRequest)
+		return
+	}
+	p.setCookie(w, r, loginCookie, "", -1)
+
+	cfg := p.oauth2Config
+	cfg.RedirectURL = loginCallbackURL(r)
+	token, err := cfg.Exchange(p.clientContext(r.Context()), code, oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier))
+	if err != nil {
+		log.Printf("oauth: login: token exchange error: %v", err)
+		http.Error(w, "failed to exchange authorization code with OIDC provider", http.StatusBadGateway)
+		return
+	}
+	s := sessionFromToken(token, nil)
+	s.Timestamp = time.Now().Unix()
+	if err := p.setSession(w, r, s); err != nil {
+		log.Printf("oauth: login: set session error: %v", err)
+		http.Error(w, "failed to process request", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// handleLogout removes the session cookie, revokes the refresh token and ends the session
+// of the OIDC provider if it supports the RP-initiated logout.
+func (p *Proxy) handleLogout(w http.ResponseWriter, r *http.Request) {
+	returnTo := p.returnTo(r, r.URL.Query().Get("redirect_uri"))
+	var s *SessionPayload
+	if v := p.sessionCookie(r); v != "" {
+		s, _ = decryptSession(p.key, v, p.login.sessionTTL())
+	}
+	p.clearSession(w, r)
+	if s == nil || p.pending.Load() {
+		http.Redirect(w, r, returnTo, http.StatusFound)
+		return
+	}
+	if s.RefreshToken != "" && p.revocationURL != "" {
+		resp, err := p.httpClient.PostForm(p.revocationURL, url.Values{
+			"token":           {s.RefreshToken},
+			"token_type_hint": {"refresh_token"},
+			"client_id":       {p.oauth2Config.ClientID},
+			"client_secret":   {p.oauth2Config.ClientSecret},
+		})
+		if err != nil {
+			log.Printf("oauth: logout: revoke token error: %v", err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+	if p.endSessionURL == "" {
+		http.Redirect(w, r, returnTo, http.StatusFound)
+		return
+	}
+	u, err := url.Parse(p.endSessionURL)
+	if err != nil {
+		http.Redirect(w, r, returnTo, http.StatusFound)
+		return
+	}
+	if strings.HasPrefix(returnTo, "/") {
+		returnTo = baseURL(r) + returnTo
+	}
+	eq := u.Query()
+	eq.Set("client_id", p.oauth2Config.ClientID)
+	eq.Set("post_logout_redirect_uri", returnTo)
+	if s.IDToken != "" {
+		eq.Set("id_token_hint", s.IDToken)
+	}
+	u.RawQuery = eq.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// SessionMiddleware authenticates the requests by the session cookie of the browser login:
+// the token of the session is set as the bearer token of the request, so it is verified
+// by the OIDC auth provider. The session is refreshed before the token expires, the requests
+// with their own Authorization header are passed as is.
+//
+// The browser sends the cookie with the requests of other sites as well, so the cookie is used
+// only for the state-changing requests (and the websocket handshakes) of the same origin,
+// and the GraphQL queries of the GET requests are run without the mutations.
+func (p *Proxy) SessionMiddleware(next http.Handler) http.Handler {
+	cop := http.NewCrossOriginProtection()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := cop.Check(stateChanging(r)); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v := p.sessionCookie(r)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s, err := decryptSession(p.key, v, p.login.sessionTTL())
+		if err != nil {
+			p.clearSession(w, r)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if time.Until(time.Unix(s.Expiry, 0)) < sessionRefreshBefore {
+			rs, err := p.refreshSession(r.Context(), s)
+			if err != nil {
+				if time.Now().After(time.Unix(s.Expiry, 0)) {
+					log.Printf("oauth: session refresh error: %v", err)
+					p.clearSession(w, r)
+					next.ServeHTTP(w, r)
+					return
+				}
+			} else {
+				if err := p.setSession(w, r, rs); err != nil {
+					log.Printf("oauth: set session error: %v", err)
+				}
+				s = rs
+			}
+		}
+		token := s.IDToken
+		if token == "" {
+			token = s.AccessToken
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+token)
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			// the links and the images of other sites must not run the mutations by the session
+			q := r.URL.Query()
+			if q.Has("query") {
+				q.Set("no_mutation", "true")
+				r.URL.RawQuery = q.Encode()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stateChanging returns the request to check by the cross-origin protection:
+// the websocket handshake is GET, but it is checked as the state-changing request.
+func stateChanging(r *http.Request) *http.Request {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return r
+	}
+	rc := *r
+	rc.Method = http.MethodPost
+	return &rc
+}
+
+// refreshSession refreshes the session tokens, the result is reused for the parallel requests
+// with the same session.
+func (p *Proxy) refreshSession(ctx context.Context, s *SessionPayload) (*SessionPayload, error) {
+	if s.RefreshToken == "" {
+		return nil, errors.New("session has no refresh token")
+	}
+	if p.pending.Load() {
+		return nil, ErrProviderUnavailable
+	}
+	key := sha256.Sum256([]byte(s.RefreshToken))
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	now := time.Now()
+	for k, rs := range p.refreshed {
+		if now.Sub(rs.at) > refreshedSessionTTL {
+			delete(p.refreshed, k)
+		}
+	}
+	if rs, ok := p.refreshed[key]; ok {
+		return rs.session, nil
+	}
+	ts := p.oauth2Config.TokenSource(p.clientContext(ctx), &oauth2.Token{
+		RefreshToken: s.RefreshToken,
+		Expiry:       time.Unix(1, 0),
+	})
+	token, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	rs := sessionFromToken(token, s)
+	rs.Timestamp = s.Timestamp
+	if p.refreshed == nil {
+		p.refreshed = make(map[[32]byte]refreshedSession)
+	}
+	p.refreshed[key] = refreshedSession{session: rs, at: now}
+	return rs, nil
+}
+
+// clientContext returns the context with the HTTP client of the OIDC provider requests.
+func (p *Proxy) clientContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, p.httpClient)
+}
+
+// sessionFromToken builds the session of the token response, the refresh token of the previous
+// session is kept if the response doesn't rotate it. Only the ID token is kept if it is issued,
+// as it is sent to the auth providers, so the cookie is smaller.
+func sessionFromToken(token *oauth2.Token, prev *SessionPayload) *SessionPayload {
+	s := &SessionPayload{RefreshToken: token.RefreshToken}
+	if s.RefreshToken == "" && prev != nil {
+		s.RefreshToken = prev.RefreshToken
+	}
+	expiry := token.Expiry
+	if idToken, _ := token.Extra("id_token").(string); idToken != "" {
+		s.IDToken = idToken
+		if exp, ok := jwtExpiry(idToken); ok {
+			expiry = exp
+		}
+	} else {
+		s.AccessToken = token.AccessToken
+	}
+	if expiry.IsZero() {
+		expiry = time.Now().Add(sessionRefreshBefore)
+	}
+	s.Expiry = expiry.Unix()
+	return s
+}
+
+// jwtExpiry returns the exp claim of the JWT without the verification, the token is verified
+// by the auth providers.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,364 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWT returns the unsigned JWT with the exp claim, the proxy doesn't verify the tokens.
+func testJWT(t *testing.T, sub string, exp time.Time) string {
+	t.Helper()
+	claims, err := json.Marshal(map[string]any{"sub": sub, "exp": exp.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+// loginTestProxy creates the test proxy with the token and revocation endpoints served by the handler.
+func loginTestProxy(t *testing.T, token http.HandlerFunc) (*Proxy, *http.ServeMux) {
+	t.Helper()
+	srv := httptest.NewServer(token)
+	t.Cleanup(srv.Close)
+	p := testProxy(t)
+	p.oauth2Config.Endpoint.TokenURL = srv.URL + "/token"
+	p.revocationURL = srv.URL + "/revoke"
+	p.endSessionURL = "http://oidc.example.com/logout"
+	mux := http.NewServeMux()
+	p.RegisterLoginHandlers(mux, LoginConfig{})
+	return p, mux
+}
+
+func sessionRequest(t *testing.T, p *Proxy, target string, s *SessionPayload) *http.Request {
+	t.Helper()
+	value, err := encrypt(p.key, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", target, nil)
+	req.AddCookie(&http.Cookie{Name: defaultSessionCookie, Value: value})
+	return req
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLogin_Flow(t *testing.T) {
+	idToken := testJWT(t, "alice", time.Now().Add(time.Hour))
+	var form url.Values
+	p, mux := loginTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": "refresh",
+			"id_token":      idToken,
+		})
+	})
+
+	req := httptest.NewRequest("GET", "https://hugr.example.com/auth/login?redirect_uri="+url.QueryEscape("/admin?tab=1"), nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: expected 302, got %d", w.Code)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("login: missing PKCE params: %s", loc)
+	}
+	if q.Get("redirect_uri") != "https://hugr.example.com/auth/callback" {
+		t.Fatalf("login: unexpected redirect_uri: %s", q.Get("redirect_uri"))
+	}
+	loginCookie := responseCookie(w, defaultSessionCookie+loginCookieSuffix)
+	if loginCookie == nil || !loginCookie.HttpOnly || !loginCookie.Secure {
+		t.Fatalf("login: unexpected login cookie: %+v", loginCookie)
+	}
+
+	// the callback without the login cookie of the browser is rejected
+	callback := "https://hugr.example.com/auth/callback?code=idp-code&state=" + url.QueryEscape(q.Get("state"))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", callback, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("callback without login cookie: expected 400, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", callback, nil)
+	req.AddCookie(loginCookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: expected 302, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Location"); got != "/admin?tab=1" {
+		t.Fatalf("callback: unexpected location: %s", got)
+	}
+	if form.Get("code") != "idp-code" || codeChallengeS256(form.Get("code_verifier")) != q.Get("code_challenge") {
+		t.Fatalf("callback: unexpected token request: %v", form)
+	}
+	session := responseCookie(w, defaultSessionCookie)
+	if session == nil || !session.HttpOnly || session.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("callback: unexpected session cookie: %+v", session)
+	}
+
+	// the session is sent to the auth providers as the bearer token
+	var auth string
+	handler := p.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	req = httptest.NewRequest("GET", "https://hugr.example.com/query", nil)
+	req.AddCookie(session)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if auth != "Bearer "+idToken {
+		t.Fatalf("middleware: unexpected Authorization: %q", auth)
+	}
+
+	// the own Authorization header of the request is kept
+	req.Header.Set("Authorization", "Bearer other")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if auth != "Bearer other" {
+		t.Fatalf("middleware: Authorization is overridden: %q", auth)
+	}
+}
+
+func TestSessionMiddleware_Refresh(t *testing.T) {
+	newToken := testJWT(t, "alice", time.Now().Add(time.Hour))
+	var calls atomic.Int32
+	p, _ := loginTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     newToken,
+		})
+	})
+	var auth string
+	handler := p.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	expired := &SessionPayload{
+		IDToken:      testJWT(t, "alice", time.Now().Add(-time.Minute)),
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(-time.Minute).Unix(),
+		Timestamp:    time.Now().Add(-time.Hour).Unix(),
+	}
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, sessionRequest(t, p, "https://hugr.example.com/query", expired))
+		if auth != "Bearer "+newToken {
+			t.Fatalf("unexpected Authorization after refresh: %q", auth)
+		}
+		c := responseCookie(w, defaultSessionCookie)
+		if c == nil {
+			t.Fatal("refreshed session cookie is not set")
+		}
+		s, err := decryptSession(p.key, c.Value, defaultSessionTTL)
+		if err != nil || s.RefreshToken != "refresh" || s.Timestamp != expired.Timestamp {
+			t.Fatalf("unexpected refreshed session: %+v, %v", s, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("the parallel refreshes are not reused: %d token requests", n)
+	}
+
+	// the expired session that can't be refreshed is removed
+	expired.RefreshToken = "revoked"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, sessionRequest(t, p, "https://hugr.example.com/query", expired))
+	if auth != "" {
+		t.Fatalf("unexpected Authorization of the failed refresh: %q", auth)
+	}
+	if c := responseCookie(w, defaultSessionCookie); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("session cookie is not removed: %+v", c)
+	}
+}
+
+func TestSessionMiddleware_CrossSite(t *testing.T) {
+	p, _ := loginTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unexpected token request", http.StatusBadRequest)
+	})
+	token := testJWT(t, "alice", time.Now().Add(time.Hour))
+	session := &SessionPayload{IDToken: token, Expiry: time.Now().Add(time.Hour).Unix(), Timestamp: time.Now().Unix()}
+	var auth string
+	var noMutation bool
+	// the engine runs the GET queries with no_mutation=true without the mutations
+	handler := p.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		noMutation = r.URL.Query().Get("no_mutation") == "true"
+		if auth == "" || noMutation && strings.HasPrefix(r.URL.Query().Get("query"), "mutation") {
+			http.Error(w, "rejected", http.StatusForbidden)
+		}
+	}))
+	request := func(method, target, site string) *httptest.ResponseRecorder {
+		req := sessionRequest(t, p, target, session)
+		req.Method = method
+		if site != "" {
+			req.Header.Set("Sec-Fetch-Site", site)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// the cross-site GET mutation carrying the session cookie is rejected
+	mutation := "https://hugr.example.com/query?no_mutation=false&query=" + url.QueryEscape("mutation { core { delete_roles { success } } }")
+	if w := request("GET", mutation, "cross-site"); w.Code != http.StatusForbidden || !noMutation {
+		t.Fatalf("cross-site GET mutation: code %d, no_mutation %v", w.Code, noMutation)
+	}
+	// the GET queries are authenticated by the session
+	query := "https://hugr.example.com/query?query=" + url.QueryEscape("{ core { roles { name } } }")
+	if w := request("GET", query, "cross-site"); w.Code != http.StatusOK || auth != "Bearer "+token {
+		t.Fatalf("GET query: code %d, Authorization %q", w.Code, auth)
+	}
+	// the cross-site state-changing requests are not authenticated by the session
+	for _, site := range []string{"cross-site", "same-site"} {
+		if w := request("POST", "https://hugr.example.com/query", site); w.Code != http.StatusForbidden || auth != "" {
+			t.Fatalf("%s POST: code %d, Authorization %q", site, w.Code, auth)
+		}
+	}
+	req := sessionRequest(t, p, "https://hugr.example.com/subscribe", session)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "https://evil.example.org")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if auth != "" {
+		t.Fatalf("cross-origin websocket: Authorization %q", auth)
+	}
+	// the same-origin POST is authenticated by the session
+	if w := request("POST", "https://hugr.example.com/query", "same-origin"); w.Code != http.StatusOK || auth != "Bearer "+token || noMutation {
+		t.Fatalf("same-origin POST: code %d, Authorization %q", w.Code, auth)
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	var revoked string
+	p, mux := loginTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		revoked = r.PostForm.Get("token")
+	})
+	idToken := testJWT(t, "alice", time.Now().Add(time.Hour))
+	req := sessionRequest(t, p, "https://hugr.example.com/auth/logout?redirect_uri=/admin", &SessionPayload{
+		IDToken:      idToken,
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour).Unix(),
+		Timestamp:    time.Now().Unix(),
+	})
+	// the logout is accepted by the same origin POST only
+	for name, r := range map[string]*http.Request{
+		"get":        req.Clone(t.Context()),
+		"cross-site": req.Clone(t.Context()),
+	} {
+		if name == "cross-site" {
+			r.Method = http.MethodPost
+			r.Header.Set("Sec-Fetch-Site", "cross-site")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code == http.StatusFound || responseCookie(w, defaultSessionCookie) != nil {
+			t.Fatalf("%s logout is accepted: %d", name, w.Code)
+		}
+	}
+	req.Method = http.MethodPost
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected 302, got %d", w.Code)
+	}
+	if revoked != "refresh" {
+		t.Fatalf("refresh token is not revoked: %q", revoked)
+	}
+	if c := responseCookie(w, defaultSessionCookie); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("session cookie is not removed: %+v", c)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	if loc.Host != "oidc.example.com" || q.Get("id_token_hint") != idToken ||
+		q.Get("post_logout_redirect_uri") != "https://hugr.example.com/admin" {
+		t.Fatalf("unexpected end session redirect: %s", loc)
+	}
+
+	// without the session the browser returns to the page
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "https://hugr.example.com/auth/logout", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("logout without session: %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestReturnTo(t *testing.T) {
+	p := testProxy(t)
+	p.login = LoginConfig{RedirectURL: "https://ui.example.com/app"}
+	r := httptest.NewRequest("GET", "https://hugr.example.com/auth/login", nil)
+	for target, want := range map[string]string{
+		"":                                 "https://ui.example.com/app",
+		"/admin?tab=1":                     "/admin?tab=1",
+		"//evil.example.com/":              "https://ui.example.com/app",
+		"https://hugr.example.com/admin":   "https://hugr.example.com/admin",
+		"https://ui.example.com/app/query": "https://ui.example.com/app/query",
+		"https://evil.example.com/app":     "https://ui.example.com/app",
+		"javascript:alert(1)":              "https://ui.example.com/app",
+		"/\\evil.example.com":              "https://ui.example.com/app",
+	} {
+		if got := p.returnTo(r, target); got != want {
+			t.Errorf("returnTo(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestSessionCookie_Chunks(t *testing.T) {
+	p := testProxy(t)
+	s := &SessionPayload{
+		IDToken:   strings.Repeat("x", 2*maxCookieSize),
+		Expiry:    time.Now().Add(time.Hour).Unix(),
+		Timestamp: time.Now().Unix(),
+	}
+	r := httptest.NewRequest("GET", "https://hugr.example.com/", nil)
+	w := httptest.NewRecorder()
+	if err := p.setSession(w, r, s); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) < 3 {
+		t.Fatalf("expected the session split into 3 cookies, got %d", len(cookies))
+	}
+	r = httptest.NewRequest("GET", "https://hugr.example.com/", nil)
+	for _, c := range cookies {
+		if len(c.Value) > maxCookieSize {
+			t.Fatalf("cookie %s exceeds the size limit: %d", c.Name, len(c.Value))
+		}
+		r.AddCookie(c)
+	}
+	got, err := decryptSession(p.key, p.sessionCookie(r), defaultSessionTTL)
+	if err != nil || got.IDToken != s.IDToken {
+		t.Fatalf("joined session mismatch: %v", err)
+	}
+
+	s.IDToken = strings.Repeat("x", maxCookieChunks*maxCookieSize)
+	if err := p.setSession(httptest.NewRecorder(), r, s); err == nil {
+		t.Fatal("too large session is accepted")
+	}
+}
@@ -1,17 +1,29 @@
 package oauth
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 )
 
+// generateCodeVerifier returns a random PKCE code_verifier (43 chars of base64url).
+func generateCodeVerifier() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// codeChallengeS256 returns the PKCE S256 code_challenge of the code_verifier.
+func codeChallengeS256(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
 // verifyCodeChallenge validates a PKCE S256 code_verifier against a code_challenge.
 // Returns true if SHA256(code_verifier) == code_challenge (base64url-encoded, no padding).
 func verifyCodeChallenge(verifier, challenge string) bool {
 	if verifier == "" || challenge == "" {
 		return false
 	}
-	h := sha256.Sum256([]byte(verifier))
-	computed := base64.RawURLEncoding.EncodeToString(h[:])
-	return computed == challenge
+	return codeChallengeS256(verifier) == challenge
 }
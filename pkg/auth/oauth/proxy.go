@@ -11,9 +11,12 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/hugr-lab/hugr/pkg/auth/discovery"
 	"golang.org/x/oauth2"
 )
 
@@ -40,33 +43,32 @@ type Config struct {
 // to an external OIDC provider. It encrypts all transient state into
 // request/response parameters using AES-GCM.
 type Proxy struct {
-	oauth2Config oauth2.Config
-	oidcProvider *oidc.Provider
+	oauth2Config  oauth2.Config
+	oidcProvider  *oidc.Provider
 	httpClient    *http.Client // used for refresh/revoke proxy
 	key           []byte
 	redirectURL   string // optional override
 	tokenURL      string // OIDC provider's token endpoint (for refresh proxy)
 	revocationURL string // OIDC provider's revocation endpoint (for logout)
+	endSessionURL string // OIDC provider's end session endpoint (for the browser logout)
+
+	// login is the browser login config, set by RegisterLoginHandlers
+	login LoginConfig
+	// refreshed are the recently refreshed sessions, so the parallel requests of the browser
+	// with the same expiring session don't refresh it again
+	refreshMu sync.Mutex
+	refreshed map[[32]byte]refreshedSession
+
+	// pending is set until the OIDC discovery succeeds, the OIDC endpoints are set before it is cleared
+	pending atomic.Bool
 }
 
 // NewProxy creates a new OAuth proxy by performing OIDC discovery.
+// If the OIDC provider is unavailable, the discovery is retried in the background
+// and the proxy endpoints respond with 503 until it succeeds.
 func NewProxy(ctx context.Context, cfg Config) (*Proxy, error) {
 	if cfg.SecretKey == "" {
-		return nil, fmt.Errorf("SECRET_KEY is required for MCP OAuth proxy")
-	}
-
-	oidcCtx := ctx
-	if cfg.TLSInsecure {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		hc := &http.Client{Transport: tr}
-		oidcCtx = oidc.ClientContext(ctx, hc)
-	}
-
-	provider, err := oidc.NewProvider(oidcCtx, cfg.Issuer)
-	if err != nil {
-		return nil, fmt.Errorf("oidc discovery: %w", err)
+		return nil, fmt.Errorf("SECRET_KEY is required for OAuth proxy")
 	}
 
 	scopes := []string{oidc.ScopeOpenID}
@@ -74,15 +76,6 @@ func NewProxy(ctx context.Context, cfg Config) (*Proxy, error) {
 		scopes = strings.Fields(cfg.Scopes)
 	}
 
-	// Extract token and revocation endpoints from provider for proxy
-	var providerClaims struct {
-		TokenEndpoint      string `json:"token_endpoint"`
-		RevocationEndpoint string `json:"revocation_endpoint"`
-	}
-	if err := provider.Claims(&providerClaims); err != nil {
-		return nil, fmt.Errorf("oidc provider claims: %w", err)
-	}
-
 	hc := http.DefaultClient
 	if cfg.TLSInsecure {
 		hc = &http.Client{
@@ -93,23 +86,80 @@ func NewProxy(ctx context.Context, cfg Config) (*Proxy, error) {
 	}
 
 	p := &Proxy{
-		oidcProvider:  provider,
-		httpClient:    hc,
-		key:           deriveKey(cfg.SecretKey),
-		redirectURL:   cfg.RedirectURL,
-		tokenURL:      providerClaims.TokenEndpoint,
-		revocationURL: providerClaims.RevocationEndpoint,
+		httpClient:  hc,
+		key:         deriveKey(cfg.SecretKey),
+		redirectURL: cfg.RedirectURL,
 		oauth2Config: oauth2.Config{
 			ClientID:     cfg.ClientID,
 			ClientSecret: cfg.ClientSecret,
-			Endpoint:     provider.Endpoint(),
 			Scopes:       scopes,
 		},
 	}
 
+	discover := func(ctx context.Context) error {
+		return p.discover(ctx, cfg)
+	}
+	if err := discover(ctx); err != nil {
+		log.Printf("oauth: oidc discovery error: %v, the proxy is unavailable until the discovery succeeds", err)
+		p.pending.Store(true)
+		go discovery.Retry(ctx, "OAuth proxy", discover)
+	}
+
 	return p, nil
 }
 
+// discover performs the OIDC discovery and sets the provider endpoints.
+func (p *Proxy) discover(ctx context.Context, cfg Config) error {
+	oidcCtx := ctx
+	if cfg.TLSInsecure {
+		oidcCtx = oidc.ClientContext(ctx, p.httpClient)
+	}
+
+	provider, err := oidc.NewProvider(oidcCtx, cfg.Issuer)
+	if err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	// Extract token and revocation endpoints from provider for proxy
+	var providerClaims struct {
+		TokenEndpoint      string `json:"token_endpoint"`
+		RevocationEndpoint string `json:"revocation_endpoint"`
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&providerClaims); err != nil {
+		return fmt.Errorf("oidc provider claims: %w", err)
+	}
+
+	p.oidcProvider = provider
+	p.tokenURL = providerClaims.TokenEndpoint
+	p.revocationURL = providerClaims.RevocationEndpoint
+	p.endSessionURL = providerClaims.EndSessionEndpoint
+	p.oauth2Config.Endpoint = provider.Endpoint()
+	p.pending.Store(false)
+	return nil
+}
+
+// ErrProviderUnavailable is returned by Ready until the OIDC discovery succeeds.
+var ErrProviderUnavailable = discovery.ErrProviderUnavailable
+
+// Ready returns ErrProviderUnavailable until the OIDC discovery succeeds.
+func (p *Proxy) Ready() error {
+	if p.pending.Load() {
+		return ErrProviderUnavailable
+	}
+	return nil
+}
+
+// unavailable responds with 503 if the OIDC discovery hasn't succeeded yet.
+func (p *Proxy) unavailable(w http.ResponseWriter) bool {
+	if !p.pending.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "5")
+	oauthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "OIDC provider is unavailable")
+	return true
+}
+
 // RegisterHandlers registers all OAuth proxy endpoints on the mux.
 func (p *Proxy) RegisterHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("GET /.well-known/oauth-authorization-server", p.handleMetadata)
@@ -168,6 +218,9 @@ func (p *Proxy) handleMetadata(w http.ResponseWriter, r *http.Request) {
 // handleAuthorize starts the OAuth flow by encrypting the MCP client's
 // session into the state parameter and redirecting to the OIDC provider.
 func (p *Proxy) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if p.unavailable(w) {
+		return
+	}
 	q := r.URL.Query()
 
 	responseType := q.Get("response_type")
@@ -218,6 +271,9 @@ func (p *Proxy) handleAuthorize(w http.ResponseWriter, r *http.Request) {
 // for tokens, encrypts them into a Hugr authorization code, and redirects
 // back to the MCP client.
 func (p *Proxy) handleCallback(w http.ResponseWriter, r *http.Request) {
+	if p.unavailable(w) {
+		return
+	}
 	q := r.URL.Query()
 
 	if errCode := q.Get("error"); errCode != "" {
@@ -355,6 +411,9 @@ func (p *Proxy) handleTokenAuthorizationCode(w http.ResponseWriter, r *http.Requ
 }
 
 func (p *Proxy) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if p.unavailable(w) {
+		return
+	}
 	refreshToken := r.FormValue("refresh_token")
 	if refreshToken == "" {
 		oauthError(w, http.StatusBadRequest, "invalid_request", "missing refresh_token")
@@ -391,6 +450,9 @@ func (p *Proxy) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
 
 // handleRevoke proxies a token revocation request (RFC 7009) to the OIDC provider.
 func (p *Proxy) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if p.unavailable(w) {
+		return
+	}
 	if p.revocationURL == "" {
 		oauthError(w, http.StatusBadRequest, "unsupported_operation", "OIDC provider does not support token revocation")
 		return
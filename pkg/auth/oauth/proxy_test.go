@@ -1,6 +1,7 @@
 package oauth
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -497,3 +498,33 @@ func TestIsValidRedirectURI(t *testing.T) {
 	}
 }
 
+
+func TestNewProxy_OIDCUnavailable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	p, err := NewProxy(ctx, Config{
+		Issuer:    srv.URL,
+		ClientID:  "hugr-client",
+		SecretKey: "test-secret-key-32-chars-minimum",
+	})
+	if err != nil {
+		t.Fatalf("NewProxy: %v", err)
+	}
+	if err := p.Ready(); err != ErrProviderUnavailable {
+		t.Fatalf("Ready = %v, want ErrProviderUnavailable", err)
+	}
+
+	mux := http.NewServeMux()
+	p.RegisterHandlers(mux)
+	req := httptest.NewRequest("GET", "/oauth/authorize?response_type=code&client_id=c&redirect_uri=http://localhost/cb&state=s&code_challenge=x&code_challenge_method=S256", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("authorize = %d, want 503", w.Code)
+	}
+}
@@ -2,16 +2,23 @@ package auth
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/golang-jwt/jwt/v5/request"
+	"github.com/hugr-lab/hugr/pkg/auth/discovery"
 	"github.com/hugr-lab/query-engine/pkg/auth"
+	"golang.org/x/oauth2"
 )
 
 type OIDCConfig struct {
@@ -26,42 +33,78 @@ type OIDCConfig struct {
 
 	ScopeRolePrefix string     `json:"scope_role_prefix" yaml:"scope_role_prefix"`
 	Claims          OIDCClaims `json:"claims" yaml:"claims"`
+	// RoleMapping maps the claim values (groups, email domain, etc) to the hugr roles,
+	// every matched rule grants its role, the rules with higher priority go first.
+	RoleMapping []RoleMappingRule `json:"role_mapping" yaml:"role_mapping"`
+	// DefaultRole is used if the request doesn't select the role and the role is granted by the claims,
+	// it is also assigned if the claims don't grant any role.
+	DefaultRole string `json:"default_role" yaml:"default_role"`
+	// RoleHeader is the request header to select the role among the roles granted by the claims (default: x-hugr-role).
+	RoleHeader string `json:"role_header" yaml:"role_header"`
+
+	// Audiences are the allowed token audiences, the token should be issued for one of them.
+	// If it is empty the audience isn't checked.
+	Audiences []string `json:"audiences" yaml:"audiences"`
+	// RequiredClaims are the conditions on the token claims, all of them should be satisfied.
+	RequiredClaims []ClaimCondition `json:"required_claims" yaml:"required_claims"`
+	// MaxTokenAge limits the time since the token was issued (iat claim), 0 - no limit.
+	MaxTokenAge time.Duration `json:"max_token_age" yaml:"max_token_age"`
+
+	// UserInfo enables the claims enrichment by the provider's userinfo endpoint,
+	// the returned claims are added to the token claims (the token claims take precedence).
+	UserInfo bool `json:"userinfo" yaml:"userinfo"`
+	// UserInfoCacheTTL is the time the userinfo claims are cached per subject (default: 5m).
+	UserInfoCacheTTL time.Duration `json:"userinfo_cache_ttl" yaml:"userinfo_cache_ttl"`
+
+	// JWKSFile is the path to the local JWKS file with the issuer's public keys,
+	// if it or JWKS is set the OIDC discovery is skipped and the tokens are verified offline.
+	JWKSFile string `json:"jwks_file" yaml:"jwks_file"`
+	// JWKS is the inline JWKS (JSON) with the issuer's public keys.
+	JWKS string `json:"jwks" yaml:"jwks"`
+	// JWKSRefreshInterval defines how often the JWKS file is checked for changes (default: 5m).
+	JWKSRefreshInterval time.Duration `json:"jwks_refresh_interval" yaml:"jwks_refresh_interval"`
+
+	// TokenCacheSize is the maximum number of the verified tokens in the cache, 0 - the cache is disabled.
+	TokenCacheSize int `json:"token_cache_size" yaml:"token_cache_size"`
+	// TokenCacheTTL limits the time the verified token is cached (default: 5m),
+	// the token is cached until its expiration otherwise.
+	TokenCacheTTL time.Duration `json:"token_cache_ttl" yaml:"token_cache_ttl"`
+}
+
+// offline reports whether the tokens are verified by the local key set without the OIDC discovery.
+func (c OIDCConfig) offline() bool {
+	return c.JWKSFile != "" || c.JWKS != ""
 }
 
 type OIDCClaims = auth.UserAuthInfoConfig
 
 type OIDCProvider struct {
+	name      string
 	c         OIDCConfig
+	mu        sync.RWMutex
 	verifier  verifier
+	userInfo  userInfoFetcher
 	extractor request.Extractor
+
+	userInfoCache *userInfoCache
+	keySet        *localKeySet
+	tokenCache    *tokenCache[*verifiedToken]
+	// discoveryErr is set until the OIDC discovery succeeds
+	discoveryErr error
 }
 
 type verifier interface {
 	Verify(ctx context.Context, token string) (*oidc.IDToken, error)
 }
 
-func NewOIDCProvider(ctx context.Context, c OIDCConfig) (*OIDCProvider, error) {
+type userInfoFetcher interface {
+	UserInfo(ctx context.Context, ts oauth2.TokenSource) (*oidc.UserInfo, error)
+}
+
+func NewOIDCProvider(ctx context.Context, name string, c OIDCConfig) (*OIDCProvider, error) {
 	if c.Issuer == "" {
 		return nil, errors.New("OIDC Issuer is required")
 	}
-	hc := &http.Client{
-		Timeout: c.Timeout,
-	}
-	if c.TLSInsecure {
-		hc.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-	}
-
-	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, hc), c.Issuer)
-	if err != nil {
-		return nil, err
-	}
-
-	verifier := provider.Verifier(&oidc.Config{
-		ClientID:          c.ClientID,
-		SkipClientIDCheck: true,
-	})
 	extractor := request.OAuth2Extractor
 	if c.CookieName != "" {
 		extractor = &request.MultiExtractor{
@@ -79,15 +122,113 @@ func NewOIDCProvider(ctx context.Context, c OIDCConfig) (*OIDCProvider, error) {
 	if c.Claims.UserName == "" {
 		c.Claims.UserName = "name"
 	}
-	return &OIDCProvider{
+	if c.RoleHeader == "" {
+		c.RoleHeader = "x-hugr-role"
+	}
+	rules, err := sortRoleMapping(c.RoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	c.RoleMapping = rules
+	for _, rc := range c.RequiredClaims {
+		if err := rc.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if name == "" {
+		name = DefaultOIDCProviderName
+	}
+	p := &OIDCProvider{
+		name:      name,
 		c:         c,
-		verifier:  verifier,
 		extractor: extractor,
-	}, nil
+	}
+	if c.UserInfo {
+		p.userInfoCache = newUserInfoCache(c.UserInfoCacheTTL)
+	}
+	if c.TokenCacheSize > 0 {
+		p.tokenCache = newTokenCache[*verifiedToken](name, c.TokenCacheSize, c.TokenCacheTTL)
+	}
+	if c.offline() {
+		if c.UserInfo {
+			return nil, errors.New("OIDC userinfo requires the discovery, it can't be used with the local JWKS")
+		}
+		ks, err := newLocalKeySet(name, c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWKS: %w", err)
+		}
+		// the tokens signed by the removed keys must not be accepted from the cache
+		ks.onChange = func() { p.InvalidateTokens("") }
+		p.keySet = ks
+		p.verifier = newLocalVerifier(c.Issuer, ks)
+		go ks.run(ctx, c.JWKSRefreshInterval)
+		return p, nil
+	}
+	// the IdP can be temporarily unavailable at the startup,
+	// the provider retries the discovery in the background and rejects its tokens until it succeeds
+	if err := p.Rediscover(ctx); err != nil {
+		log.Printf("Auth: OIDC %s: discovery failed: %v, the provider is unavailable until the discovery succeeds", name, err)
+		p.discoveryErr = fmt.Errorf("%w: oidc %s: %v", ErrProviderUnavailable, name, err)
+		go discovery.Retry(ctx, "OIDC "+name, p.Rediscover)
+	}
+	return p, nil
+}
+
+// discover runs the OIDC discovery.
+func (c OIDCConfig) discover(ctx context.Context) (*oidc.Provider, error) {
+	return oidc.NewProvider(oidc.ClientContext(ctx, c.httpClient()), c.Issuer)
+}
+
+// newVerifier creates the token verifier,
+// the audience is checked by the provider against the list of allowed audiences.
+func newVerifier(provider *oidc.Provider) verifier {
+	return provider.Verifier(&oidc.Config{
+		SkipClientIDCheck: true,
+	})
+}
+
+func (c OIDCConfig) httpClient() *http.Client {
+	hc := &http.Client{
+		Timeout: c.Timeout,
+	}
+	if c.TLSInsecure {
+		hc.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	return hc
+}
+
+// Rediscover runs the OIDC discovery again and replaces the token verifier,
+// so the issuer's signing keys (JWKS) are re-fetched on the next verification.
+// The local JWKS is re-read instead of the discovery.
+func (p *OIDCProvider) Rediscover(ctx context.Context) error {
+	// the issuer's keys can be revoked, so the tokens are verified again
+	defer p.InvalidateTokens("")
+	if p.keySet != nil {
+		return p.keySet.load()
+	}
+	provider, err := p.c.discover(ctx)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.verifier = newVerifier(provider)
+	p.userInfo = provider
+	p.discoveryErr = nil
+	p.mu.Unlock()
+	return nil
+}
+
+// Ready returns ErrProviderUnavailable until the OIDC discovery succeeds.
+func (p *OIDCProvider) Ready() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.discoveryErr
 }
 
 func (p *OIDCProvider) Name() string {
-	return "oidc"
+	return p.name
 }
 
 func (p *OIDCProvider) Type() string {
@@ -109,7 +250,24 @@ func (p *OIDCProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
 		return nil, auth.ErrSkipAuth
 	}
 
-	idToken, err := p.verifier.Verify(r.Context(), token)
+	p.mu.RLock()
+	v, ui := p.verifier, p.userInfo
+	p.mu.RUnlock()
+	if v == nil {
+		// the discovery hasn't succeeded yet, the tokens of the other issuers are passed to the next providers
+		if p.tokenIssuedHere(token) {
+			return nil, ErrProviderUnavailable
+		}
+		return nil, auth.ErrInvalidKeyType
+	}
+	key := sha256.Sum256([]byte(token))
+	if p.tokenCache != nil {
+		if vt, ok := p.tokenCache.get(key); ok {
+			return p.authInfo(r, vt)
+		}
+	}
+
+	idToken, err := v.Verify(r.Context(), token)
 	if _, ok := errors.AsType[*oidc.TokenExpiredError](err); ok {
 		return nil, auth.ErrTokenExpired
 	}
@@ -129,31 +287,127 @@ func (p *OIDCProvider) Authenticate(r *http.Request) (*auth.AuthInfo, error) {
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, auth.ErrForbidden
 	}
-
-	role := claimString(claims, p.c.Claims.Role, p.c.ScopeRolePrefix)
-	userId := claimString(claims, p.c.Claims.UserId, "")
-	userName := claimString(claims, p.c.Claims.UserName, "")
-
-	// check scopes if role is empty
-	if role == "" {
-		role = claimString(claims, "scopes", p.c.ScopeRolePrefix)
+	if p.userInfoCache != nil {
+		if err := p.enrichClaims(r.Context(), ui, token, idToken.Subject, claims); err != nil {
+			// the userinfo endpoint details are logged only, they are not sent to the client
+			log.Printf("Auth: OIDC %s: userinfo for %s: %v", p.Name(), idToken.Subject, err)
+			if errors.Is(err, errUserInfoSubject) {
+				return nil, auth.ErrForbidden
+			}
+			return nil, ErrProviderUnavailable
+		}
 	}
 
-	if role == "" {
+	vt := &verifiedToken{
+		userId:   claimString(claims, p.c.Claims.UserId, ""),
+		userName: claimString(claims, p.c.Claims.UserName, ""),
+		token:    token,
+		claims:   claims,
+	}
+	if err := p.admit(idToken.Audience, idToken.IssuedAt, claims); err != nil {
+		log.Printf("Auth: OIDC %s: user %s: token rejected: %v", p.Name(), vt.userId, err)
 		return nil, auth.ErrForbidden
 	}
+	vt.roles = p.roles(claims)
+	if p.tokenCache != nil {
+		expires := idToken.Expiry
+		if p.c.MaxTokenAge > 0 && idToken.IssuedAt.Add(p.c.MaxTokenAge).Before(expires) {
+			expires = idToken.IssuedAt.Add(p.c.MaxTokenAge)
+		}
+		p.tokenCache.add(key, vt, expires)
+	}
+	return p.authInfo(r, vt)
+}
+
+// verifiedToken is the result of the token verification, it is cached by the token hash.
+type verifiedToken struct {
+	userId   string
+	userName string
+	token    string
+	claims   jwt.MapClaims
+	roles    []string
+}
 
+// authInfo selects the role requested by the request and creates the auth info.
+func (p *OIDCProvider) authInfo(r *http.Request, vt *verifiedToken) (*auth.AuthInfo, error) {
+	role, err := p.selectRole(r, vt.roles)
+	if err != nil {
+		log.Printf("Auth: OIDC %s: user %s: %v", p.Name(), vt.userId, err)
+		return nil, auth.ErrForbidden
+	}
 	return &auth.AuthInfo{
 		Role:         role,
-		UserId:       userId,
-		UserName:     userName,
+		UserId:       vt.userId,
+		UserName:     vt.userName,
 		AuthType:     p.Type(),
 		AuthProvider: p.Name(),
-		Token:        token,
-		Claims:       auth.ScalarClaims(claims),
+		Token:        vt.token,
+		Claims:       auth.ScalarClaims(vt.claims),
 	}, nil
 }
 
+// InvalidateTokens removes the cached verified tokens, if the subject is set only its tokens are removed.
+func (p *OIDCProvider) InvalidateTokens(subject string) {
+	if p.tokenCache == nil {
+		return
+	}
+	if subject == "" {
+		p.tokenCache.purge()
+		return
+	}
+	p.tokenCache.removeFunc(func(vt *verifiedToken) bool {
+		sub, _ := vt.claims["sub"].(string)
+		return sub == subject
+	})
+}
+
+// admit checks the token audience, age and the required claims.
+func (p *OIDCProvider) admit(audience []string, issuedAt time.Time, claims jwt.MapClaims) error {
+	if len(p.c.Audiences) != 0 && !slices.ContainsFunc(audience, func(aud string) bool {
+		return slices.Contains(p.c.Audiences, aud)
+	}) {
+		return fmt.Errorf("audience %v is not allowed", audience)
+	}
+	if p.c.MaxTokenAge > 0 {
+		if issuedAt.IsZero() {
+			return errors.New("token issue time (iat) is missing")
+		}
+		if age := time.Since(issuedAt); age > p.c.MaxTokenAge {
+			return fmt.Errorf("token age %s exceeds %s", age.Round(time.Second), p.c.MaxTokenAge)
+		}
+	}
+	for _, rc := range p.c.RequiredClaims {
+		if err := rc.check(claims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roles returns all roles granted by the claims in the order:
+// the role mapping rules, the role claim and the scopes claim.
+// The scopes grant the roles only with the scope role prefix, otherwise any scope the client
+// can request (openid, profile, ...) would be a role.
+// If the claims don't grant any role, the default role is returned.
+func (p *OIDCProvider) roles(claims jwt.MapClaims) []string {
+	roles := mapRoles(p.c.RoleMapping, claims)
+	roles = append(roles, claimStringsWithPrefix(claims, p.c.Claims.Role, p.c.ScopeRolePrefix)...)
+	if p.c.ScopeRolePrefix != "" {
+		roles = append(roles, claimStringsWithPrefix(claims, "scopes", p.c.ScopeRolePrefix)...)
+	}
+	roles = slices.DeleteFunc(roles, func(r string) bool { return r == "" })
+	if len(roles) == 0 && p.c.DefaultRole != "" {
+		return []string{p.c.DefaultRole}
+	}
+	return uniqueStrings(roles)
+}
+
+// selectRole returns the role requested in the role header if it is granted by the claims,
+// otherwise the default role if it is granted or the first granted role.
+func (p *OIDCProvider) selectRole(r *http.Request, roles []string) (string, error) {
+	return selectGrantedRole(r.Header.Get(p.c.RoleHeader), p.c.DefaultRole, roles)
+}
+
 // tokenIssuedHere reports whether the token's `iss` claim matches this
 // provider's configured issuer. It parses the JWT WITHOUT verifying the
 // signature — used only to classify a verification failure as a hard error
@@ -170,42 +424,25 @@ func (p *OIDCProvider) tokenIssuedHere(token string) bool {
 }
 
 // claimString extracts a string value from a claim, if prefix is provided, it return only unprefixed value with it.
-// claims can be in different formats, for example:
+// The key is a claim selector (see claimValue), claims can be in different formats, for example:
 // "scopes": ["hugr:admin", "app:user"] -> for prefix "hugr:" it will return "admin", for prefix "app:" it will return "user", for prefix "" it will return "hugr:admin" (first match)
 // "roles": "hugr:user" -> for prefix "hugr:" it will return "user", for prefix "" it will return "hugr:user", for prefix "app:" it will return "" (no match)
 // "x-hugr-role": "admin"
+// "realm_access": {"roles": ["admin"]} -> for key "realm_access.roles" it will return "admin"
 func claimString(claims jwt.MapClaims, key, prefix string) string {
-	if len(claims) == 0 {
-		return ""
-	}
-	v, ok := claims[key]
-	if !ok {
-		return ""
-	}
-	var s string
-	switch val := v.(type) {
-	case string:
-		if after, ok := strings.CutPrefix(val, prefix); ok {
-			s = after
-		}
-	case []any:
-		for _, item := range val {
-			str, ok := item.(string)
-			if !ok {
-				continue
-			}
-			if after, ok := strings.CutPrefix(str, prefix); ok {
-				s = after
-				break
-			}
-		}
-	case []string:
-		for _, str := range val {
-			if after, ok := strings.CutPrefix(str, prefix); ok {
-				s = after
-				break
-			}
+	if ss := claimStringsWithPrefix(claims, key, prefix); len(ss) != 0 {
+		return ss[0]
+	}
+	return ""
+}
+
+// claimStringsWithPrefix returns all unprefixed claim values that have the prefix.
+func claimStringsWithPrefix(claims jwt.MapClaims, key, prefix string) []string {
+	var ss []string
+	for _, s := range claimStrings(claimValue(claims, key)) {
+		if after, ok := strings.CutPrefix(s, prefix); ok {
+			ss = append(ss, after)
 		}
 	}
-	return s
+	return ss
 }
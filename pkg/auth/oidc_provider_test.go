@@ -2,14 +2,25 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/hugr-lab/hugr/pkg/auth/oauth"
 	"github.com/hugr-lab/query-engine/pkg/auth"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type stubVerifier struct{ err error }
@@ -69,3 +80,317 @@ func TestOIDCProvider_Authenticate_Classification(t *testing.T) {
 		}
 	})
 }
+
+func TestClaimValue(t *testing.T) {
+	claims := jwt.MapClaims{
+		"https://example.com/roles": []any{"reader"},
+		"realm_access":              map[string]any{"roles": []any{"admin", "user"}},
+		"resource_access": map[string]any{
+			"hugr-app": map[string]any{"roles": []any{"analyst"}},
+		},
+	}
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{"https://example.com/roles", "reader"},
+		{"realm_access.roles", "admin"},
+		{"$.realm_access.roles[1]", "user"},
+		{"$.resource_access['hugr-app'].roles", "analyst"},
+		{"realm_access.groups", ""},
+		{"realm_access.roles.name", ""},
+	}
+	for _, tt := range tests {
+		if got := claimString(claims, tt.selector, ""); got != tt.want {
+			t.Errorf("claimString(%q) = %q, want %q", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCProvider_SelectRole(t *testing.T) {
+	rules, err := sortRoleMapping([]RoleMappingRule{
+		{Claim: "email", Pattern: "*@example.com", Role: "user"},
+		{Claim: "groups", Value: "hugr-admins", Role: "admin", Priority: 10},
+		{Claim: "realm_access.roles", Value: "analyst", Role: "analyst"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &OIDCProvider{c: OIDCConfig{
+		Claims:          OIDCClaims{Role: "x-hugr-role"},
+		ScopeRolePrefix: "hugr:",
+		RoleMapping:     rules,
+		DefaultRole:     "readonly",
+		RoleHeader:      "x-hugr-role",
+	}}
+
+	tests := []struct {
+		name      string
+		claims    jwt.MapClaims
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		{name: "priority", claims: jwt.MapClaims{"email": "bob@example.com", "groups": []any{"staff", "hugr-admins"}}, want: "admin"},
+		{name: "email domain", claims: jwt.MapClaims{"email": "bob@example.com", "groups": []any{"staff"}}, want: "user"},
+		{name: "nested claim", claims: jwt.MapClaims{"realm_access": map[string]any{"roles": []any{"analyst"}}}, want: "analyst"},
+		{name: "role claim", claims: jwt.MapClaims{"email": "bob@other.com", "x-hugr-role": "hugr:editor"}, want: "editor"},
+		{name: "scopes", claims: jwt.MapClaims{"scopes": []any{"openid", "hugr:viewer"}}, want: "viewer"},
+		{name: "default", claims: jwt.MapClaims{"email": "bob@other.com"}, want: "readonly"},
+		{name: "granted default", claims: jwt.MapClaims{"groups": []any{"hugr-admins"}, "scopes": []any{"hugr:readonly"}}, want: "readonly"},
+		{name: "requested", claims: jwt.MapClaims{"email": "bob@example.com", "groups": []any{"hugr-admins"}}, requested: "user", want: "user"},
+		{name: "requested not granted", claims: jwt.MapClaims{"email": "bob@example.com"}, requested: "admin", wantErr: true},
+		{name: "requested default not granted", claims: jwt.MapClaims{"email": "bob@example.com"}, requested: "readonly", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.requested != "" {
+				req.Header.Set("x-hugr-role", tt.requested)
+			}
+			got, err := p.selectRole(req, p.roles(tt.claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("role = %q, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("role = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	// without the scope role prefix the scopes don't grant the roles
+	p.c.ScopeRolePrefix = ""
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("x-hugr-role", "openid")
+	claims := jwt.MapClaims{"x-hugr-role": "editor", "scopes": []any{"openid", "admin"}}
+	if roles := p.roles(claims); !slices.Equal(roles, []string{"editor"}) {
+		t.Fatalf("roles without scope prefix = %v, want [editor]", roles)
+	}
+	if got, err := p.selectRole(req, p.roles(claims)); err == nil {
+		t.Fatalf("unprefixed scope is selected as role %q", got)
+	}
+
+	if _, err := sortRoleMapping([]RoleMappingRule{{Claim: "groups", Role: "admin"}}); err == nil {
+		t.Fatal("expected error for the rule without value and pattern")
+	}
+}
+
+func TestOIDCProvider_Admit(t *testing.T) {
+	p := &OIDCProvider{c: OIDCConfig{
+		Audiences:   []string{"hugr", "hugr-admin"},
+		MaxTokenAge: time.Hour,
+		RequiredClaims: []ClaimCondition{
+			{Claim: "email_verified", Equals: true},
+			{Claim: "realm_access.groups", Contains: "hugr-users"},
+		},
+	}}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"email_verified": true,
+			"realm_access":   map[string]any{"groups": []any{"staff", "hugr-users"}},
+		}
+	}
+	now := time.Now()
+
+	if err := p.admit([]string{"account", "hugr"}, now, claims()); err != nil {
+		t.Fatalf("admit: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		audience []string
+		issuedAt time.Time
+		claims   jwt.MapClaims
+	}{
+		{"audience", []string{"account"}, now, claims()},
+		{"token age", []string{"hugr"}, now.Add(-2 * time.Hour), claims()},
+		{"no iat", []string{"hugr"}, time.Time{}, claims()},
+		{"email not verified", []string{"hugr"}, now, func() jwt.MapClaims { c := claims(); c["email_verified"] = false; return c }()},
+		{"missing claim", []string{"hugr"}, now, func() jwt.MapClaims { c := claims(); delete(c, "email_verified"); return c }()},
+		{"required group", []string{"hugr"}, now, func() jwt.MapClaims {
+			c := claims()
+			c["realm_access"] = map[string]any{"groups": []any{"staff"}}
+			return c
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.admit(tt.audience, tt.issuedAt, tt.claims); err == nil {
+				t.Fatal("admit = nil, want error")
+			}
+		})
+	}
+}
+
+// newDiscoveryServer starts the stand-in IdP that serves the OIDC discovery document
+// only after it is switched to available.
+func newDiscoveryServer(t *testing.T, available *atomic.Bool) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() || r.URL.Path != "/.well-known/openid-configuration" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOIDCProvider_UnavailableAtStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var available atomic.Bool
+	srv := newDiscoveryServer(t, &available)
+
+	p, err := NewOIDCProvider(ctx, "idp", OIDCConfig{Issuer: srv.URL})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	if err := p.Ready(); !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("Ready = %v, want ErrProviderUnavailable", err)
+	}
+	if err := CheckProviders(&auth.Config{Providers: []auth.AuthProvider{p}})(ctx); !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("CheckProviders = %v, want ErrProviderUnavailable", err)
+	}
+
+	authenticate := func(token string) error {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := p.Authenticate(req)
+		return err
+	}
+	if err := authenticate(oidcTokenWithIssuer(t, srv.URL)); !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("own token err = %v, want ErrProviderUnavailable", err)
+	}
+	if err := authenticate(oidcTokenWithIssuer(t, "https://other")); !errors.Is(err, auth.ErrInvalidKeyType) {
+		t.Fatalf("foreign token err = %v, want ErrInvalidKeyType", err)
+	}
+
+	// the OAuth proxy reports the same error value
+	if !errors.Is(oauth.ErrProviderUnavailable, ErrProviderUnavailable) {
+		t.Fatal("OAuth proxy error is not ErrProviderUnavailable")
+	}
+
+	available.Store(true)
+	if err := p.Rediscover(ctx); err != nil {
+		t.Fatalf("Rediscover: %v", err)
+	}
+	if err := p.Ready(); err != nil {
+		t.Fatalf("Ready after discovery = %v", err)
+	}
+	// the token is verified now (the stand-in IdP has no keys, so the verification fails)
+	if err := authenticate(oidcTokenWithIssuer(t, srv.URL)); !errors.Is(err, auth.ErrForbidden) {
+		t.Fatalf("own token err = %v, want ErrForbidden", err)
+	}
+}
+
+func TestOIDCProvider_LocalJWKS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newKey := func(kid string) (*rsa.PrivateKey, jose.JSONWebKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"}
+	}
+	writeJWKS := func(path string, keys ...jose.JSONWebKey) {
+		b, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(key *rsa.PrivateKey, kid string) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":         "https://idp.internal",
+			"sub":         "u1",
+			"exp":         time.Now().Add(time.Hour).Unix(),
+			"x-hugr-role": "admin",
+		})
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	key1, jwk1 := newKey("k1")
+	key2, jwk2 := newKey("k2")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(path, jwk1)
+
+	p, err := NewOIDCProvider(ctx, "offline", OIDCConfig{Issuer: "https://idp.internal", JWKSFile: path, TokenCacheSize: 10})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	if err := p.Ready(); err != nil {
+		t.Fatalf("Ready = %v", err)
+	}
+	authenticate := func(token string) (*auth.AuthInfo, error) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return p.Authenticate(req)
+	}
+	token1 := sign(key1, "k1")
+	if info, err := authenticate(token1); err != nil || info.Role != "admin" || info.UserId != "u1" {
+		t.Fatalf("authenticate: %+v, %v", info, err)
+	}
+	// the verified token is cached
+	if info, err := authenticate(token1); err != nil || info.Role != "admin" {
+		t.Fatalf("cached authenticate: %+v, %v", info, err)
+	}
+	if got := testutil.ToFloat64(tokenCacheRequests.WithLabelValues("offline", "hit")); got != 1 {
+		t.Fatalf("token cache hits = %v, want 1", got)
+	}
+
+	unknown := testutil.ToFloat64(jwksUnknownKid.WithLabelValues("offline"))
+	if _, err := authenticate(sign(key2, "k2")); !errors.Is(err, auth.ErrForbidden) {
+		t.Fatalf("unknown kid err = %v, want ErrForbidden", err)
+	}
+	if got := testutil.ToFloat64(jwksUnknownKid.WithLabelValues("offline")); got != unknown+1 {
+		t.Fatalf("unknown kid metric = %v, want %v", got, unknown+1)
+	}
+
+	// rotate the keys
+	writeJWKS(path, jwk2)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err := p.keySet.reloadIfChanged(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, err := authenticate(sign(key2, "k2")); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	// the cached token signed by the removed key is verified again
+	if _, err := authenticate(token1); !errors.Is(err, auth.ErrForbidden) {
+		t.Fatalf("removed key err = %v, want ErrForbidden", err)
+	}
+	if got := testutil.ToFloat64(jwksRefreshes.WithLabelValues("offline", "success")); got != 2 {
+		t.Fatalf("refreshes metric = %v, want 2", got)
+	}
+
+	// the inline keys
+	b, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk1}})
+	p, err = NewOIDCProvider(ctx, "inline", OIDCConfig{Issuer: "https://idp.internal", JWKS: string(b)})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	if _, err := authenticate(sign(key1, "k1")); err != nil {
+		t.Fatalf("inline keys: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const defaultTokenCacheTTL = 5 * time.Minute
+
+type tokenKey = [sha256.Size]byte
+
+// tokenCache is the bounded LRU cache of the verified tokens keyed by the token hash,
+// the entries are kept until the token expiration (limited by the cache TTL).
+type tokenCache[T any] struct {
+	provider string
+	size     int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[tokenKey]*list.Element
+}
+
+type tokenCacheEntry[T any] struct {
+	key     tokenKey
+	value   T
+	expires time.Time
+}
+
+func newTokenCache[T any](provider string, size int, ttl time.Duration) *tokenCache[T] {
+	if ttl <= 0 {
+		ttl = defaultTokenCacheTTL
+	}
+	return &tokenCache[T]{
+		provider: provider,
+		size:     size,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[tokenKey]*list.Element),
+	}
+}
+
+func (c *tokenCache[T]) get(key tokenKey) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero T
+	el, ok := c.items[key]
+	if !ok {
+		tokenCacheRequests.WithLabelValues(c.provider, "miss").Inc()
+		return zero, false
+	}
+	e := el.Value.(*tokenCacheEntry[T])
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		tokenCacheRequests.WithLabelValues(c.provider, "miss").Inc()
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	tokenCacheRequests.WithLabelValues(c.provider, "hit").Inc()
+	return e.value, true
+}
+
+// add caches the value until the expiration time limited by the cache TTL.
+func (c *tokenCache[T]) add(key tokenKey, value T, expires time.Time) {
+	now := time.Now()
+	if expires.IsZero() || expires.After(now.Add(c.ttl)) {
+		expires = now.Add(c.ttl)
+	}
+	if !expires.After(now) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*tokenCacheEntry[T])
+		e.value, e.expires = value, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&tokenCacheEntry[T]{key: key, value: value, expires: expires})
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+		tokenCacheEvictions.WithLabelValues(c.provider).Inc()
+	}
+	tokenCacheEntries.WithLabelValues(c.provider).Set(float64(c.ll.Len()))
+}
+
+// removeFunc removes the entries for which the fn returns true (e.g. the revoked tokens).
+func (c *tokenCache[T]) removeFunc(fn func(T) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if fn(el.Value.(*tokenCacheEntry[T]).value) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// purge removes all entries.
+func (c *tokenCache[T]) purge() {
+	c.removeFunc(func(T) bool { return true })
+}
+
+func (c *tokenCache[T]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*tokenCacheEntry[T]).key)
+	tokenCacheEntries.WithLabelValues(c.provider).Set(float64(c.ll.Len()))
+}
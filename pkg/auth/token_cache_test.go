@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenCache(t *testing.T) {
+	c := newTokenCache[string]("test-lru", 2, time.Hour)
+	k := func(s string) tokenKey { return sha256.Sum256([]byte(s)) }
+
+	c.add(k("t1"), "u1", time.Now().Add(time.Minute))
+	c.add(k("t2"), "u2", time.Now().Add(time.Minute))
+	if v, ok := c.get(k("t1")); !ok || v != "u1" {
+		t.Fatalf("get t1 = %q, %t", v, ok)
+	}
+	// t2 is the least recently used
+	c.add(k("t3"), "u3", time.Now().Add(time.Minute))
+	if _, ok := c.get(k("t2")); ok {
+		t.Fatal("t2 should be evicted")
+	}
+	if _, ok := c.get(k("t1")); !ok {
+		t.Fatal("t1 should be cached")
+	}
+	if got := testutil.ToFloat64(tokenCacheEvictions.WithLabelValues("test-lru")); got != 1 {
+		t.Fatalf("evictions = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tokenCacheRequests.WithLabelValues("test-lru", "hit")); got != 2 {
+		t.Fatalf("hits = %v, want 2", got)
+	}
+
+	// expired and already expired tokens
+	c.add(k("t4"), "u4", time.Now().Add(-time.Second))
+	if _, ok := c.get(k("t4")); ok {
+		t.Fatal("expired token should not be cached")
+	}
+	c.add(k("t5"), "u5", time.Now().Add(10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get(k("t5")); ok {
+		t.Fatal("t5 should be expired")
+	}
+
+	// revocation
+	c.add(k("t6"), "u6", time.Now().Add(time.Minute))
+	c.removeFunc(func(v string) bool { return v == "u6" })
+	if _, ok := c.get(k("t6")); ok {
+		t.Fatal("t6 should be removed")
+	}
+	c.purge()
+	if _, ok := c.get(k("t1")); ok {
+		t.Fatal("cache should be empty")
+	}
+	if got := testutil.ToFloat64(tokenCacheEntries.WithLabelValues("test-lru")); got != 0 {
+		t.Fatalf("entries = %v, want 0", got)
+	}
+}
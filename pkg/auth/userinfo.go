@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const defaultUserInfoCacheTTL = 5 * time.Minute
+
+// userInfoCache holds the userinfo claims per subject.
+type userInfoCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]userInfoEntry
+	lastSweep time.Time
+}
+
+type userInfoEntry struct {
+	claims  map[string]any
+	expires time.Time
+}
+
+func newUserInfoCache(ttl time.Duration) *userInfoCache {
+	if ttl <= 0 {
+		ttl = defaultUserInfoCacheTTL
+	}
+	return &userInfoCache{
+		ttl:     ttl,
+		entries: make(map[string]userInfoEntry),
+	}
+}
+
+func (c *userInfoCache) get(sub string) (map[string]any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[sub]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.claims, true
+}
+
+func (c *userInfoCache) set(sub string, claims map[string]any) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[sub] = userInfoEntry{claims: claims, expires: now.Add(c.ttl)}
+}
+
+// errUserInfoSubject is returned if the userinfo response is issued for another subject.
+var errUserInfoSubject = errors.New("userinfo subject mismatch")
+
+// enrichClaims adds the claims returned by the userinfo endpoint to the token claims,
+// the token claims are not overwritten. The userinfo claims are cached per subject.
+func (p *OIDCProvider) enrichClaims(ctx context.Context, ui userInfoFetcher, token, sub string, claims jwt.MapClaims) error {
+	if sub == "" {
+		return fmt.Errorf("token subject is empty")
+	}
+	info, ok := p.userInfoCache.get(sub)
+	if !ok {
+		ctx = oidc.ClientContext(ctx, p.c.httpClient())
+		res, err := ui.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: token,
+			TokenType:   "Bearer",
+		}))
+		if err != nil {
+			return err
+		}
+		// the userinfo response must be issued for the token subject (OpenID Connect Core 5.3.2)
+		if res.Subject != sub {
+			return fmt.Errorf("%w: userinfo subject %q doesn't match the token subject", errUserInfoSubject, res.Subject)
+		}
+		info = map[string]any{}
+		if err := res.Claims(&info); err != nil {
+			return err
+		}
+		p.userInfoCache.set(sub, info)
+	}
+	for k, v := range info {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	return nil
+}
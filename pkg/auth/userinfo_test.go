@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+)
+
+func TestOIDCProvider_EnrichClaims(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"sub":    "u1",
+			"name":   "Alice",
+			"email":  "alice@example.com",
+			"groups": []any{"hugr-admins"},
+		})
+	}))
+	defer srv.Close()
+
+	provider := (&oidc.ProviderConfig{IssuerURL: srv.URL, UserInfoURL: srv.URL}).NewProvider(context.Background())
+	p := &OIDCProvider{
+		c:             OIDCConfig{UserInfo: true},
+		userInfoCache: newUserInfoCache(0),
+	}
+
+	claims := jwt.MapClaims{"sub": "u1", "email": "alice@corp.example.com"}
+	if err := p.enrichClaims(context.Background(), provider, "access-token", "u1", claims); err != nil {
+		t.Fatalf("enrichClaims: %v", err)
+	}
+	if claims["name"] != "Alice" || claims["email"] != "alice@corp.example.com" {
+		t.Fatalf("claims = %v, want the userinfo name and the token email", claims)
+	}
+	if claimString(claims, "groups", "") != "hugr-admins" {
+		t.Fatalf("groups = %v", claims["groups"])
+	}
+
+	// the userinfo claims are cached per subject
+	claims = jwt.MapClaims{"sub": "u1"}
+	if err := p.enrichClaims(context.Background(), provider, "access-token", "u1", claims); err != nil {
+		t.Fatalf("enrichClaims: %v", err)
+	}
+	if n := calls.Load(); n != 1 || claims["name"] != "Alice" {
+		t.Fatalf("userinfo calls = %d, claims = %v", n, claims)
+	}
+
+	// the userinfo subject must match the token subject
+	if err := p.enrichClaims(context.Background(), provider, "access-token", "u2", jwt.MapClaims{}); err == nil {
+		t.Fatal("expected error for the subject mismatch")
+	}
+	if err := p.enrichClaims(context.Background(), provider, "wrong-token", "u3", jwt.MapClaims{}); err == nil {
+		t.Fatal("expected error for the rejected token")
+	}
+}
+
+func TestOIDCProvider_UserInfoErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "internal idp details", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"sub": "other"})
+	}))
+	defer srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "RS256", Use: "sig"}}})
+	p, err := NewOIDCProvider(context.Background(), "userinfo", OIDCConfig{Issuer: "https://idp.internal", JWKS: string(b)})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": "https://idp.internal",
+		"sub": "u1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	tok.Header["kid"] = "k1"
+	token, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate := func(userInfoURL string) error {
+		p.userInfoCache = newUserInfoCache(0)
+		p.userInfo = (&oidc.ProviderConfig{IssuerURL: srv.URL, UserInfoURL: userInfoURL}).NewProvider(context.Background())
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := p.Authenticate(req)
+		return err
+	}
+
+	// the userinfo endpoint failure isn't sent to the client
+	err = authenticate(srv.URL + "/fail")
+	if !errors.Is(err, ErrProviderUnavailable) || strings.Contains(err.Error(), "internal idp details") {
+		t.Fatalf("userinfo failure err = %v, want ErrProviderUnavailable", err)
+	}
+	// the subject mismatch is rejected
+	if err := authenticate(srv.URL); !errors.Is(err, auth.ErrForbidden) {
+		t.Fatalf("subject mismatch err = %v, want ErrForbidden", err)
+	}
+}
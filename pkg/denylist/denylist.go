@@ -0,0 +1,369 @@
+package denylist
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/catalog/compiler"
+	"github.com/hugr-lab/query-engine/pkg/catalog/sources"
+	rtsources "github.com/hugr-lab/query-engine/pkg/data-sources/sources"
+	"github.com/hugr-lab/query-engine/pkg/data-sources/sources/runtime"
+	"github.com/hugr-lab/query-engine/pkg/db"
+	"github.com/hugr-lab/query-engine/pkg/engines"
+	"github.com/hugr-lab/query-engine/types"
+
+	_ "embed"
+)
+
+// The Denylist runtime source for hugr query engine that stores the token denylist in the CoreDB
+// and exposes the admin functions to manage it:
+// 1. core.denylist.entries
+// 2. core.denylist.deny
+// 3. core.denylist.allow
+// Every node reloads the denylist from the CoreDB periodically, so the changes are applied in the cluster.
+
+//go:embed schema.graphql
+var schema string
+
+const createTableSQL = `CREATE TABLE IF NOT EXISTS core.auth_denylist (
+	kind VARCHAR NOT NULL,
+	value VARCHAR NOT NULL,
+	reason VARCHAR,
+	created_by VARCHAR,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ,
+	PRIMARY KEY (kind, value)
+)`
+
+var ErrNotAdmin = errors.New("denylist management is allowed for admins only")
+
+var _ (rtsources.RuntimeSource) = (*Source)(nil)
+
+type Source struct {
+	denylist *hugrauth.Denylist
+	readOnly bool
+	pool     *db.Pool
+}
+
+// New creates the denylist source, the readOnly CoreDB is only read.
+func New(dl *hugrauth.Denylist, readOnly bool) *Source {
+	return &Source{
+		denylist: dl,
+		readOnly: readOnly,
+	}
+}
+
+func (*Source) Name() string {
+	return "core.denylist"
+}
+
+func (*Source) Engine() engines.Engine {
+	return engines.NewDuckDB()
+}
+
+func (*Source) IsReadonly() bool {
+	return false
+}
+
+func (*Source) AsModule() bool {
+	return true
+}
+
+func (s *Source) Attach(ctx context.Context, pool *db.Pool) error {
+	s.pool = pool
+	return s.registerUDFs(ctx)
+}
+
+func (s *Source) Catalog(ctx context.Context) (sources.Catalog, error) {
+	e := engines.NewDuckDB()
+	opts := compiler.Options{
+		Name:         s.Name(),
+		Prefix:       "core_denylist",
+		ReadOnly:     s.IsReadonly(),
+		AsModule:     s.AsModule(),
+		EngineType:   string(e.Type()),
+		Capabilities: e.Capabilities(),
+	}
+	return sources.NewStringSource(s.Name(), e, opts, schema)
+}
+
+// Start creates the denylist table, loads the entries and reloads them until the context is done.
+// It should be called after the engine initialization (the CoreDB is attached).
+func (s *Source) Start(ctx context.Context) error {
+	if s.pool == nil {
+		return errors.New("denylist source is not attached")
+	}
+	if !s.readOnly {
+		if _, err := s.pool.Exec(ctx, createTableSQL); err != nil {
+			return fmt.Errorf("create denylist table: %w", err)
+		}
+	}
+	if err := s.Refresh(ctx); err != nil {
+		return err
+	}
+	go s.run(ctx, s.denylist.Config.Interval())
+	return nil
+}
+
+func (s *Source) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Refresh(ctx); err != nil {
+			log.Printf("Auth: denylist refresh error: %v", err)
+		}
+	}
+}
+
+// Refresh reloads the denylist from the CoreDB, the expired entries are removed.
+func (s *Source) Refresh(ctx context.Context) error {
+	now := time.Now()
+	if !s.readOnly {
+		_, err := s.pool.Exec(ctx, `DELETE FROM core.auth_denylist WHERE expires_at IS NOT NULL AND expires_at <= $1`, now)
+		if err != nil {
+			return fmt.Errorf("remove expired denylist entries: %w", err)
+		}
+	}
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(ctx, `SELECT kind, value, reason, created_by, created_at, expires_at
+		FROM core.auth_denylist WHERE expires_at IS NULL OR expires_at > $1`, now)
+	if err != nil {
+		return fmt.Errorf("load denylist: %w", err)
+	}
+	defer rows.Close()
+	var entries []hugrauth.DenylistEntry
+	for rows.Next() {
+		var e hugrauth.DenylistEntry
+		var reason, createdBy *string
+		var expiresAt *time.Time
+		if err := rows.Scan(&e.Kind, &e.Value, &reason, &createdBy, &e.CreatedAt, &expiresAt); err != nil {
+			return fmt.Errorf("load denylist: %w", err)
+		}
+		if reason != nil {
+			e.Reason = *reason
+		}
+		if createdBy != nil {
+			e.CreatedBy = *createdBy
+		}
+		if expiresAt != nil {
+			e.ExpiresAt = *expiresAt
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("load denylist: %w", err)
+	}
+	s.denylist.Set(entries)
+	return nil
+}
+
+// Deny stores the entry in the CoreDB and applies it on the node.
+func (s *Source) Deny(ctx context.Context, e hugrauth.DenylistEntry) error {
+	if s.readOnly {
+		return errors.New("core db is read-only")
+	}
+	if err := hugrauth.ValidDenyKind(e.Kind); err != nil {
+		return err
+	}
+	if e.Value == "" {
+		return errors.New("denylist value is empty")
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	var expiresAt any
+	if !e.ExpiresAt.IsZero() {
+		expiresAt = e.ExpiresAt
+	}
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Exec(ctx, `DELETE FROM core.auth_denylist WHERE kind = $1 AND value = $2`, e.Kind, e.Value)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO core.auth_denylist (kind, value, reason, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		e.Kind, e.Value, e.Reason, e.CreatedBy, e.CreatedAt, expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+	s.denylist.Add(e)
+	log.Printf("Auth: denylist: %s %q denied by %q: %s", e.Kind, e.Value, e.CreatedBy, e.Reason)
+	return nil
+}
+
+// Allow removes the entry from the CoreDB and the node denylist.
+func (s *Source) Allow(ctx context.Context, kind, value string) (int, error) {
+	if s.readOnly {
+		return 0, errors.New("core db is read-only")
+	}
+	if err := hugrauth.ValidDenyKind(kind); err != nil {
+		return 0, err
+	}
+	res, err := s.pool.Exec(ctx, `DELETE FROM core.auth_denylist WHERE kind = $1 AND value = $2`, kind, value)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	s.denylist.Remove(kind, value)
+	return int(n), nil
+}
+
+// checkAdmin checks that the request is allowed to manage the denylist.
+func (s *Source) checkAdmin(ctx context.Context) (*auth.AuthInfo, error) {
+	if auth.IsFullAccess(ctx) {
+		return auth.AuthInfoFromContext(ctx), nil
+	}
+	info := auth.AuthInfoFromContext(ctx)
+	if info == nil || !s.denylist.Config.IsAdmin(info.Role) {
+		return nil, ErrNotAdmin
+	}
+	return info, nil
+}
+
+func (s *Source) registerUDFs(ctx context.Context) error {
+	// core_denylist_entries() → table of the active entries
+	err := s.pool.RegisterTableRowFunction(ctx, &db.TableRowFunctionNoArgs[hugrauth.DenylistEntry]{
+		Name: "core_denylist_entries",
+		ColumnInfos: []duckdb.ColumnInfo{
+			{Name: "kind", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "value", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "reason", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "created_by", T: runtime.DuckDBTypeInfoByNameMust("VARCHAR")},
+			{Name: "created_at", T: runtime.DuckDBTypeInfoByNameMust("TIMESTAMP")},
+			{Name: "expires_at", T: runtime.DuckDBTypeInfoByNameMust("TIMESTAMP")},
+		},
+		Execute: func(ctx context.Context) ([]hugrauth.DenylistEntry, error) {
+			if _, err := s.checkAdmin(ctx); err != nil {
+				return nil, err
+			}
+			return s.denylist.Entries(), nil
+		},
+		FillRow: func(e hugrauth.DenylistEntry, row duckdb.Row) error {
+			var expiresAt any
+			if !e.ExpiresAt.IsZero() {
+				expiresAt = e.ExpiresAt.UTC()
+			}
+			for i, v := range []any{e.Kind, e.Value, e.Reason, e.CreatedBy, e.CreatedAt.UTC(), expiresAt} {
+				if err := row.SetRowValue(i, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("register core_denylist_entries: %w", err)
+	}
+
+	// core_denylist_deny(kind, value, reason, ttl) → OperationResult
+	type denyArgs struct {
+		kind   string
+		value  string
+		reason string
+		ttl    int32
+	}
+	err = s.pool.RegisterScalarFunction(ctx, &db.ScalarFunctionWithArgs[denyArgs, *types.OperationResult]{
+		Name: "core_denylist_deny",
+		Execute: func(ctx context.Context, args denyArgs) (*types.OperationResult, error) {
+			info, err := s.checkAdmin(ctx)
+			if err != nil {
+				return types.ErrResult(err), nil
+			}
+			e := hugrauth.DenylistEntry{
+				Kind:      args.kind,
+				Value:     args.value,
+				Reason:    args.reason,
+				CreatedAt: time.Now(),
+			}
+			if info != nil {
+				e.CreatedBy = info.UserId
+			}
+			if args.ttl > 0 {
+				e.ExpiresAt = e.CreatedAt.Add(time.Duration(args.ttl) * time.Second)
+			}
+			if err := s.Deny(ctx, e); err != nil {
+				return types.ErrResult(err), nil
+			}
+			return types.Result("denied", 1, 0), nil
+		},
+		ConvertInput: func(args []driver.Value) (denyArgs, error) {
+			a := denyArgs{kind: args[0].(string), value: args[1].(string)}
+			if args[2] != nil {
+				a.reason = args[2].(string)
+			}
+			if args[3] != nil {
+				a.ttl = args[3].(int32)
+			}
+			return a, nil
+		},
+		ConvertOutput: func(out *types.OperationResult) (any, error) {
+			return out.ToDuckdb(), nil
+		},
+		InputTypes: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("INTEGER"),
+		},
+		OutputType:            db.DuckDBOperationResult(),
+		IsSpecialNullHandling: true,
+	})
+	if err != nil {
+		return fmt.Errorf("register core_denylist_deny: %w", err)
+	}
+
+	// core_denylist_allow(kind, value) → OperationResult
+	type allowArgs struct {
+		kind  string
+		value string
+	}
+	err = s.pool.RegisterScalarFunction(ctx, &db.ScalarFunctionWithArgs[allowArgs, *types.OperationResult]{
+		Name: "core_denylist_allow",
+		Execute: func(ctx context.Context, args allowArgs) (*types.OperationResult, error) {
+			if _, err := s.checkAdmin(ctx); err != nil {
+				return types.ErrResult(err), nil
+			}
+			n, err := s.Allow(ctx, args.kind, args.value)
+			if err != nil {
+				return types.ErrResult(err), nil
+			}
+			return types.Result("allowed", n, 0), nil
+		},
+		ConvertInput: func(args []driver.Value) (allowArgs, error) {
+			return allowArgs{kind: args[0].(string), value: args[1].(string)}, nil
+		},
+		ConvertOutput: func(out *types.OperationResult) (any, error) {
+			return out.ToDuckdb(), nil
+		},
+		InputTypes: []duckdb.TypeInfo{
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+			runtime.DuckDBTypeInfoByNameMust("VARCHAR"),
+		},
+		OutputType: db.DuckDBOperationResult(),
+	})
+	if err != nil {
+		return fmt.Errorf("register core_denylist_allow: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package denylist
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	hugrauth "github.com/hugr-lab/hugr/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/auth"
+	"github.com/hugr-lab/query-engine/pkg/db"
+)
+
+// newCorePool creates the in-memory DuckDB pool with the attached in-memory core database.
+func newCorePool(t *testing.T) *db.Pool {
+	t.Helper()
+	pool, err := db.NewPool("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	if _, err := pool.Exec(t.Context(), `ATTACH ':memory:' AS core`); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestSource_DenyAllow(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	pool := newCorePool(t)
+
+	dl := hugrauth.NewDenylist(hugrauth.DenylistConfig{Enabled: true, RefreshInterval: time.Hour})
+	s := New(dl, false)
+	if err := s.Attach(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Deny(ctx, hugrauth.DenylistEntry{Kind: "token", Value: "x"}); err == nil {
+		t.Error("unknown kind must be rejected")
+	}
+	err := s.Deny(ctx, hugrauth.DenylistEntry{Kind: hugrauth.DenySubject, Value: "bob", Reason: "left the company"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Deny(ctx, hugrauth.DenylistEntry{
+		Kind: hugrauth.DenyJTI, Value: "token-1",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, denied := dl.Check(&auth.AuthInfo{UserId: "bob"}); !denied {
+		t.Error("subject is not denied on the node")
+	}
+
+	// the other node loads the entries from the core db
+	other := hugrauth.NewDenylist(hugrauth.DenylistConfig{Enabled: true})
+	ro := New(other, true)
+	ro.pool = pool
+	if err := ro.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	entries := other.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(entries))
+	}
+	if entries[0].Reason != "left the company" || !entries[0].ExpiresAt.IsZero() {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+	if entries[1].ExpiresAt.IsZero() {
+		t.Errorf("expiration is not loaded: %+v", entries[1])
+	}
+	if _, err := ro.Allow(ctx, hugrauth.DenySubject, "bob"); err == nil {
+		t.Error("read-only node must not change the denylist")
+	}
+
+	n, err := s.Allow(ctx, hugrauth.DenySubject, "bob")
+	if err != nil || n != 1 {
+		t.Fatalf("allow: %d, %v", n, err)
+	}
+	if err := ro.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, denied := other.Check(&auth.AuthInfo{UserId: "bob"}); denied {
+		t.Error("removed subject is still denied on the other node")
+	}
+}
+
+func TestSource_RefreshRemovesExpired(t *testing.T) {
+	ctx := t.Context()
+	pool := newCorePool(t)
+	dl := hugrauth.NewDenylist(hugrauth.DenylistConfig{Enabled: true})
+	s := New(dl, false)
+	s.pool = pool
+	if _, err := pool.Exec(ctx, createTableSQL); err != nil {
+		t.Fatal(err)
+	}
+	_, err := pool.Exec(ctx, `INSERT INTO core.auth_denylist (kind, value, created_at, expires_at) VALUES
+		('jti', 'old', $1, $2), ('jti', 'new', $1, NULL)`,
+		time.Now().Add(-time.Hour), time.Now().Add(-time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries := dl.Entries(); len(entries) != 1 || entries[0].Value != "new" {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var count int
+	if err := conn.QueryRow(ctx, `SELECT count(*) FROM core.auth_denylist`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expired entries are not removed, rows = %d", count)
+	}
+}
@@ -50,6 +50,7 @@ var _ (rtsources.RuntimeSource) = (*Source)(nil)
 
 type Source struct {
 	info NodeInfo
+	pool *db.Pool
 }
 
 func New(info NodeInfo) *Source {
@@ -74,7 +75,14 @@ func (*Source) AsModule() bool {
 	return false
 }
 
+// Pool returns the engine DuckDB pool the source is attached to (nil before attach).
+// It is used by the service endpoints to check and monitor the database.
+func (s *Source) Pool() *db.Pool {
+	return s.pool
+}
+
 func (s *Source) Attach(ctx context.Context, pool *db.Pool) error {
+	s.pool = pool
 	// Register the version UDF
 	err := pool.RegisterScalarFunction(ctx, &db.ScalarFunctionNoArgs[NodeInfo]{
 		Name: "node_version",
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// AdminOperation is a runtime admin operation, it receives the request query
+// parameters and returns the message that describes the result.
+// The operation wraps ErrInvalidParams for the invalid parameters (400), other errors are
+// reported as the internal failures (500).
+type AdminOperation func(ctx context.Context, params url.Values) (string, error)
+
+// ErrInvalidParams is returned by the admin operations for the invalid request parameters.
+var ErrInvalidParams = errors.New("invalid parameters")
+
+// AdminResult is the JSON body returned by the admin endpoints.
+type AdminResult struct {
+	Operation string `json:"operation"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+}
+
+// AddAdminOperation registers the operation on POST /admin/<name>.
+// The admin endpoints require the service authentication, if it is not configured
+// the operation is not registered.
+// Each call is logged with the operator identity.
+func (s *Service) AddAdminOperation(name string, op AdminOperation) {
+	if !s.config.Auth.enabled() {
+		return
+	}
+	s.mux.Handle("POST /admin/"+name, s.protect(s.adminHandler(name, op)))
+}
+
+func (s *Service) adminHandler(name string, op AdminOperation) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		operator := IdentityFromContext(r.Context())
+		if onBehalf := r.Header.Get("X-Operator"); onBehalf != "" {
+			operator += " (on behalf of " + onBehalf + ")"
+		}
+		log.Printf("Admin: operation %s requested by %s from %s, params: %s", name, operator, r.RemoteAddr, params.Encode())
+
+		res := AdminResult{Operation: name, Success: true}
+		status := http.StatusOK
+		msg, err := op(r.Context(), params)
+		if err != nil {
+			log.Printf("Admin: operation %s by %s failed: %v", name, operator, err)
+			res.Success = false
+			res.Message = err.Error()
+			status = http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidParams) {
+				status = http.StatusBadRequest
+			}
+		} else {
+			log.Printf("Admin: operation %s by %s completed: %s", name, operator, msg)
+			res.Message = msg
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+// LogLevelOperation changes the minimal level of the leveled (slog) logs (debug, info, warn, error),
+// the level is passed in the level query parameter. The standard log lines are not leveled and
+// always written, so the admin operations and the auth events are not hidden by the level.
+func LogLevelOperation(ctx context.Context, params url.Values) (string, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(params.Get("level"))); err != nil {
+		return "", fmt.Errorf("%w: log level %q: %v", ErrInvalidParams, params.Get("level"), err)
+	}
+	prev := slog.SetLogLoggerLevel(level)
+	return fmt.Sprintf("log level changed from %s to %s", prev, level), nil
+}
+
+// DebugOperation returns the operation that switches the SQL debug output of the query engine,
+// the enabled query parameter is true or false.
+func DebugOperation(set func(enabled bool)) AdminOperation {
+	return func(ctx context.Context, params url.Values) (string, error) {
+		enabled, err := strconv.ParseBool(params.Get("enabled"))
+		if err != nil {
+			return "", fmt.Errorf("%w: enabled %q: %v", ErrInvalidParams, params.Get("enabled"), err)
+		}
+		set(enabled)
+		return fmt.Sprintf("debug output enabled: %t", enabled), nil
+	}
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAdminOperations_RequireAuth(t *testing.T) {
+	s := New(Config{})
+	s.AddAdminOperation("noop", func(ctx context.Context, params url.Values) (string, error) {
+		return "done", nil
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/admin/noop", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404 (admin disabled without service auth)", w.Code)
+	}
+}
+
+func TestAdminOperations(t *testing.T) {
+	s := New(Config{Auth: AuthConfig{Username: "ops", Password: "pass"}})
+	var gotOperator string
+	s.AddAdminOperation("noop", func(ctx context.Context, params url.Values) (string, error) {
+		gotOperator = IdentityFromContext(ctx)
+		switch params.Get("fail") {
+		case "params":
+			return "", fmt.Errorf("%w: bad value", ErrInvalidParams)
+		case "internal":
+			return "", errors.New("failed")
+		}
+		return "done", nil
+	})
+
+	call := func(method, target string, auth bool) (int, AdminResult) {
+		req := httptest.NewRequest(method, target, nil)
+		if auth {
+			req.SetBasicAuth("ops", "pass")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		var res AdminResult
+		json.NewDecoder(w.Body).Decode(&res)
+		return w.Code, res
+	}
+
+	if code, _ := call("POST", "/admin/noop", false); code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d, want 401", code)
+	}
+	if code, _ := call("GET", "/admin/noop", true); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d, want 405", code)
+	}
+	code, res := call("POST", "/admin/noop", true)
+	if code != http.StatusOK || !res.Success || res.Message != "done" {
+		t.Fatalf("got %d %+v, want 200 success", code, res)
+	}
+	if gotOperator != "ops" {
+		t.Fatalf("operator = %q, want ops", gotOperator)
+	}
+	code, res = call("POST", "/admin/noop?fail=params", true)
+	if code != http.StatusBadRequest || res.Success {
+		t.Fatalf("got %d %+v, want 400 failure", code, res)
+	}
+	code, res = call("POST", "/admin/noop?fail=internal", true)
+	if code != http.StatusInternalServerError || res.Success {
+		t.Fatalf("got %d %+v, want 500 failure", code, res)
+	}
+}
+
+func TestLogLevelOperation(t *testing.T) {
+	prev := slog.SetLogLoggerLevel(slog.LevelInfo)
+	defer slog.SetLogLoggerLevel(prev)
+
+	if _, err := LogLevelOperation(context.Background(), url.Values{"level": {"debug"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug level is not enabled")
+	}
+	if _, err := LogLevelOperation(context.Background(), url.Values{"level": {"verbose"}}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("invalid level error = %v, want ErrInvalidParams", err)
+	}
+}
+
+func TestDebugOperation(t *testing.T) {
+	var debug bool
+	op := DebugOperation(func(enabled bool) { debug = enabled })
+	if _, err := op(context.Background(), url.Values{"enabled": {"true"}}); err != nil || !debug {
+		t.Fatalf("enable debug: %v, debug = %t", err, debug)
+	}
+	if _, err := op(context.Background(), url.Values{"enabled": {"false"}}); err != nil || debug {
+		t.Fatalf("disable debug: %v, debug = %t", err, debug)
+	}
+	if _, err := op(context.Background(), url.Values{"enabled": {"maybe"}}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("invalid value error = %v, want ErrInvalidParams", err)
+	}
+}
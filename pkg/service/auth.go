@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig holds the credentials to access the protected service endpoints (metrics, debug and admin).
+// The probes (/health, /livez, /startupz, /readyz) are always open.
+// If both the bearer token and the basic credentials are set, any of them is accepted.
+type AuthConfig struct {
+	BearerToken string
+	Username    string
+	Password    string
+}
+
+func (c AuthConfig) enabled() bool {
+	return c.BearerToken != "" || c.Username != ""
+}
+
+// Validate checks that the basic credentials are set together: the user name without the password
+// would accept the empty password and the password without the user name would leave the endpoints open.
+func (c AuthConfig) Validate() error {
+	if c.Username != "" && c.Password == "" {
+		return errors.New("service auth password is required with the user name")
+	}
+	if c.Password != "" && c.Username == "" {
+		return errors.New("service auth user name is required with the password")
+	}
+	return nil
+}
+
+// protect wraps the handler with the authentication check, the extra
+// bearer tokens are accepted in addition to the configured credentials.
+// If no credentials are configured the handler is returned as is.
+func (s *Service) protect(next http.Handler, extraTokens ...string) http.Handler {
+	var tokens []string
+	if s.config.Auth.BearerToken != "" {
+		tokens = append(tokens, s.config.Auth.BearerToken)
+	}
+	for _, t := range extraTokens {
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	basic := s.config.Auth.Username != ""
+	if len(tokens) == 0 && !basic {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, ok := s.authorized(r, tokens, basic); ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, identity)))
+			return
+		}
+		if basic {
+			w.Header().Add("WWW-Authenticate", `Basic realm="hugr-service"`)
+		}
+		if len(tokens) != 0 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="hugr-service"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// authorized checks the request credentials and returns the caller identity:
+// the basic auth user name or "bearer" for the token authentication.
+func (s *Service) authorized(r *http.Request, tokens []string, basic bool) (string, bool) {
+	if got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range tokens {
+			if secureEqual(got, t) {
+				return "bearer", true
+			}
+		}
+		return "", false
+	}
+	if !basic {
+		return "", false
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	// evaluate both comparisons to avoid leaking which one failed
+	userOK := secureEqual(user, s.config.Auth.Username)
+	passOK := secureEqual(pass, s.config.Auth.Password)
+	if !userOK || !passOK {
+		return "", false
+	}
+	return user, true
+}
+
+type identityKeyType string
+
+const identityKey identityKeyType = "serviceIdentity"
+
+// IdentityFromContext returns the identity of the caller authenticated by the service endpoint.
+func IdentityFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey).(string)
+	return id
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
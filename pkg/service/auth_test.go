@@ -0,0 +1,68 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServiceAuth(t *testing.T) {
+	s := New(Config{
+		Profiling:  true,
+		DebugToken: "debug-secret",
+		Auth: AuthConfig{
+			BearerToken: "metrics-secret",
+			Username:    "prometheus",
+			Password:    "scrape",
+		},
+	})
+	s.mux.Handle("/metrics", s.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	s.registerDebugHandlers()
+	s.MarkStarted()
+
+	tests := []struct {
+		name  string
+		path  string
+		setup func(r *http.Request)
+		want  int
+	}{
+		{"metrics without credentials", "/metrics", nil, http.StatusUnauthorized},
+		{"metrics with bearer token", "/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer metrics-secret") }, http.StatusOK},
+		{"metrics with basic auth", "/metrics", func(r *http.Request) { r.SetBasicAuth("prometheus", "scrape") }, http.StatusOK},
+		{"metrics with wrong password", "/metrics", func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }, http.StatusUnauthorized},
+		{"metrics with debug token", "/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer debug-secret") }, http.StatusUnauthorized},
+		{"debug with debug token", "/debug/vars", func(r *http.Request) { r.Header.Set("Authorization", "Bearer debug-secret") }, http.StatusOK},
+		{"debug with basic auth", "/debug/vars", func(r *http.Request) { r.SetBasicAuth("prometheus", "scrape") }, http.StatusOK},
+		{"debug without credentials", "/debug/vars", nil, http.StatusUnauthorized},
+		{"probe is open", "/readyz", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.setup != nil {
+				tt.setup(req)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceAuth_HalfConfigured(t *testing.T) {
+	for _, c := range []AuthConfig{
+		{Username: "prometheus"},
+		{Password: "scrape"},
+		{BearerToken: "metrics-secret", Username: "prometheus"},
+	} {
+		if err := New(Config{Bind: "127.0.0.1:0", Auth: c}).Start(t.Context()); err == nil {
+			t.Errorf("%+v: the half-configured basic auth is accepted", c)
+		}
+	}
+	if err := (AuthConfig{Username: "prometheus", Password: "scrape"}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+	"github.com/hugr-lab/query-engine/pkg/cache"
+	"github.com/hugr-lab/query-engine/pkg/cluster"
+	"github.com/hugr-lab/query-engine/pkg/db"
+)
+
+// Ready made checks for the components of the hugr server.
+
+// DBCheck runs the query on a connection from the pool.
+// It is used to check the DuckDB pool and the attached CoreDB.
+func DBCheck(pool *db.Pool, query string) CheckFunc {
+	return func(ctx context.Context) error {
+		if pool == nil {
+			return errors.New("database is not connected")
+		}
+		conn, err := pool.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var v any
+		return conn.QueryRow(ctx, query).Scan(&v)
+	}
+}
+
+// L2CacheCheck checks the L2 cache backend is reachable.
+func L2CacheCheck(l2 *L2Cache) CheckFunc {
+	return func(ctx context.Context) error {
+		s, err := l2.Store(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = s.Get(ctx, "hugr:service:readyz")
+		if err != nil && !errors.Is(err, store.NotFound{}) {
+			return err
+		}
+		return nil
+	}
+}
+
+// L2Cache lazily connects to the L2 cache backend, the connection
+// is retried on the next call if the backend was unavailable.
+type L2Cache struct {
+	config cache.L2Config
+
+	mu      sync.Mutex
+	store   store.StoreInterface
+	counter l2Counter
+}
+
+// NewL2Cache creates a lazy L2 cache backend client.
+func NewL2Cache(c cache.L2Config) *L2Cache {
+	return &L2Cache{config: c}
+}
+
+// Store returns the connected L2 cache store.
+func (c *L2Cache) Store(ctx context.Context) (store.StoreInterface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store != nil {
+		return c.store, nil
+	}
+	s, err := c.config.Init(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.store = s
+	return s, nil
+}
+
+// Clear removes all items from the L2 cache.
+func (c *L2Cache) Clear(ctx context.Context) error {
+	s, err := c.Store(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Clear(ctx)
+}
+
+// DialCheck checks that a TCP connection can be established with the host of the URL.
+// It is used for the services that have no dedicated health endpoint (e.g. embedder).
+func DialCheck(rawURL string) CheckFunc {
+	return func(ctx context.Context) error {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid url: %w", err)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// ClusterCheck checks that the node is registered in the cluster (heartbeat is running).
+func ClusterCheck(cs *cluster.Source) CheckFunc {
+	return func(ctx context.Context) error {
+		if cs == nil {
+			return errors.New("cluster source is not attached")
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if err := cs.WaitRegistered(ctx); err != nil {
+			return errors.New("node is not registered in the cluster")
+		}
+		return nil
+	}
+}
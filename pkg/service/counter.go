@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/hugr-lab/query-engine/pkg/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// l2Counter increments the counters in the L2 cache backend atomically.
+type l2Counter interface {
+	incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// Incr increments the counter of the key in the L2 cache backend atomically and returns the new value,
+// the counter expires after the ttl since the last increment. The counters are shared by the cluster nodes
+// (e.g. the auth lockout failures), the cache store doesn't provide the atomic increment, so the backend
+// client is connected separately.
+func (c *L2Cache) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	counter, err := c.getCounter(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return counter.incr(ctx, key, ttl)
+}
+
+func (c *L2Cache) getCounter(ctx context.Context) (l2Counter, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counter != nil {
+		return c.counter, nil
+	}
+	switch c.config.Backend {
+	case cache.L2RedisBackend:
+		if len(c.config.Addresses) == 0 {
+			return nil, errors.New("redis addresses are required")
+		}
+		client := redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:    c.config.Addresses,
+			Username: c.config.Username,
+			Password: c.config.Password,
+			DB:       c.config.Database,
+		})
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		c.counter = &redisCounter{client: client}
+	case cache.L2MemcachedBackend:
+		client := memcache.New(c.config.Addresses...)
+		if err := client.Ping(); err != nil {
+			return nil, err
+		}
+		c.counter = &memcacheCounter{client: client}
+	default:
+		return nil, errors.New("unsupported l2 backend type")
+	}
+	return c.counter, nil
+}
+
+// redisCounter increments the counter by INCR and sets its ttl by EXPIRE in the transaction.
+type redisCounter struct {
+	client redis.UniversalClient
+}
+
+func (c *redisCounter) incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		incr = p.Incr(ctx, key)
+		p.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// memcacheCounter increments the counter by INCR, the missing counter is added by ADD,
+// so the concurrent increments are not lost.
+type memcacheCounter struct {
+	client *memcache.Client
+}
+
+func (c *memcacheCounter) incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	expiration := int32(max(1, math.Ceil(ttl.Seconds())))
+	for range 2 {
+		v, err := c.client.Increment(key, 1)
+		if err == nil {
+			if err := c.client.Touch(key, expiration); err != nil {
+				return 0, err
+			}
+			return int64(v), nil
+		}
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			return 0, err
+		}
+		err = c.client.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: expiration})
+		if err == nil {
+			return 1, nil
+		}
+		// the counter is added concurrently, it is incremented on the next try
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 0, err
+		}
+	}
+	return 0, errors.New("memcached counter is not stored")
+}
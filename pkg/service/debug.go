@@ -0,0 +1,69 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// The debug endpoints (enabled by the Profiling config option):
+// /debug/pprof/ - pprof profiles
+// /debug/vars - runtime stats (memory, gc, goroutines, build info)
+// /debug/goroutines - full goroutine stack dump
+
+var startedAt = time.Now()
+
+func (s *Service) registerDebugHandlers() {
+	s.mux.Handle("/debug/pprof/", s.debugAuth(http.HandlerFunc(pprof.Index)))
+	s.mux.Handle("/debug/pprof/cmdline", s.debugAuth(http.HandlerFunc(pprof.Cmdline)))
+	s.mux.Handle("/debug/pprof/profile", s.debugAuth(http.HandlerFunc(pprof.Profile)))
+	s.mux.Handle("/debug/pprof/symbol", s.debugAuth(http.HandlerFunc(pprof.Symbol)))
+	s.mux.Handle("/debug/pprof/trace", s.debugAuth(http.HandlerFunc(pprof.Trace)))
+	s.mux.Handle("/debug/vars", s.debugAuth(http.HandlerFunc(handleRuntimeVars)))
+	s.mux.Handle("/debug/goroutines", s.debugAuth(http.HandlerFunc(handleGoroutineDump)))
+}
+
+// debugAuth protects the debug endpoints with the service credentials
+// or the dedicated debug bearer token if they are configured.
+func (s *Service) debugAuth(next http.Handler) http.Handler {
+	return s.protect(next, s.config.DebugToken)
+}
+
+// RuntimeVars is the runtime stats returned by the /debug/vars endpoint.
+type RuntimeVars struct {
+	GoVersion  string           `json:"go_version"`
+	Uptime     string           `json:"uptime"`
+	NumCPU     int              `json:"num_cpu"`
+	GOMAXPROCS int              `json:"gomaxprocs"`
+	Goroutines int              `json:"goroutines"`
+	CgoCalls   int64            `json:"cgo_calls"`
+	MemStats   runtime.MemStats `json:"memstats"`
+	Build      *debug.BuildInfo `json:"build,omitempty"`
+}
+
+func handleRuntimeVars(w http.ResponseWriter, r *http.Request) {
+	vars := RuntimeVars{
+		GoVersion:  runtime.Version(),
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		CgoCalls:   runtime.NumCgoCall(),
+	}
+	runtime.ReadMemStats(&vars.MemStats)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		vars.Build = bi
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars)
+}
+
+// handleGoroutineDump writes the stack traces of all goroutines in the panic output format.
+func handleGoroutineDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hugr-lab/query-engine/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultDuckDBMetricsInterval = 15 * time.Second
+
+// DuckDBMetrics periodically samples the embedded DuckDB engine state
+// and publishes it as prometheus gauges:
+// - memory usage and temporary storage by the DuckDB memory tag (duckdb_memory())
+// - temporary files count and size (duckdb_temporary_files())
+// - memory and temp directory limits in effect (current_setting())
+// - configured pool connection limits
+// - loaded extensions
+// The open, idle and in use connections are not exported: the query engine pool doesn't expose its stats.
+// The values are sampled in the background, so the scrape doesn't query the database.
+type DuckDBMetrics struct {
+	pool     *db.Pool
+	config   db.Config
+	interval time.Duration
+
+	memoryUsage      *prometheus.GaugeVec
+	temporaryStorage *prometheus.GaugeVec
+	tempFiles        prometheus.Gauge
+	tempFilesSize    prometheus.Gauge
+	memoryLimit      prometheus.Gauge
+	tempSizeLimit    prometheus.Gauge
+	poolMaxConns     *prometheus.GaugeVec
+	extensions       *prometheus.GaugeVec
+	sampleErrors     prometheus.Counter
+	sampleDuration   prometheus.Gauge
+}
+
+// NewDuckDBMetrics creates the DuckDB metrics exporter for the pool, the interval
+// defines how often the metrics are sampled (default 15s).
+func NewDuckDBMetrics(pool *db.Pool, config db.Config, interval time.Duration) *DuckDBMetrics {
+	if interval <= 0 {
+		interval = defaultDuckDBMetricsInterval
+	}
+	return &DuckDBMetrics{
+		pool:     pool,
+		config:   config,
+		interval: interval,
+		memoryUsage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_memory_usage_bytes",
+			Help: "DuckDB memory usage by the memory tag (duckdb_memory()).",
+		}, []string{"tag"}),
+		temporaryStorage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_temporary_storage_bytes",
+			Help: "DuckDB data spilled to the temporary storage by the memory tag (duckdb_memory()).",
+		}, []string{"tag"}),
+		tempFiles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_temp_files",
+			Help: "Number of DuckDB temporary files.",
+		}),
+		tempFilesSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_temp_directory_bytes",
+			Help: "Total size of the DuckDB temporary files.",
+		}),
+		memoryLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_memory_limit_bytes",
+			Help: "DuckDB memory limit in effect (memory_limit setting).",
+		}),
+		tempSizeLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_temp_directory_limit_bytes",
+			Help: "DuckDB temp directory size limit in effect (max_temp_directory_size setting), 0 - relative to the available disk space.",
+		}),
+		poolMaxConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_pool_max_connections",
+			Help: "Configured DuckDB pool connection limits by kind (open, idle), 0 - unlimited.",
+		}, []string{"kind"}),
+		extensions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_extension_loaded",
+			Help: "DuckDB extensions loaded in the database (always 1).",
+		}, []string{"name", "version"}),
+		sampleErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "hugr_duckdb_metrics_sample_errors_total",
+			Help: "Number of failed DuckDB metrics samples.",
+		}),
+		sampleDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hugr_duckdb_metrics_sample_duration_seconds",
+			Help: "Duration of the last DuckDB metrics sample.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *DuckDBMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *DuckDBMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *DuckDBMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.memoryUsage, m.temporaryStorage, m.tempFiles, m.tempFilesSize,
+		m.memoryLimit, m.tempSizeLimit, m.poolMaxConns,
+		m.extensions, m.sampleErrors, m.sampleDuration,
+	}
+}
+
+// Run samples the metrics until the context is done.
+func (m *DuckDBMetrics) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Sample(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("DuckDB metrics: sample error: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample queries the DuckDB state and updates the gauges.
+func (m *DuckDBMetrics) Sample(ctx context.Context) error {
+	start := time.Now()
+	err := m.sample(ctx)
+	m.sampleDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		m.sampleErrors.Inc()
+	}
+	return err
+}
+
+func (m *DuckDBMetrics) sample(ctx context.Context) error {
+	m.poolMaxConns.WithLabelValues("open").Set(float64(m.config.MaxOpenConns))
+	m.poolMaxConns.WithLabelValues("idle").Set(float64(m.config.MaxIdleConns))
+
+	conn, err := m.pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the limits are read from the database, so the DuckDB defaults are reported as well
+	var memoryLimit, tempLimit string
+	err = conn.QueryRow(ctx, `SELECT current_setting('memory_limit'), current_setting('max_temp_directory_size')`).Scan(&memoryLimit, &tempLimit)
+	if err != nil {
+		return err
+	}
+	for _, l := range []struct {
+		value string
+		gauge prometheus.Gauge
+	}{{memoryLimit, m.memoryLimit}, {tempLimit, m.tempSizeLimit}} {
+		if strings.Contains(l.value, "%") {
+			// the default temp directory limit is the percentage of the available disk space
+			l.gauge.Set(0)
+			continue
+		}
+		n, err := parseDuckDBSize(l.value)
+		if err != nil {
+			return err
+		}
+		l.gauge.Set(n)
+	}
+
+	rows, err := conn.Query(ctx, `SELECT tag, memory_usage_bytes, temporary_storage_bytes FROM duckdb_memory()`)
+	if err != nil {
+		return err
+	}
+	m.memoryUsage.Reset()
+	m.temporaryStorage.Reset()
+	for rows.Next() {
+		var tag string
+		var usage, temp int64
+		if err := rows.Scan(&tag, &usage, &temp); err != nil {
+			rows.Close()
+			return err
+		}
+		m.memoryUsage.WithLabelValues(tag).Set(float64(usage))
+		m.temporaryStorage.WithLabelValues(tag).Set(float64(temp))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var files, size int64
+	err = conn.QueryRow(ctx, `SELECT count(*), coalesce(sum(size), 0) FROM duckdb_temporary_files()`).Scan(&files, &size)
+	if err != nil {
+		return err
+	}
+	m.tempFiles.Set(float64(files))
+	m.tempFilesSize.Set(float64(size))
+
+	rows, err = conn.Query(ctx, `SELECT extension_name, coalesce(extension_version, '') FROM duckdb_extensions() WHERE loaded`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m.extensions.Reset()
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			return err
+		}
+		m.extensions.WithLabelValues(name, version).Set(1)
+	}
+	return rows.Err()
+}
+
+var duckDBSizeUnits = map[string]float64{
+	"bytes": 1, "b": 1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12, "pb": 1e15,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40, "pib": 1 << 50,
+}
+
+// parseDuckDBSize parses the size setting of DuckDB (e.g. "12.5 GiB") into bytes.
+func parseDuckDBSize(s string) (float64, error) {
+	num, unit, _ := strings.Cut(strings.TrimSpace(s), " ")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DuckDB size %q: %w", s, err)
+	}
+	if unit == "" {
+		return n, nil
+	}
+	mul, ok := duckDBSizeUnits[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok {
+		return 0, fmt.Errorf("invalid DuckDB size unit %q", s)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hugr-lab/query-engine/pkg/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDuckDBMetrics_Sample(t *testing.T) {
+	pool, err := db.NewPool("")
+	if err != nil {
+		t.Fatalf("create pool: %v", err)
+	}
+	defer pool.Close()
+
+	// the DuckDB default limits are reported, the pool is not configured by the settings
+	m := NewDuckDBMetrics(pool, db.Config{MaxOpenConns: 4}, 0)
+	if err := m.Sample(context.Background()); err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(m); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if n := testutil.CollectAndCount(m, "hugr_duckdb_memory_usage_bytes"); n == 0 {
+		t.Fatal("expected memory usage by tag")
+	}
+	if v := testutil.ToFloat64(m.memoryLimit); v <= 0 {
+		t.Fatalf("memory limit = %v, want the DuckDB default", v)
+	}
+	if _, err := pool.Exec(context.Background(), "SET memory_limit = '2GiB'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sample(context.Background()); err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+	if v := testutil.ToFloat64(m.memoryLimit); v != 2<<30 {
+		t.Fatalf("memory limit = %v, want 2GiB", v)
+	}
+	if v := testutil.ToFloat64(m.poolMaxConns.WithLabelValues("open")); v != 4 {
+		t.Fatalf("max open connections = %v, want 4", v)
+	}
+	if v := testutil.ToFloat64(m.sampleErrors); v != 0 {
+		t.Fatalf("sample errors = %v, want 0", v)
+	}
+}
+
+func TestParseDuckDBSize(t *testing.T) {
+	for in, want := range map[string]float64{
+		"12.5 GiB":  12.5 * (1 << 30),
+		"953.6 MiB": 953.6 * (1 << 20),
+		"1.0 GB":    1e9,
+		"0 bytes":   0,
+		"512":       512,
+	} {
+		got, err := parseDuckDBSize(in)
+		if err != nil || got != want {
+			t.Errorf("parseDuckDBSize(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseDuckDBSize("lots"); err == nil {
+		t.Error("invalid size is accepted")
+	}
+}
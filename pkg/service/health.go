@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultCheckTimeout = 5 * time.Second
+
+// Probe statuses reported in the JSON responses of the probe endpoints.
+const (
+	StatusOK       = "ok"
+	StatusFail     = "fail"
+	StatusStarting = "starting"
+)
+
+// CheckFunc reports the state of a single component,
+// a nil error means that the component is healthy.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// CheckResult is the result of a single readiness check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ProbeResponse is the JSON body returned by the probe endpoints.
+type ProbeResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type health struct {
+	mu      sync.RWMutex
+	checks  []check
+	started bool
+	timeout time.Duration
+}
+
+// AddCheck registers a named readiness check.
+// Checks can be added at any time, for example after the engine is initialized.
+func (s *Service) AddCheck(name string, fn CheckFunc) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.checks = append(s.health.checks, check{name: name, fn: fn})
+}
+
+// SetCheckTimeout sets the timeout for each readiness check (default 5s).
+func (s *Service) SetCheckTimeout(d time.Duration) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.timeout = d
+}
+
+// MarkStarted marks the server start up as completed.
+// Until it is called the startup and readiness probes report 503.
+func (s *Service) MarkStarted() {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	s.health.started = true
+}
+
+// Started reports whether the server start up is completed.
+func (s *Service) Started() bool {
+	s.health.mu.RLock()
+	defer s.health.mu.RUnlock()
+	return s.health.started
+}
+
+// Ready runs all registered checks concurrently and returns the results by check name.
+func (s *Service) Ready(ctx context.Context) (bool, map[string]CheckResult) {
+	s.health.mu.RLock()
+	checks := s.health.checks
+	timeout := s.health.timeout
+	s.health.mu.RUnlock()
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+
+	results := make(map[string]CheckResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.fn(ctx)
+			res := CheckResult{
+				Status:    StatusOK,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				res.Status = StatusFail
+				res.Error = err.Error()
+			}
+			mu.Lock()
+			results[c.name] = res
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	ready := true
+	for _, res := range results {
+		if res.Status != StatusOK {
+			ready = false
+		}
+	}
+	return ready, results
+}
+
+// handleLive reports that the process is running and serving requests.
+func (s *Service) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, http.StatusOK, ProbeResponse{Status: StatusOK})
+}
+
+// handleStartup reports whether the engine initialization is completed.
+func (s *Service) handleStartup(w http.ResponseWriter, r *http.Request) {
+	if !s.Started() {
+		writeProbe(w, http.StatusServiceUnavailable, ProbeResponse{Status: StatusStarting})
+		return
+	}
+	writeProbe(w, http.StatusOK, ProbeResponse{Status: StatusOK})
+}
+
+// handleReady runs the readiness checks, the error messages of the failed
+// checks are returned only with the verbose query parameter.
+func (s *Service) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.Started() {
+		writeProbe(w, http.StatusServiceUnavailable, ProbeResponse{Status: StatusStarting})
+		return
+	}
+	ready, results := s.Ready(r.Context())
+	if !r.URL.Query().Has("verbose") {
+		for name, res := range results {
+			res.Error = ""
+			results[name] = res
+		}
+	}
+	resp := ProbeResponse{Status: StatusOK, Checks: results}
+	status := http.StatusOK
+	if !ready {
+		resp.Status = StatusFail
+		status = http.StatusServiceUnavailable
+	}
+	writeProbe(w, status, resp)
+}
+
+func writeProbe(w http.ResponseWriter, status int, resp ProbeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
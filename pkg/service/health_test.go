@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func probe(t *testing.T, s *Service, path string) (int, ProbeResponse) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", s.handleLive)
+	mux.HandleFunc("/startupz", s.handleStartup)
+	mux.HandleFunc("/readyz", s.handleReady)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var resp ProbeResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode %s: %v", path, err)
+	}
+	return w.Code, resp
+}
+
+func TestProbes_BeforeStartup(t *testing.T) {
+	s := New(Config{})
+	s.AddCheck("ok", func(ctx context.Context) error { return nil })
+
+	if code, _ := probe(t, s, "/livez"); code != http.StatusOK {
+		t.Fatalf("livez = %d, want 200", code)
+	}
+	if code, resp := probe(t, s, "/startupz"); code != http.StatusServiceUnavailable || resp.Status != StatusStarting {
+		t.Fatalf("startupz = %d %q, want 503 starting", code, resp.Status)
+	}
+	if code, _ := probe(t, s, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz = %d, want 503", code)
+	}
+}
+
+func TestProbes_Readiness(t *testing.T) {
+	s := New(Config{})
+	s.AddCheck("coredb", func(ctx context.Context) error { return nil })
+	s.MarkStarted()
+
+	if code, _ := probe(t, s, "/startupz"); code != http.StatusOK {
+		t.Fatalf("startupz = %d, want 200", code)
+	}
+	code, resp := probe(t, s, "/readyz")
+	if code != http.StatusOK || resp.Status != StatusOK {
+		t.Fatalf("readyz = %d %q, want 200 ok", code, resp.Status)
+	}
+	if resp.Checks["coredb"].Status != StatusOK {
+		t.Fatalf("coredb check = %+v, want ok", resp.Checks["coredb"])
+	}
+
+	s.AddCheck("cache_l2", func(ctx context.Context) error { return errors.New("connection refused") })
+	code, resp = probe(t, s, "/readyz")
+	if code != http.StatusServiceUnavailable || resp.Status != StatusFail {
+		t.Fatalf("readyz = %d %q, want 503 fail", code, resp.Status)
+	}
+	if res := resp.Checks["cache_l2"]; res.Status != StatusFail || res.Error != "" {
+		t.Fatalf("cache_l2 check = %+v, want fail without error details", res)
+	}
+
+	_, resp = probe(t, s, "/readyz?verbose")
+	if res := resp.Checks["cache_l2"]; res.Error != "connection refused" {
+		t.Fatalf("verbose cache_l2 check = %+v, want error details", res)
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net/http"
@@ -9,37 +10,73 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// THe service http handler - expose health check and metrics for prometheus
+// THe service http handler - expose health check, probes and metrics for prometheus:
+// /livez - liveness probe, the process is running
+// /startupz - startup probe, the engine initialization is completed
+// /readyz - readiness probe, all registered component checks are passed
+// /debug/ - profiling and runtime debug endpoints (see debug.go)
+// /admin/ - runtime admin operations (see admin.go)
+
+type Config struct {
+	Bind string
+	// Profiling enables pprof, runtime stats and goroutine dump endpoints under /debug/
+	Profiling bool
+	// DebugToken is an additional bearer token to access the debug endpoints
+	DebugToken string
+	// TLS enables HTTPS for the service endpoint, if nil plain HTTP is used
+	TLS *tls.Config
+	// Auth protects the metrics, debug and admin endpoints, the probes are always open
+	Auth AuthConfig
+}
 
 type Service struct {
-	bind string
-	mux  *http.ServeMux
-	srv  *http.Server
+	config Config
+	mux    *http.ServeMux
+	srv    *http.Server
+
+	health health
 }
 
-func New(bind string) *Service {
+func New(c Config) *Service {
 	return &Service{
-		bind: bind,
-		mux:  http.NewServeMux(),
+		config: c,
+		mux:    http.NewServeMux(),
 	}
 }
 
 func (s *Service) Start(ctx context.Context) error {
-	if s.bind == "" {
+	if s.config.Bind == "" {
 		return nil
 	}
+	if err := s.config.Auth.Validate(); err != nil {
+		return err
+	}
 	s.mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	s.mux.Handle("/metrics", promhttp.Handler())
+	s.mux.HandleFunc("/livez", s.handleLive)
+	s.mux.HandleFunc("/startupz", s.handleStartup)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	s.mux.Handle("/metrics", s.protect(promhttp.Handler()))
+	if s.config.Profiling {
+		s.registerDebugHandlers()
+	}
+	s.AddAdminOperation("log-level", LogLevelOperation)
 	s.srv = &http.Server{
-		Addr:    s.bind,
-		Handler: s.mux,
+		Addr:      s.config.Bind,
+		Handler:   s.mux,
+		TLSConfig: s.config.TLS,
 	}
 	go func() {
-		log.Printf("Starting service server on %s", s.bind)
-		err := s.srv.ListenAndServe()
+		var err error
+		if s.config.TLS != nil {
+			log.Printf("Starting service server on %s (HTTPS)", s.config.Bind)
+			err = s.srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting service server on %s (HTTP)", s.config.Bind)
+			err = s.srv.ListenAndServe()
+		}
 		if errors.Is(err, http.ErrServerClosed) {
 			log.Println("Service server closed")
 			return
@@ -48,6 +85,11 @@ func (s *Service) Start(ctx context.Context) error {
 			log.Printf("Error starting service: %v", err)
 		}
 	}()
+	if s.config.Auth.enabled() {
+		log.Println("Service server: metrics, debug and admin endpoints require authentication")
+	} else {
+		log.Println("Service server: admin endpoints are disabled, set the service authentication to enable them")
+	}
 	return nil
 }
 